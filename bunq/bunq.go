@@ -1,24 +1,38 @@
 package bunq
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"os"
 	"strconv"
+	"sync"
 
+	"github.com/daanvanberkel/fireflyiiibunq/cassette"
+	"github.com/daanvanberkel/fireflyiiibunq/metrics"
 	"github.com/daanvanberkel/fireflyiiibunq/util"
 	"github.com/sirupsen/logrus"
 )
 
 type BunqClient struct {
-	config   *util.Config
-	session  *BunqSession
-	client   *BunqHttpClient
-	keyChain *util.Keychain
-	log      *logrus.Logger
+	config          *util.Config
+	secret          string
+	session         *BunqSession
+	client          *BunqHttpClient
+	keyChain        *util.Keychain
+	reregistrations int
+	sessionMutex    sync.Mutex
+	reregisterMutex sync.Mutex
+	log             *logrus.Entry
 }
 
-func NewBunqClient(config *util.Config, log *logrus.Logger) (*BunqClient, error) {
-	keyChain, err := util.NewKeyChain(config.StorageLocation+config.BunqConfig.PrivateKeyFileName, config.StorageLocation+config.BunqConfig.PublicKeyFileName, 2048)
+func NewBunqClient(config *util.Config, log *logrus.Entry) (*BunqClient, error) {
+	secret, err := loadSecret(config, log)
+	if err != nil {
+		return nil, err
+	}
+
+	keyChain, err := util.NewKeyChain(config.StorageLocation+config.BunqConfig.PrivateKeyFileName, config.StorageLocation+config.BunqConfig.PublicKeyFileName, config.BunqConfig.KeyBitSize)
 	if err != nil {
 		return nil, err
 	}
@@ -28,33 +42,86 @@ func NewBunqClient(config *util.Config, log *logrus.Logger) (*BunqClient, error)
 		return nil, err
 	}
 	httpClient.SetKeyChain(keyChain)
+	httpClient.SetRateLimit(config.BunqConfig.RequestsPerSecond)
+
+	transport, err := cassette.Transport(config)
+	if err != nil {
+		return nil, err
+	}
+	httpClient.SetTransport(metrics.Transport("bunq", transport))
+
+	// A recording starts a new session, so a replay without the stored session can find the session in the cassette
+	if config.CassetteConfig != nil && config.CassetteConfig.Mode == util.CassetteRecord {
+		if err := os.Remove(config.StorageLocation + config.BunqConfig.SessionServerFileName); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
 
 	client := &BunqClient{
 		config:   config,
+		secret:   secret,
 		keyChain: keyChain,
 		client:   httpClient,
 		log:      log,
 	}
 
 	if err := client.boot(); err != nil {
-		return nil, err
+		var bunqError *BunqError
+		if !errors.As(err, &bunqError) || !bunqError.IsRegistrationInvalid() {
+			return nil, err
+		}
+
+		if err := client.reregister(err); err != nil {
+			return nil, err
+		}
 	}
 	return client, nil
 }
 
+// SessionRestarts returns how often bunq rejected the session of this client
+func (c *BunqClient) SessionRestarts() int {
+	session := c.currentSession()
+	if session == nil {
+		return 0
+	}
+
+	return session.Restarts()
+}
+
+// Close ends the session at bunq when configured, otherwise the session is kept for the next run
+func (c *BunqClient) Close() error {
+	session := c.currentSession()
+	if !c.config.BunqConfig.DeleteSessionOnExit || session == nil {
+		return nil
+	}
+
+	return session.DeleteSession()
+}
+
 // ENDPOINT CALLS
 
-func (c *BunqClient) GetMonetaryBankAccounts() ([]*BunqMonetaryAccountBank, error) {
-	if err := c.startSession(); err != nil {
+// GetUser returns the person, company or api key user the api key belongs to
+func (c *BunqClient) GetUser() (*BunqUser, error) {
+	session, err := c.startSession()
+	if err != nil {
+		return nil, err
+	}
+
+	return session.GetUser()
+}
+
+func (c *BunqClient) GetMonetaryBankAccounts(ctx context.Context) ([]*BunqMonetaryAccountBank, error) {
+	session, err := c.startSession()
+	if err != nil {
 		return nil, err
 	}
 
-	userId, err := c.session.GetUserId()
+	userId, err := session.GetUserId()
 	if err != nil {
 		return nil, err
 	}
 
-	response, err := c.client.DoBunqRequest("GET", "/user/"+strconv.Itoa(userId)+"/monetary-account-bank", nil)
+	response, err := c.client.DoBunqRequest(ctx, "GET", "/user/"+strconv.Itoa(userId)+"/monetary-account-bank", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -72,12 +139,13 @@ func (c *BunqClient) GetMonetaryBankAccounts() ([]*BunqMonetaryAccountBank, erro
 	return result, nil
 }
 
-func (c *BunqClient) GetPayments(monetaryAccountId int, olderThanId int) ([]*BunqPayment, error) {
-	if err := c.startSession(); err != nil {
+func (c *BunqClient) GetPayments(ctx context.Context, monetaryAccountId int, olderThanId int) ([]*BunqPayment, error) {
+	session, err := c.startSession()
+	if err != nil {
 		return nil, err
 	}
 
-	userId, err := c.session.GetUserId()
+	userId, err := session.GetUserId()
 	if err != nil {
 		return nil, err
 	}
@@ -87,7 +155,7 @@ func (c *BunqClient) GetPayments(monetaryAccountId int, olderThanId int) ([]*Bun
 		url += "?older_id=" + strconv.Itoa(olderThanId)
 	}
 
-	response, err := c.client.DoBunqRequest("GET", url, nil)
+	response, err := c.client.DoBunqRequest(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -105,8 +173,209 @@ func (c *BunqClient) GetPayments(monetaryAccountId int, olderThanId int) ([]*Bun
 	return result, nil
 }
 
+// GetPayment returns a single payment, for retrying payments that are older than the payments of the sync
+func (c *BunqClient) GetPayment(ctx context.Context, monetaryAccountId int, paymentId int) (*BunqPayment, error) {
+	session, err := c.startSession()
+	if err != nil {
+		return nil, err
+	}
+
+	userId, err := session.GetUserId()
+	if err != nil {
+		return nil, err
+	}
+
+	url := "/user/" + strconv.Itoa(userId) + "/monetary-account/" + strconv.Itoa(monetaryAccountId) + "/payment/" + strconv.Itoa(paymentId)
+	response, err := c.client.DoBunqRequest(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var paymentResponse BunqPaymentsResponse
+	if err := json.Unmarshal(response, &paymentResponse); err != nil {
+		return nil, err
+	}
+
+	if len(paymentResponse.Response) == 0 || paymentResponse.Response[0].Payment == nil {
+		return nil, errors.New("payment " + strconv.Itoa(paymentId) + " not found in bunq response")
+	}
+
+	return paymentResponse.Response[0].Payment, nil
+}
+
+func (c *BunqClient) GetMastercardActions(ctx context.Context, monetaryAccountId int, olderThanId int) ([]*BunqMastercardAction, error) {
+	session, err := c.startSession()
+	if err != nil {
+		return nil, err
+	}
+
+	userId, err := session.GetUserId()
+	if err != nil {
+		return nil, err
+	}
+
+	url := "/user/" + strconv.Itoa(userId) + "/monetary-account/" + strconv.Itoa(monetaryAccountId) + "/mastercard-action"
+	if olderThanId > 0 {
+		url += "?older_id=" + strconv.Itoa(olderThanId)
+	}
+
+	response, err := c.client.DoBunqRequest(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var mastercardActionResponse BunqMastercardActionsResponse
+	if err := json.Unmarshal(response, &mastercardActionResponse); err != nil {
+		return nil, err
+	}
+
+	result := make([]*BunqMastercardAction, len(mastercardActionResponse.Response))
+	for i, action := range mastercardActionResponse.Response {
+		result[i] = action.MastercardAction
+	}
+
+	return result, nil
+}
+
+// GetPaymentAttachments returns both the receipts attached to the payment and the attachments added as note
+func (c *BunqClient) GetPaymentAttachments(ctx context.Context, monetaryAccountId int, payment *BunqPayment) ([]*BunqPaymentAttachment, error) {
+	session, err := c.startSession()
+	if err != nil {
+		return nil, err
+	}
+
+	userId, err := session.GetUserId()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*BunqPaymentAttachment{}
+	for _, attachment := range payment.Attachment {
+		accountId := attachment.MonetaryAccountId
+		if accountId == 0 {
+			accountId = monetaryAccountId
+		}
+
+		result = append(result, &BunqPaymentAttachment{
+			Id:                attachment.Id,
+			MonetaryAccountId: accountId,
+		})
+	}
+
+	url := "/user/" + strconv.Itoa(userId) + "/monetary-account/" + strconv.Itoa(monetaryAccountId) + "/payment/" + strconv.Itoa(payment.Id) + "/note-attachment"
+	response, err := c.client.DoBunqRequest(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var noteAttachmentResponse BunqNoteAttachmentsResponse
+	if err := json.Unmarshal(response, &noteAttachmentResponse); err != nil {
+		return nil, err
+	}
+
+	for _, item := range noteAttachmentResponse.Response {
+		if item.NoteAttachment == nil {
+			continue
+		}
+
+		result = append(result, &BunqPaymentAttachment{
+			Id:                item.NoteAttachment.AttachmentId,
+			MonetaryAccountId: monetaryAccountId,
+			Description:       item.NoteAttachment.Description,
+		})
+	}
+
+	return result, nil
+}
+
+// GetAttachmentContent downloads the attachment and returns its content with the content type
+func (c *BunqClient) GetAttachmentContent(ctx context.Context, attachment *BunqPaymentAttachment) ([]byte, string, error) {
+	session, err := c.startSession()
+	if err != nil {
+		return nil, "", err
+	}
+
+	userId, err := session.GetUserId()
+	if err != nil {
+		return nil, "", err
+	}
+
+	url := "/user/" + strconv.Itoa(userId) + "/monetary-account/" + strconv.Itoa(attachment.MonetaryAccountId) + "/attachment/" + strconv.Itoa(attachment.Id) + "/content"
+	return c.client.DoBunqContentRequest(ctx, "GET", url)
+}
+
+func (c *BunqClient) GetPaymentNotes(ctx context.Context, monetaryAccountId int, paymentId int) ([]*BunqNoteText, error) {
+	session, err := c.startSession()
+	if err != nil {
+		return nil, err
+	}
+
+	userId, err := session.GetUserId()
+	if err != nil {
+		return nil, err
+	}
+
+	url := "/user/" + strconv.Itoa(userId) + "/monetary-account/" + strconv.Itoa(monetaryAccountId) + "/payment/" + strconv.Itoa(paymentId) + "/note-text"
+	response, err := c.client.DoBunqRequest(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var noteTextResponse BunqNoteTextsResponse
+	if err := json.Unmarshal(response, &noteTextResponse); err != nil {
+		return nil, err
+	}
+
+	result := []*BunqNoteText{}
+	for _, item := range noteTextResponse.Response {
+		if item.NoteText != nil {
+			result = append(result, item.NoteText)
+		}
+	}
+
+	return result, nil
+}
+
+func (c *BunqClient) CreatePaymentNote(ctx context.Context, monetaryAccountId int, paymentId int, content string) error {
+	session, err := c.startSession()
+	if err != nil {
+		return err
+	}
+
+	userId, err := session.GetUserId()
+	if err != nil {
+		return err
+	}
+
+	url := "/user/" + strconv.Itoa(userId) + "/monetary-account/" + strconv.Itoa(monetaryAccountId) + "/payment/" + strconv.Itoa(paymentId) + "/note-text"
+	_, err = c.client.DoBunqRequest(ctx, "POST", url, BunqNoteTextRequest{
+		Content: content,
+	})
+
+	return err
+}
+
 // UTILS
 
+// loadSecret returns the api key, or the access token stored by the OAuth login when no api key is configured
+func loadSecret(config *util.Config, log *logrus.Entry) (string, error) {
+	if config.BunqConfig.ApiKey != "" {
+		return config.BunqConfig.ApiKey, nil
+	}
+
+	token, err := LoadBunqOAuthToken(config)
+	if err != nil {
+		return "", err
+	}
+
+	if token == nil {
+		return "", errors.New("missing bunq api key in env, set BUNQ_API_KEY or run the login command")
+	}
+
+	log.Debug("Use bunq oauth access token as secret")
+	return token.AccessToken, nil
+}
+
 func (c *BunqClient) boot() error {
 	if err := c.loadInstallation(); err != nil {
 		return err
@@ -123,13 +392,8 @@ func (c *BunqClient) loadInstallation() error {
 	// Try to load installation from storage
 	installationPath := c.config.StorageLocation + c.config.BunqConfig.InstallationFileName
 	if _, err := os.Stat(installationPath); err == nil {
-		data, err := os.ReadFile(installationPath)
-		if err != nil {
-			return err
-		}
-
 		var installation BunqInstallationServer
-		if err := json.Unmarshal(data, &installation); err != nil {
+		if err := util.ReadStateFile(installationPath, &installation); err != nil {
 			return err
 		}
 
@@ -139,16 +403,27 @@ func (c *BunqClient) loadInstallation() error {
 	}
 
 	// Generate new installation
-	response, err := c.client.DoBunqRequest("POST", "/installation", BunqInstallationRequest{
-		ClientPublicKey: string(c.keyChain.PublicKeyPem),
-	})
+	installation, err := registerInstallation(c.client, c.keyChain)
 	if err != nil {
 		return err
 	}
 
+	c.client.SetInstallation(installation)
+	return util.WriteStateFile(installationPath, installation)
+}
+
+// registerInstallation registers the public key of the keychain at bunq and returns the new installation
+func registerInstallation(client *BunqHttpClient, keyChain *util.Keychain) (*BunqInstallationServer, error) {
+	response, err := client.DoBunqRequest(context.Background(), "POST", "/installation", BunqInstallationRequest{
+		ClientPublicKey: string(keyChain.PublicKeyPem),
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	var installationResponse BunqInstallationResponse
 	if err := json.Unmarshal(response, &installationResponse); err != nil {
-		return err
+		return nil, err
 	}
 
 	installation := BunqInstallationServer{}
@@ -166,17 +441,7 @@ func (c *BunqClient) loadInstallation() error {
 		}
 	}
 
-	c.client.SetInstallation(&installation)
-	installationJson, err := json.Marshal(installation)
-	if err != nil {
-		return err
-	}
-
-	if err := os.WriteFile(installationPath, installationJson, 0700); err != nil {
-		return err
-	}
-
-	return nil
+	return &installation, nil
 }
 
 func (c *BunqClient) loadDeviceServer() error {
@@ -185,18 +450,28 @@ func (c *BunqClient) loadDeviceServer() error {
 		return nil
 	}
 
-	response, err := c.client.DoBunqRequest("POST", "/device-server", BunqDeviceServerRequest{
-		Description:  c.config.BunqConfig.UserAgent,
-		Secret:       c.config.BunqConfig.ApiKey,
-		PermittedIps: c.config.BunqConfig.PermittedIps,
-	})
+	deviceServer, err := registerDeviceServer(c.client, c.config, c.secret)
 	if err != nil {
 		return err
 	}
 
+	return util.WriteStateFile(deviceServerPath, deviceServer)
+}
+
+// registerDeviceServer registers this device for the secret at bunq, the client must use the installation token
+func registerDeviceServer(client *BunqHttpClient, config *util.Config, secret string) (*BunqDeviceServer, error) {
+	response, err := client.DoBunqRequest(context.Background(), "POST", "/device-server", BunqDeviceServerRequest{
+		Description:  config.BunqConfig.UserAgent,
+		Secret:       secret,
+		PermittedIps: config.BunqConfig.PermittedIps,
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	var deviceServerResponse BunqDeviceServerResponse
 	if err := json.Unmarshal(response, &deviceServerResponse); err != nil {
-		return err
+		return nil, err
 	}
 
 	deviceServer := BunqDeviceServer{}
@@ -206,28 +481,62 @@ func (c *BunqClient) loadDeviceServer() error {
 		}
 	}
 
-	deviceServerJson, err := json.Marshal(deviceServer)
-	if err != nil {
-		return err
+	return &deviceServer, nil
+}
+
+// startSession returns the session, loading or starting it on first use. Concurrent callers share one session.
+func (c *BunqClient) startSession() (*BunqSession, error) {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+
+	if c.session != nil {
+		return c.session, nil
 	}
 
-	if err := os.WriteFile(deviceServerPath, deviceServerJson, 0700); err != nil {
-		return err
+	session, err := NewBunqSession(c.secret, c.config.StorageLocation+c.config.BunqConfig.SessionServerFileName, c.client, c.reregister, c.log)
+	if err != nil {
+		return nil, err
 	}
+	c.session = session
 
-	return nil
+	return session, nil
 }
 
-func (c *BunqClient) startSession() error {
-	if c.session != nil {
-		return nil
+func (c *BunqClient) currentSession() *BunqSession {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+
+	return c.session
+}
+
+// reregister throws away the stored installation, device server and session after bunq rejected them, for example
+// because the api key was regenerated, the ip address changed or the installation was revoked, and registers again.
+func (c *BunqClient) reregister(cause error) error {
+	c.reregisterMutex.Lock()
+	defer c.reregisterMutex.Unlock()
+
+	log := c.log.WithError(cause).WithField("attempt", c.reregistrations+1)
+
+	if c.reregistrations >= c.config.BunqConfig.MaxReregistrations {
+		log.Error("Bunq rejected the registration, but the maximum number of re-registrations is reached")
+		return errors.New("bunq registration is invalid and maximum number of re-registrations is reached")
 	}
+	c.reregistrations++
 
-	session, err := NewBunqSession(c.config.BunqConfig.ApiKey, c.config.StorageLocation+c.config.BunqConfig.SessionServerFileName, c.client, c.log)
-	if err != nil {
+	log.Warn("Bunq rejected the stored registration, register installation and device server again")
+	for _, fileName := range []string{c.config.BunqConfig.InstallationFileName, c.config.BunqConfig.DeviceServerFileName, c.config.BunqConfig.SessionServerFileName} {
+		if err := os.Remove(c.config.StorageLocation + fileName); err != nil && !os.IsNotExist(err) {
+			log.WithError(err).Error("Cannot remove stored bunq registration")
+			return err
+		}
+	}
+	c.client.SetInstallation(nil)
+
+	if err := c.boot(); err != nil {
+		log.WithError(err).Error("Registering installation and device server again failed")
 		return err
 	}
-	c.session = session
 
+	log.Info("Registered new bunq installation and device server")
 	return nil
 }
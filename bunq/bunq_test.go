@@ -0,0 +1,229 @@
+package bunq_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/bunq"
+	"github.com/daanvanberkel/fireflyiiibunq/bunqtest"
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestConfig(server *bunqtest.Server, storageLocation string) *util.Config {
+	return &util.Config{
+		StorageLocation: storageLocation,
+		BunqConfig: &util.BunqConfig{
+			ApiBaseUrl:            server.URL,
+			ApiKey:                "sandbox_test_api_key",
+			PrivateKeyFileName:    "bunq_client.key",
+			PublicKeyFileName:     "bunq_client.pub.key",
+			KeyBitSize:            2048,
+			InstallationFileName:  "bunq_installation.json",
+			DeviceServerFileName:  "bunq_device_server.json",
+			SessionServerFileName: "bunq_session_server.json",
+			UserAgent:             "BunqFireflySync/test",
+			PermittedIps:          []string{"*"},
+			MaxReregistrations:    1,
+		},
+	}
+}
+
+func newTestLog() *logrus.Entry {
+	log := logrus.New()
+	log.Out = io.Discard
+
+	return logrus.NewEntry(log)
+}
+
+func newTestClient(t *testing.T, server *bunqtest.Server, storageLocation string) *bunq.BunqClient {
+	t.Helper()
+
+	client, err := bunq.NewBunqClient(newTestConfig(server, storageLocation), newTestLog())
+	if err != nil {
+		t.Fatalf("cannot create bunq client: %v", err)
+	}
+
+	return client
+}
+
+func startTestServer(t *testing.T, fixtures *bunqtest.Fixtures) *bunqtest.Server {
+	t.Helper()
+
+	server, err := bunqtest.Start(fixtures)
+	if err != nil {
+		t.Fatalf("cannot start fake bunq server: %v", err)
+	}
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestClientRegistersAndLoadsAccounts(t *testing.T) {
+	server := startTestServer(t, bunqtest.DefaultFixtures())
+	client := newTestClient(t, server, t.TempDir()+"/")
+
+	user, err := client.GetUser()
+	if err != nil {
+		t.Fatalf("cannot get user: %v", err)
+	}
+	if user.Id != 100 || user.Type != bunq.UserPersonType {
+		t.Errorf("unexpected user %+v", user)
+	}
+
+	accounts, err := client.GetMonetaryBankAccounts(context.Background())
+	if err != nil {
+		t.Fatalf("cannot get accounts: %v", err)
+	}
+	if len(accounts) != 2 {
+		t.Fatalf("expected 2 accounts, got %d", len(accounts))
+	}
+
+	payments, err := client.GetPayments(context.Background(), accounts[0].Id, 0)
+	if err != nil {
+		t.Fatalf("cannot get payments: %v", err)
+	}
+	if len(payments) != 4 || payments[0].Id != 5004 {
+		t.Errorf("expected 4 payments starting with the newest, got %d", len(payments))
+	}
+}
+
+func TestClientPaginatesPayments(t *testing.T) {
+	fixtures := bunqtest.DefaultFixtures()
+	account := fixtures.Accounts[0]
+	account.Payments = nil
+	for i := 1; i <= 25; i++ {
+		account.Payments = append(account.Payments, bunqtest.Payment(i, account.Account, "-1.00", fmt.Sprint("Payment ", i), "NL00SHOP0000000001", "Shop", time.Now().Add(-time.Duration(i)*time.Minute)))
+	}
+
+	server := startTestServer(t, fixtures)
+	client := newTestClient(t, server, t.TempDir()+"/")
+
+	seen := 0
+	olderId := 0
+	for {
+		payments, err := client.GetPayments(context.Background(), account.Account.Id, olderId)
+		if err != nil {
+			t.Fatalf("cannot get payments: %v", err)
+		}
+		if len(payments) == 0 {
+			break
+		}
+
+		seen += len(payments)
+		olderId = payments[len(payments)-1].Id
+	}
+
+	if seen != 25 {
+		t.Errorf("expected 25 payments over all pages, got %d", seen)
+	}
+}
+
+func TestClientRecoversFromRateLimitAndExpiredSession(t *testing.T) {
+	server := startTestServer(t, bunqtest.DefaultFixtures())
+	client := newTestClient(t, server, t.TempDir()+"/")
+
+	if _, err := client.GetMonetaryBankAccounts(context.Background()); err != nil {
+		t.Fatalf("cannot get accounts: %v", err)
+	}
+
+	server.RateLimit(1)
+	if _, err := client.GetMonetaryBankAccounts(context.Background()); err != nil {
+		t.Errorf("request after rate limit failed: %v", err)
+	}
+
+	server.ExpireSessions()
+	if _, err := client.GetMonetaryBankAccounts(context.Background()); err != nil {
+		t.Errorf("request after session expiry failed: %v", err)
+	}
+}
+
+func TestClientIsSafeForConcurrentUse(t *testing.T) {
+	fixtures := bunqtest.DefaultFixtures()
+	server := startTestServer(t, fixtures)
+	client := newTestClient(t, server, t.TempDir()+"/")
+
+	// The session is started, expired and rate limited while the requests run
+	server.RateLimit(2)
+	server.ExpireSessionsAfter(4)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(accountId int) {
+			defer wg.Done()
+			if _, err := client.GetPayments(context.Background(), accountId, 0); err != nil {
+				errs <- err
+			}
+		}(fixtures.Accounts[i%len(fixtures.Accounts)].Account.Id)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("concurrent request failed: %v", err)
+	}
+}
+
+func TestClientReregistersRevokedInstallation(t *testing.T) {
+	server := startTestServer(t, bunqtest.DefaultFixtures())
+	storageLocation := t.TempDir() + "/"
+
+	if _, err := newTestClient(t, server, storageLocation).GetUser(); err != nil {
+		t.Fatalf("cannot get user: %v", err)
+	}
+
+	server.RevokeInstallations()
+
+	if _, err := newTestClient(t, server, storageLocation).GetMonetaryBankAccounts(context.Background()); err != nil {
+		t.Errorf("request after revoked installation failed: %v", err)
+	}
+}
+
+func TestClientReportsStoredSessionWithoutUser(t *testing.T) {
+	server := startTestServer(t, bunqtest.DefaultFixtures())
+	storageLocation := t.TempDir() + "/"
+	newTestClient(t, server, storageLocation)
+
+	createdAt := time.Now()
+	session := &bunq.BunqSessionServer{Token: &bunq.BunqSessionServerToken{Token: "stored"}, CreatedAt: &createdAt}
+	if err := util.WriteStateFile(storageLocation+"bunq_session_server.json", session); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := newTestClient(t, server, storageLocation).GetUser()
+	if err == nil || !strings.Contains(err.Error(), "no user in session") {
+		t.Errorf("expected the error of the stored session, got %v", err)
+	}
+}
+
+func TestReadStoredSessionReportsExpiredSession(t *testing.T) {
+	server := startTestServer(t, bunqtest.DefaultFixtures())
+	storageLocation := t.TempDir() + "/"
+	config := newTestConfig(server, storageLocation)
+
+	if _, err := newTestClient(t, server, storageLocation).GetUser(); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := bunq.ReadStoredSession(config)
+	if err != nil {
+		t.Fatalf("expected the started session to be valid, got %v", err)
+	}
+
+	// The session timeout of the user has passed since the session was created
+	createdAt := time.Now().Add(-time.Duration(stored.SessionTimeout+1) * time.Second)
+	stored.CreatedAt = &createdAt
+	if err := util.WriteStateFile(storageLocation+config.BunqConfig.SessionServerFileName, stored); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bunq.ReadStoredSession(config); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("expected the expired session to be reported, got %v", err)
+	}
+}
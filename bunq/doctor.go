@@ -0,0 +1,146 @@
+package bunq
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+	"github.com/sirupsen/logrus"
+)
+
+// DoctorCheck is the result of validating one stored artifact
+type DoctorCheck struct {
+	Artifact string
+	Ok       bool
+	Message  string
+}
+
+// RunDoctor validates the stored keypair, installation, device server and session against the bunq api. Unlike
+// NewBunqClient it never registers a new installation or device server. The stored session is used for the checks, a
+// new session is only started and stored when there is no usable session or bunq rejects the stored one.
+func RunDoctor(config *util.Config, log *logrus.Entry) []*DoctorCheck {
+	checks := []*DoctorCheck{}
+	check := func(artifact string, err error, message string) bool {
+		result := &DoctorCheck{Artifact: artifact, Ok: err == nil, Message: message}
+		if err != nil {
+			result.Message = err.Error()
+		}
+		checks = append(checks, result)
+		return err == nil
+	}
+
+	secret, err := loadSecret(config, log)
+	if !check("secret", err, "api key or oauth access token available") {
+		return checks
+	}
+
+	keyChain, err := util.LoadKeyChain(config.StorageLocation+config.BunqConfig.PrivateKeyFileName, config.StorageLocation+config.BunqConfig.PublicKeyFileName)
+	if !check("keypair", err, "keypair can be loaded and keys belong together") {
+		return checks
+	}
+
+	installation, err := readDoctorInstallation(config)
+	if !check("installation", err, "installation file contains a token and server public key") {
+		return checks
+	}
+
+	deviceServer, err := readDoctorDeviceServer(config)
+	if !check("device server", err, "device server file contains an id") {
+		return checks
+	}
+
+	httpClient, err := NewBunqHttpClient(config.BunqConfig.ApiBaseUrl, config.BunqConfig.UserAgent, log)
+	if !check("api", err, "http client created") {
+		return checks
+	}
+	httpClient.SetKeyChain(keyChain)
+	httpClient.SetInstallation(installation)
+
+	sessionLocation := config.StorageLocation + config.BunqConfig.SessionServerFileName
+	session := &BunqSession{apiKey: secret, sessionLocation: sessionLocation, client: httpClient, log: log}
+	sessionAccepted := false
+	if _, err := os.Stat(sessionLocation); err == nil {
+		if check("session", session.loadSession(), "session file can be loaded") {
+			storedToken := session.sessionServer.Token
+			_, err := session.doctorGetUser()
+			// A rejected session is replaced by the http client, the new session is accepted when the request succeeds
+			sessionAccepted = err == nil
+			if err == nil && storedToken != nil && session.sessionServer.Token != nil && storedToken.Token != session.sessionServer.Token.Token {
+				err = errors.New("stored session was rejected or expired, replaced it with a new session")
+			}
+			check("session", err, "stored session is accepted by bunq")
+		}
+	} else {
+		check("session", nil, "no stored session, a new session is started")
+	}
+
+	// Starting a session validates the installation token, server public key, device server, secret and ip address
+	if sessionAccepted {
+		check("registration", nil, "installation and device server are accepted by bunq")
+	} else if !check("registration", session.StartSession(), "installation, device server and secret are accepted by bunq") {
+		return checks
+	}
+
+	_, err = httpClient.DoBunqRequest(context.Background(), "GET", "/device-server/"+strconv.Itoa(deviceServer.Id.Id), nil)
+	check("device server", err, "stored device server exists at bunq")
+
+	user, err := session.doctorGetUser()
+	if err == nil {
+		check("user", nil, "session belongs to "+string(user.Type)+" "+user.Name)
+	} else {
+		check("user", err, "")
+	}
+
+	return checks
+}
+
+// doctorGetUser requests the user of the session, which fails when bunq does not accept the session token
+func (s *BunqSession) doctorGetUser() (*BunqUser, error) {
+	user, err := s.GetUser()
+	if err != nil {
+		return nil, err
+	}
+
+	path := "/user/" + strconv.Itoa(user.Id)
+	if user.Type == UserApiKeyType {
+		path = "/user-api-key/" + strconv.Itoa(user.Id)
+	}
+
+	if _, err := s.client.DoBunqRequest(context.Background(), "GET", path, nil); err != nil {
+		return nil, err
+	}
+
+	return s.GetUser()
+}
+
+func readDoctorInstallation(config *util.Config) (*BunqInstallationServer, error) {
+	var installation BunqInstallationServer
+	if err := util.ReadStateFile(config.StorageLocation+config.BunqConfig.InstallationFileName, &installation); err != nil {
+		return nil, err
+	}
+
+	if installation.Token == nil || installation.Token.Token == "" {
+		return nil, errors.New("installation has no token")
+	}
+
+	if _, err := installation.GetServerPublicKey(); err != nil {
+		return nil, err
+	}
+
+	return &installation, nil
+}
+
+func readDoctorDeviceServer(config *util.Config) (*BunqDeviceServer, error) {
+	var deviceServer BunqDeviceServer
+	if err := util.ReadStateFile(config.StorageLocation+config.BunqConfig.DeviceServerFileName, &deviceServer); err != nil {
+		return nil, err
+	}
+
+	if deviceServer.Id == nil || deviceServer.Id.Id == 0 {
+		return nil, errors.New("device server has no id")
+	}
+
+	return &deviceServer, nil
+}
@@ -0,0 +1,79 @@
+package bunq_test
+
+import (
+	"testing"
+
+	"github.com/daanvanberkel/fireflyiiibunq/bunq"
+	"github.com/daanvanberkel/fireflyiiibunq/bunqtest"
+)
+
+func sessionStarts(server *bunqtest.Server) int {
+	starts := 0
+	for _, request := range server.Requests() {
+		if request.Method == "POST" && request.Path == "/v1/session-server" {
+			starts++
+		}
+	}
+
+	return starts
+}
+
+// startStoredSession starts and stores a session like a sync run does
+func startStoredSession(t *testing.T, server *bunqtest.Server, storageLocation string) {
+	t.Helper()
+
+	if _, err := newTestClient(t, server, storageLocation).GetUser(); err != nil {
+		t.Fatalf("cannot start session: %v", err)
+	}
+}
+
+func assertDoctorChecksOk(t *testing.T, checks []*bunq.DoctorCheck) {
+	t.Helper()
+
+	for _, check := range checks {
+		if !check.Ok {
+			t.Errorf("expected %s check to pass, got %q", check.Artifact, check.Message)
+		}
+	}
+}
+
+func TestDoctorUsesStoredSession(t *testing.T) {
+	server := startTestServer(t, bunqtest.DefaultFixtures())
+	storageLocation := t.TempDir() + "/"
+	startStoredSession(t, server, storageLocation)
+
+	startsBefore := sessionStarts(server)
+	assertDoctorChecksOk(t, bunq.RunDoctor(newTestConfig(server, storageLocation), newTestLog()))
+
+	if starts := sessionStarts(server) - startsBefore; starts != 0 {
+		t.Errorf("expected the accepted stored session to be used, got %d new sessions", starts)
+	}
+}
+
+func TestDoctorReplacesRejectedSession(t *testing.T) {
+	server := startTestServer(t, bunqtest.DefaultFixtures())
+	storageLocation := t.TempDir() + "/"
+	startStoredSession(t, server, storageLocation)
+	server.ExpireSessions()
+
+	startsBefore := sessionStarts(server)
+	checks := bunq.RunDoctor(newTestConfig(server, storageLocation), newTestLog())
+
+	rejected := false
+	for _, check := range checks {
+		if check.Artifact == "session" && !check.Ok {
+			rejected = true
+			continue
+		}
+		if !check.Ok {
+			t.Errorf("expected %s check to pass, got %q", check.Artifact, check.Message)
+		}
+	}
+	if !rejected {
+		t.Error("expected the session check to report the rejected session")
+	}
+
+	if starts := sessionStarts(server) - startsBefore; starts != 1 {
+		t.Errorf("expected the rejected session to be replaced once, got %d new sessions", starts)
+	}
+}
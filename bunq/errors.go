@@ -0,0 +1,65 @@
+package bunq
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Error descriptions bunq returns when the installation token, api key or ip address of the device server is no
+// longer valid. Descriptions like "Insufficient authorisation." alone are also returned for expired sessions and
+// missing permissions, so only these exact descriptions trigger a new registration.
+var registrationErrorDescriptions = []string{
+	"User credentials are incorrect. Incorrect API key or IP address.",
+	"Incorrect API key or IP address.",
+	"Insufficient authorisation. Installation token is invalid.",
+}
+
+// BunqError is an error response of the bunq api
+type BunqError struct {
+	StatusCode   int
+	Body         string
+	Descriptions []string
+}
+
+func newBunqError(statusCode int, body []byte) *BunqError {
+	bunqError := &BunqError{
+		StatusCode: statusCode,
+		Body:       string(body),
+	}
+
+	var errorResponse struct {
+		Error []struct {
+			ErrorDescription string `json:"error_description"`
+		} `json:"Error"`
+	}
+	if err := json.Unmarshal(body, &errorResponse); err == nil {
+		for _, item := range errorResponse.Error {
+			bunqError.Descriptions = append(bunqError.Descriptions, item.ErrorDescription)
+		}
+	}
+
+	return bunqError
+}
+
+func (e *BunqError) Error() string {
+	return e.Body
+}
+
+// IsRegistrationInvalid reports whether bunq rejected the installation token, api key or ip address of the device
+// server. Only meaningful for errors of requests authenticated with the installation token, like starting a session.
+func (e *BunqError) IsRegistrationInvalid() bool {
+	if e.StatusCode != 400 && e.StatusCode != 401 && e.StatusCode != 403 {
+		return false
+	}
+
+	for _, description := range e.Descriptions {
+		description = strings.TrimSpace(description)
+		for _, registrationError := range registrationErrorDescriptions {
+			if strings.EqualFold(description, registrationError) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,29 @@
+package bunq_test
+
+import (
+	"testing"
+
+	"github.com/daanvanberkel/fireflyiiibunq/bunq"
+)
+
+func TestIsRegistrationInvalid(t *testing.T) {
+	tests := []struct {
+		statusCode  int
+		description string
+		expected    bool
+	}{
+		{400, "User credentials are incorrect. Incorrect API key or IP address.", true},
+		{401, "Insufficient authorisation. Installation token is invalid.", true},
+		{401, "Insufficient authorisation.", false},
+		{403, "Insufficient authorisation.", false},
+		{400, "Request signature is invalid.", false},
+		{500, "User credentials are incorrect. Incorrect API key or IP address.", false},
+	}
+
+	for _, test := range tests {
+		err := &bunq.BunqError{StatusCode: test.statusCode, Descriptions: []string{test.description}}
+		if actual := err.IsRegistrationInvalid(); actual != test.expected {
+			t.Errorf("expected %d %q to be registration invalid %t, got %t", test.statusCode, test.description, test.expected, actual)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package bunq
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -11,51 +12,98 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/daanvanberkel/fireflyiiibunq/metrics"
+	"github.com/daanvanberkel/fireflyiiibunq/tracing"
 	"github.com/daanvanberkel/fireflyiiibunq/util"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// BunqHttpClient is safe for concurrent use, the installation, session and keychain can be replaced while requests
+// are sent
 type BunqHttpClient struct {
 	apiBaseUrl   string
 	userAgent    string
-	log          *logrus.Logger
+	log          *logrus.Entry
+	mutex        sync.RWMutex
 	installation *BunqInstallationServer
 	session      *BunqSession
 	keyChain     *util.Keychain
 	httpClient   *http.Client
+	limiter      *rateLimiter
 	maxRetries   int
 }
 
-func NewBunqHttpClient(apiBaseUrl string, userAgent string, log *logrus.Logger) (*BunqHttpClient, error) {
+func NewBunqHttpClient(apiBaseUrl string, userAgent string, log *logrus.Entry) (*BunqHttpClient, error) {
 	return &BunqHttpClient{
 		apiBaseUrl: apiBaseUrl,
 		userAgent:  userAgent,
 		log:        log,
 		httpClient: &http.Client{},
+		limiter:    &rateLimiter{},
 		maxRetries: 3,
 	}, nil
 }
 
 func (c *BunqHttpClient) SetInstallation(installation *BunqInstallationServer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	c.installation = installation
 }
 
 func (c *BunqHttpClient) SetSession(session *BunqSession) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	c.session = session
 }
 
 func (c *BunqHttpClient) SetKeyChain(keyChain *util.Keychain) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	c.keyChain = keyChain
 }
 
-func (c *BunqHttpClient) DoBunqRequest(method string, path string, data interface{}) ([]byte, error) {
-	return c.doActualBunqRequest(method, path, data, 1)
+// SetRateLimit spaces the requests to at most requestsPerSecond, 0 only waits after bunq answered 429
+func (c *BunqHttpClient) SetRateLimit(requestsPerSecond float64) {
+	c.limiter.setRate(requestsPerSecond)
+}
+
+func (c *BunqHttpClient) credentials() (*BunqInstallationServer, *BunqSession, *util.Keychain) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.installation, c.session, c.keyChain
+}
+
+// SetTransport replaces the transport of the http client, used to record or replay requests
+func (c *BunqHttpClient) SetTransport(transport http.RoundTripper) {
+	c.httpClient.Transport = transport
+}
+
+func (c *BunqHttpClient) DoBunqRequest(ctx context.Context, method string, path string, data interface{}) ([]byte, error) {
+	body, _, err := c.doActualBunqRequest(ctx, method, path, data, 1)
+	return body, err
+}
+
+// DoBunqContentRequest does a request for binary content, like attachments, and returns the body with its content type
+func (c *BunqHttpClient) DoBunqContentRequest(ctx context.Context, method string, path string) ([]byte, string, error) {
+	body, header, err := c.doActualBunqRequest(ctx, method, path, nil, 1)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return body, header.Get("Content-Type"), nil
 }
 
-func (c *BunqHttpClient) doActualBunqRequest(method string, path string, data interface{}, try int) ([]byte, error) {
+func (c *BunqHttpClient) doActualBunqRequest(ctx context.Context, method string, path string, data interface{}, try int) (responseBody []byte, responseHeader http.Header, err error) {
 	requestId := uuid.New()
 	log := c.log.WithFields(logrus.Fields{
 		"requestId": requestId.String(),
@@ -64,45 +112,68 @@ func (c *BunqHttpClient) doActualBunqRequest(method string, path string, data in
 		"path":      path,
 	})
 
+	// Every try gets its own span, retries are siblings under the span of the caller
+	parentCtx := ctx
+	endpoint, _, _ := strings.Cut(path, "?")
+	ctx, span := tracing.Start(ctx, "bunq "+method+" "+metrics.Endpoint(endpoint),
+		attribute.String("http.request.method", method),
+		attribute.String("url.template", metrics.Endpoint(endpoint)),
+		attribute.String("bunq.request_id", requestId.String()),
+		attribute.Int("bunq.try", try),
+	)
+	// A retry ends the span of this try before it starts its own
+	spanEnded := false
+	defer func() {
+		if !spanEnded {
+			tracing.End(span, err)
+		}
+	}()
+
 	if try > c.maxRetries {
 		c.log.Error("Max retires reached")
-		return nil, errors.New("max retries reached")
+		return nil, nil, errors.New("max retries reached")
 	}
 
 	body, err := json.Marshal(data)
 	if err != nil {
 		log.WithError(err).Error("Cannot marshal request body")
-		return nil, err
+		return nil, nil, err
 	}
 
 	url := c.apiBaseUrl + path
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(body))
 	if err != nil {
 		log.WithError(err).Error("Cannot create new request")
-		return nil, err
+		return nil, nil, err
 	}
 
-	if err := c.setDefaultHeaders(req, &requestId, log); err != nil {
-		return nil, err
+	installation, session, keyChain := c.credentials()
+	if err := c.setDefaultHeaders(req, path, installation, session, &requestId, log); err != nil {
+		return nil, nil, err
 	}
-	if err := c.signRequestBody(req, body, log); err != nil {
-		return nil, err
+	if err := c.signRequestBody(req, body, keyChain, log); err != nil {
+		return nil, nil, err
+	}
+
+	if err := c.limiter.wait(ctx); err != nil {
+		return nil, nil, err
 	}
 
 	log.Debug("Send bunq request")
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		log.WithError(err).Error("Cannot send request")
-		return nil, err
+		return nil, nil, err
 	}
 
 	defer resp.Body.Close()
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
 		log.WithError(err).Error("Cannot read bunq response body")
-		return nil, err
+		return nil, nil, err
 	}
 
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
 	log.WithFields(logrus.Fields{
 		"statusCode":        resp.StatusCode,
 		"bodyLength":        len(respBody),
@@ -118,56 +189,65 @@ func (c *BunqHttpClient) doActualBunqRequest(method string, path string, data in
 			retryAfter, err = strconv.Atoi(retryAfterHeader)
 			if err != nil {
 				log.WithError(err).Error("Cannot convert Retry-After header to int")
-				return nil, err
+				return nil, nil, err
 			}
 		} else {
 			retryAfter = 3
 		}
 
+		// All requests of the client wait, the retry waits for the pause in the rate limiter
 		log.WithField("duration", retryAfter).Info("Waiting before retrying the request")
-		time.Sleep(time.Duration(retryAfter) * time.Second)
-		return c.doActualBunqRequest(method, path, data, (try + 1))
+		metrics.RateLimitWaits.Inc()
+		metrics.RateLimitWaitSeconds.Add(float64(retryAfter))
+		c.limiter.pause(time.Duration(retryAfter) * time.Second)
+		span.End()
+		spanEnded = true
+		return c.doActualBunqRequest(parentCtx, method, path, data, (try + 1))
 	}
 
 	if resp.Header.Get("X-Bunq-Client-Request-Id") != requestId.String() {
 		log.Error("Received response for another request")
-		return nil, errors.New("received response for another request")
+		return nil, nil, errors.New("received response for another request")
 	}
 
-	if err := c.validateServerResponseBody(resp, respBody, path, log); err != nil {
-		return nil, err
+	if err := c.validateServerResponseBody(resp, respBody, path, installation, log); err != nil {
+		return nil, nil, err
 	}
 
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		if (resp.StatusCode == 401 || resp.StatusCode == 403) && c.session != nil && path != "/session-server" {
-			if err := c.session.StartSession(); err != nil {
-				return nil, err
+		if (resp.StatusCode == 401 || resp.StatusCode == 403) && session != nil && !usesInstallationToken(path) {
+			if err := session.RestartSession(req.Header.Get("X-Bunq-Client-Authentication")); err != nil {
+				return nil, nil, err
 			}
 
 			log.Info("Received 401 or 403 from bunq, possible session expiry. Retry request")
-			return c.doActualBunqRequest(method, path, data, (try + 1))
+			span.End()
+			spanEnded = true
+			return c.doActualBunqRequest(parentCtx, method, path, data, (try + 1))
 		}
 
 		log.WithField("body", string(respBody)).Warn("Received error from bunq")
-		return nil, errors.New(string(respBody))
+		return nil, nil, newBunqError(resp.StatusCode, respBody)
 	}
 
-	return respBody, nil
+	return respBody, resp.Header, nil
 }
 
-func (c *BunqHttpClient) setDefaultHeaders(request *http.Request, requestId *uuid.UUID, log *logrus.Entry) error {
+func (c *BunqHttpClient) setDefaultHeaders(request *http.Request, path string, installation *BunqInstallationServer, session *BunqSession, requestId *uuid.UUID, log *logrus.Entry) error {
 	request.Header.Set("User-Agent", c.userAgent)
 	request.Header.Set("Cache-Control", "no-cache")
 	request.Header.Set("X-Bunq-Client-Request-Id", requestId.String())
 
-	if c.installation != nil && c.installation.Token != nil && c.session == nil {
+	useSession := session != nil && !usesInstallationToken(path)
+
+	if installation != nil && installation.Token != nil && !useSession {
 		log.Debug("Use installation token for bunq authentication")
-		request.Header.Set("X-Bunq-Client-Authentication", c.installation.Token.Token)
+		request.Header.Set("X-Bunq-Client-Authentication", installation.Token.Token)
 	}
 
 	// Session token has higher priority than installation token
-	if c.session != nil {
-		sessionToken, err := c.session.GetToken()
+	if useSession {
+		sessionToken, err := session.GetToken()
 		if err != nil {
 			return err
 		}
@@ -176,16 +256,22 @@ func (c *BunqHttpClient) setDefaultHeaders(request *http.Request, requestId *uui
 		request.Header.Set("X-Bunq-Client-Authentication", sessionToken)
 	}
 
-	if c.installation == nil && c.session == nil {
+	if installation == nil && session == nil {
 		log.Info("Both installation and session tokens are missing, continuing without authentication")
 	}
 
 	return nil
 }
 
-func (c *BunqHttpClient) signRequestBody(request *http.Request, body []byte, log *logrus.Entry) error {
-	if c.keyChain != nil && len(body) > 0 {
-		base64Signature, err := c.keyChain.Sign(body)
+// usesInstallationToken reports whether the request registers the client, these requests are never authenticated
+// with the session token
+func usesInstallationToken(path string) bool {
+	return path == "/installation" || path == "/device-server" || path == "/session-server"
+}
+
+func (c *BunqHttpClient) signRequestBody(request *http.Request, body []byte, keyChain *util.Keychain, log *logrus.Entry) error {
+	if keyChain != nil && len(body) > 0 {
+		base64Signature, err := keyChain.Sign(body)
 		if err != nil {
 			log.WithError(err).Error("Cannot sign request body")
 			return err
@@ -194,16 +280,16 @@ func (c *BunqHttpClient) signRequestBody(request *http.Request, body []byte, log
 		request.Header.Set("X-Bunq-Client-Signature", base64Signature)
 	}
 
-	if c.keyChain == nil {
+	if keyChain == nil {
 		log.Info("Keychain missing, continuing without signing the request")
 	}
 
 	return nil
 }
 
-func (c *BunqHttpClient) validateServerResponseBody(response *http.Response, responseBody []byte, path string, log *logrus.Entry) error {
+func (c *BunqHttpClient) validateServerResponseBody(response *http.Response, responseBody []byte, path string, installation *BunqInstallationServer, log *logrus.Entry) error {
 	// TODO: Make all calls verify the signature, for now only the session-server call works. All other calls fail for some reason
-	if len(responseBody) > 0 && c.installation != nil && path == "/session-server" {
+	if len(responseBody) > 0 && installation != nil && path == "/session-server" {
 		hashedBody := sha256.Sum256(responseBody)
 		serverSignature, err := base64.StdEncoding.DecodeString(response.Header.Get("X-Bunq-Server-Signature"))
 		if err != nil {
@@ -211,7 +297,7 @@ func (c *BunqHttpClient) validateServerResponseBody(response *http.Response, res
 			return err
 		}
 
-		publicKey, err := c.installation.GetServerPublicKey()
+		publicKey, err := installation.GetServerPublicKey()
 		if err != nil {
 			log.WithError(err).Error("Cannot load bunq server public key")
 			return err
@@ -225,7 +311,7 @@ func (c *BunqHttpClient) validateServerResponseBody(response *http.Response, res
 		log.Debug("Bunq server signature verified successfully")
 	}
 
-	if c.installation == nil {
+	if installation == nil {
 		log.Info("Bunq installation missing, continuing without server signature validation")
 	}
 
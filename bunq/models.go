@@ -5,6 +5,8 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"math"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -14,8 +16,56 @@ type BunqId struct {
 	Id int `json:"id"`
 }
 
+type BunqUserType string
+
+const (
+	UserPersonType  BunqUserType = "UserPerson"
+	UserCompanyType BunqUserType = "UserCompany"
+	UserApiKeyType  BunqUserType = "UserApiKey"
+)
+
+// BunqUser is the user the session is started for, independent of the type of user
+type BunqUser struct {
+	Id             int
+	Type           BunqUserType
+	Name           string
+	SessionTimeout int
+}
+
 type BunqUserPerson struct {
-	Id int `json:"id"`
+	Id             int    `json:"id"`
+	DisplayName    string `json:"display_name"`
+	PublicNickName string `json:"public_nick_name"`
+	LegalName      string `json:"legal_name"`
+	SessionTimeout int    `json:"session_timeout"`
+}
+
+type BunqUserCompany struct {
+	Id             int    `json:"id"`
+	Name           string `json:"name"`
+	DisplayName    string `json:"display_name"`
+	PublicNickName string `json:"public_nick_name"`
+	SessionTimeout int    `json:"session_timeout"`
+}
+
+// BunqUserApiKey is the user of an api key created through OAuth, granted by another user to access their accounts
+type BunqUserApiKey struct {
+	Id              int                `json:"id"`
+	RequestedByUser *BunqUserReference `json:"requested_by_user"`
+	GrantedByUser   *BunqUserReference `json:"granted_by_user"`
+}
+
+type BunqUserReference struct {
+	UserPerson  *BunqUserPerson  `json:"UserPerson"`
+	UserCompany *BunqUserCompany `json:"UserCompany"`
+}
+
+func (c *BunqUserCompany) GetName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+
+	return c.DisplayName
 }
 
 type BunqAmount struct {
@@ -23,6 +73,23 @@ type BunqAmount struct {
 	Currency string `json:"currency"`
 }
 
+// GetCents returns the absolute value of the amount in cents
+func (a *BunqAmount) GetCents() (int64, error) {
+	value, err := strconv.ParseFloat(strings.Trim(a.Value, "-"), 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(math.Round(value * 100)), nil
+}
+
+type BunqGeolocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude"`
+	Radius    float64 `json:"radius"`
+}
+
 type BunqPointer struct {
 	Type  string `json:"type"`
 	Value string `json:"value"`
@@ -35,10 +102,21 @@ type BunqPagination struct {
 	OlderUrl  string `json:"older_url"`
 }
 
+// Format of the timestamps in bunq responses, always in UTC
+const BunqTimeFormat = "2006-01-02 15:04:05.000000"
+
 type BunqTime struct {
 	time.Time
 }
 
+func (bt BunqTime) MarshalJSON() ([]byte, error) {
+	if bt.Time.IsZero() {
+		return []byte("null"), nil
+	}
+
+	return []byte("\"" + bt.Time.UTC().Format(BunqTimeFormat) + "\""), nil
+}
+
 func (bt *BunqTime) UnmarshalJSON(b []byte) (err error) {
 	s := strings.Trim(string(b), "\"")
 	if s == "null" {
@@ -46,7 +124,7 @@ func (bt *BunqTime) UnmarshalJSON(b []byte) (err error) {
 		return
 	}
 
-	bt.Time, err = time.Parse("2006-01-02 15:04:05.000000", s)
+	bt.Time, err = time.Parse(BunqTimeFormat, s)
 	return
 }
 
@@ -67,7 +145,15 @@ type BunqInstallationServer struct {
 }
 
 func (i *BunqInstallationServer) GetServerPublicKey() (*rsa.PublicKey, error) {
+	if i.ServerPublicKey == nil {
+		return nil, errors.New("installation has no server public key")
+	}
+
 	bunqPublicKey, _ := pem.Decode([]byte(i.ServerPublicKey.ServicePublicKey))
+	if bunqPublicKey == nil {
+		return nil, errors.New("server public key is not pem encoded")
+	}
+
 	bunqServerPublicKey, err := x509.ParsePKIXPublicKey(bunqPublicKey.Bytes)
 	if err != nil {
 		return nil, err
@@ -113,9 +199,58 @@ type BunqSessionServerResponse struct {
 }
 
 type BunqSessionServer struct {
-	Id         *BunqId                 `json:"Id"`
-	Token      *BunqSessionServerToken `json:"Token"`
-	UserPerson *BunqUserPerson         `json:"UserPerson"`
+	Id          *BunqId                 `json:"Id"`
+	Token       *BunqSessionServerToken `json:"Token"`
+	UserPerson  *BunqUserPerson         `json:"UserPerson"`
+	UserCompany *BunqUserCompany        `json:"UserCompany"`
+	UserApiKey  *BunqUserApiKey         `json:"UserApiKey"`
+
+	// Not returned by bunq, stored to know when the session expires
+	CreatedAt      *time.Time `json:"CreatedAt,omitempty"`
+	SessionTimeout int        `json:"SessionTimeout,omitempty"`
+}
+
+// GetUser returns the user the session was started for, bunq returns exactly one of the user types
+func (s *BunqSessionServer) GetUser() (*BunqUser, error) {
+	if s.UserPerson != nil {
+		return &BunqUser{
+			Id:             s.UserPerson.Id,
+			Type:           UserPersonType,
+			Name:           s.UserPerson.DisplayName,
+			SessionTimeout: s.UserPerson.SessionTimeout,
+		}, nil
+	}
+
+	if s.UserCompany != nil {
+		return &BunqUser{
+			Id:             s.UserCompany.Id,
+			Type:           UserCompanyType,
+			Name:           s.UserCompany.GetName(),
+			SessionTimeout: s.UserCompany.SessionTimeout,
+		}, nil
+	}
+
+	if s.UserApiKey != nil {
+		user := &BunqUser{
+			Id:   s.UserApiKey.Id,
+			Type: UserApiKeyType,
+		}
+
+		// The accounts belong to the user that granted access
+		if grantedBy := s.UserApiKey.GrantedByUser; grantedBy != nil {
+			if grantedBy.UserCompany != nil {
+				user.Name = grantedBy.UserCompany.GetName()
+				user.SessionTimeout = grantedBy.UserCompany.SessionTimeout
+			} else if grantedBy.UserPerson != nil {
+				user.Name = grantedBy.UserPerson.DisplayName
+				user.SessionTimeout = grantedBy.UserPerson.SessionTimeout
+			}
+		}
+
+		return user, nil
+	}
+
+	return nil, errors.New("no user in session")
 }
 
 type BunqSessionServerToken struct {
@@ -181,14 +316,162 @@ type BunqPayment struct {
 	Amount               *BunqAmount                 `json:"amount"`
 	Description          string                      `json:"description"`
 	Type                 string                      `json:"type"`
+	SubType              string                      `json:"sub_type"`
 	MerchantReference    string                      `json:"merchant_reference"`
+	BatchId              int                         `json:"batch_id"`
+	EndToEndId           string                      `json:"end_to_end_id"`
+	Geolocation          *BunqGeolocation            `json:"geolocation"`
 	BalanceAfterMutation *BunqAmount                 `json:"balance_after_mutation"`
 	Alias                *BunqPaymentMonetaryAccount `json:"alias"`
 	CounterpartyAlias    *BunqPaymentMonetaryAccount `json:"counterparty_alias"`
+	Attachment           []*BunqAttachmentReference  `json:"attachment"`
 }
 
 type BunqPaymentMonetaryAccount struct {
-	Iban        string `json:"iban"`
-	DisplayName string `json:"display_name"`
-	Country     string `json:"country"`
+	Iban                 string `json:"iban"`
+	DisplayName          string `json:"display_name"`
+	Country              string `json:"country"`
+	MerchantCategoryCode string `json:"merchant_category_code"`
+}
+
+// BUNQ MASTERCARD ACTION MODELS
+
+const (
+	MastercardActionDecisionAllowed       = "ALLOWED"
+	MastercardActionClearingPending       = "PENDING"
+	MastercardActionAuthorisationReversed = "REVERSED"
+)
+
+type BunqMastercardActionsResponse struct {
+	Response   []*BunqMastercardActionResponse `json:"Response"`
+	Pagination *BunqPagination                 `json:"Pagination"`
+}
+
+type BunqMastercardActionResponse struct {
+	MastercardAction *BunqMastercardAction `json:"MastercardAction"`
+}
+
+type BunqMastercardAction struct {
+	Id                    int                         `json:"id"`
+	Created               *BunqTime                   `json:"created"`
+	Updated               *BunqTime                   `json:"updated"`
+	MonetaryAccountId     int                         `json:"monetary_account_id"`
+	CardId                int                         `json:"card_id"`
+	AmountLocal           *BunqAmount                 `json:"amount_local"`
+	AmountBilling         *BunqAmount                 `json:"amount_billing"`
+	AmountOriginalLocal   *BunqAmount                 `json:"amount_original_local"`
+	AmountOriginalBilling *BunqAmount                 `json:"amount_original_billing"`
+	AmountFee             *BunqAmount                 `json:"amount_fee"`
+	Decision              string                      `json:"decision"`
+	DecisionDescription   string                      `json:"decision_description"`
+	Description           string                      `json:"description"`
+	AuthorisationStatus   string                      `json:"authorisation_status"`
+	AuthorisationType     string                      `json:"authorisation_type"`
+	SettlementStatus      string                      `json:"settlement_status"`
+	ClearingStatus        string                      `json:"clearing_status"`
+	City                  string                      `json:"city"`
+	PanEntryModeUser      string                      `json:"pan_entry_mode_user"`
+	ReservationExpiryTime *BunqTime                   `json:"reservation_expiry_time"`
+	Alias                 *BunqPaymentMonetaryAccount `json:"alias"`
+	CounterpartyAlias     *BunqPaymentMonetaryAccount `json:"counterparty_alias"`
+}
+
+// GetForeignAmount returns the amount in the currency of the merchant, or nil when the merchant charged in the
+// currency of the account
+func (a *BunqMastercardAction) GetForeignAmount() *BunqAmount {
+	if a.AmountLocal == nil || a.AmountBilling == nil || a.AmountLocal.Currency == "" || a.AmountLocal.Currency == a.AmountBilling.Currency {
+		return nil
+	}
+
+	return a.AmountLocal
+}
+
+// GetExchangeRate returns the rate used to convert the local amount into the billed amount
+func (a *BunqMastercardAction) GetExchangeRate() (float64, error) {
+	if a.GetForeignAmount() == nil {
+		return 1, nil
+	}
+
+	localCents, err := a.AmountLocal.GetCents()
+	if err != nil {
+		return 0, err
+	}
+
+	billingCents, err := a.AmountBilling.GetCents()
+	if err != nil {
+		return 0, err
+	}
+
+	if localCents == 0 {
+		return 0, errors.New("cannot calculate exchange rate for zero amount")
+	}
+
+	return float64(billingCents) / float64(localCents), nil
+}
+
+// IsPending reports whether the card payment is authorised but not yet settled into a payment
+func (a *BunqMastercardAction) IsPending() bool {
+	return a.Decision == MastercardActionDecisionAllowed && a.ClearingStatus == MastercardActionClearingPending && !a.IsReversed()
+}
+
+// IsReversed reports whether the authorisation was reversed by the merchant or expired without being settled
+func (a *BunqMastercardAction) IsReversed() bool {
+	if a.AuthorisationStatus == MastercardActionAuthorisationReversed {
+		return true
+	}
+
+	return a.ClearingStatus == MastercardActionClearingPending && a.ReservationExpiryTime != nil && !a.ReservationExpiryTime.IsZero() && a.ReservationExpiryTime.Before(time.Now())
+}
+
+// BUNQ ATTACHMENT MODELS
+
+type BunqAttachmentReference struct {
+	Id                int `json:"id"`
+	MonetaryAccountId int `json:"monetary_account_id"`
+}
+
+type BunqNoteAttachmentsResponse struct {
+	Response   []*BunqNoteAttachmentResponse `json:"Response"`
+	Pagination *BunqPagination               `json:"Pagination"`
+}
+
+type BunqNoteAttachmentResponse struct {
+	NoteAttachment *BunqNoteAttachment `json:"NoteAttachment"`
+}
+
+type BunqNoteAttachment struct {
+	Id           int       `json:"id"`
+	Created      *BunqTime `json:"created"`
+	Updated      *BunqTime `json:"updated"`
+	Description  string    `json:"description"`
+	AttachmentId int       `json:"attachment_id"`
+}
+
+// BunqPaymentAttachment is a receipt or note attachment of a payment, stored on a monetary account
+type BunqPaymentAttachment struct {
+	Id                int
+	MonetaryAccountId int
+	Description       string
+}
+
+// BUNQ NOTE TEXT MODELS
+
+type BunqNoteTextRequest struct {
+	Content string `json:"content"`
+}
+
+type BunqNoteTextsResponse struct {
+	Response   []*BunqNoteTextResponse `json:"Response"`
+	Pagination *BunqPagination         `json:"Pagination"`
+}
+
+type BunqNoteTextResponse struct {
+	NoteText *BunqNoteText `json:"NoteText"`
+}
+
+type BunqNoteText struct {
+	Id      int       `json:"id"`
+	Created *BunqTime `json:"created"`
+	Updated *BunqTime `json:"updated"`
+	Content string    `json:"content"`
 }
@@ -0,0 +1,123 @@
+package bunq
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+	"github.com/sirupsen/logrus"
+)
+
+// Time the user has to authorise the application in the browser
+const oauthLoginTimeout = 10 * time.Minute
+
+type BunqOAuthToken struct {
+	AccessToken string    `json:"access_token"`
+	TokenType   string    `json:"token_type"`
+	Created     time.Time `json:"created"`
+}
+
+// BunqOAuthLogin runs the OAuth authorisation code flow and stores the access token. The access token replaces the
+// api key as secret for the device server and sessions.
+func BunqOAuthLogin(config *util.Config, log *logrus.Entry) error {
+	if config.BunqConfig.OAuthClientId == "" || config.BunqConfig.OAuthClientSecret == "" {
+		return errors.New("missing bunq oauth client id or client secret in env")
+	}
+
+	state, err := util.NewOAuthState()
+	if err != nil {
+		return err
+	}
+
+	authorizeUrl := config.BunqConfig.OAuthAuthorizeUrl + "?" + url.Values{
+		"response_type": {"code"},
+		"client_id":     {config.BunqConfig.OAuthClientId},
+		"redirect_uri":  {config.BunqConfig.OAuthRedirectUrl},
+		"state":         {state},
+	}.Encode()
+	log.WithField("url", authorizeUrl).Info("Open the url in your browser to grant access to your bunq accounts")
+
+	code, err := util.WaitForOAuthCallback(config.BunqConfig.OAuthRedirectUrl, state, oauthLoginTimeout)
+	if err != nil {
+		return err
+	}
+
+	token, err := exchangeBunqOAuthCode(config, code)
+	if err != nil {
+		log.WithError(err).Error("Cannot exchange authorisation code for bunq access token")
+		return err
+	}
+
+	if err := util.WriteStateFile(config.StorageLocation+config.BunqConfig.OAuthTokenFileName, token); err != nil {
+		return err
+	}
+
+	// The device server and session are registered for the previous secret
+	for _, fileName := range []string{config.BunqConfig.DeviceServerFileName, config.BunqConfig.SessionServerFileName} {
+		if err := os.Remove(config.StorageLocation + fileName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	log.Info("Stored bunq access token")
+	return nil
+}
+
+// LoadBunqOAuthToken loads the access token stored by the login command, returns nil when there is none
+func LoadBunqOAuthToken(config *util.Config) (*BunqOAuthToken, error) {
+	var token BunqOAuthToken
+	if err := util.ReadStateFile(config.StorageLocation+config.BunqConfig.OAuthTokenFileName, &token); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if token.AccessToken == "" {
+		return nil, errors.New("stored bunq oauth token has no access token")
+	}
+
+	return &token, nil
+}
+
+func exchangeBunqOAuthCode(config *util.Config, code string) (*BunqOAuthToken, error) {
+	tokenUrl := config.BunqConfig.OAuthTokenUrl + "?" + url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {config.BunqConfig.OAuthRedirectUrl},
+		"client_id":     {config.BunqConfig.OAuthClientId},
+		"client_secret": {config.BunqConfig.OAuthClientSecret},
+	}.Encode()
+
+	resp, err := http.Post(tokenUrl, "application/json", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, errors.New(string(body))
+	}
+
+	var token BunqOAuthToken
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, err
+	}
+
+	if token.AccessToken == "" {
+		return nil, errors.New("bunq did not return an access token")
+	}
+	token.Created = time.Now()
+
+	return &token, nil
+}
@@ -0,0 +1,68 @@
+package bunq
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter is shared by all requests of a client. It spaces the requests when a rate is set and pauses every
+// request after bunq answered 429, so concurrent requests don't each run into the rate limit.
+type rateLimiter struct {
+	mutex       sync.Mutex
+	interval    time.Duration
+	next        time.Time
+	pausedUntil time.Time
+}
+
+// setRate limits the requests per second, 0 disables spacing the requests
+func (l *rateLimiter) setRate(requestsPerSecond float64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.interval = 0
+	if requestsPerSecond > 0 {
+		l.interval = time.Duration(float64(time.Second) / requestsPerSecond)
+	}
+}
+
+// wait blocks until the request can be sent
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mutex.Lock()
+	slot := time.Now()
+	if l.pausedUntil.After(slot) {
+		slot = l.pausedUntil
+	}
+	if l.interval > 0 {
+		if l.next.After(slot) {
+			slot = l.next
+		}
+		l.next = slot.Add(l.interval)
+	}
+	l.mutex.Unlock()
+
+	delay := time.Until(slot)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// pause holds back all requests for the duration
+func (l *rateLimiter) pause(duration time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if until := time.Now().Add(duration); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
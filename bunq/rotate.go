@@ -0,0 +1,197 @@
+package bunq
+
+import (
+	"errors"
+	"os"
+
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	rotateStagingSuffix = ".new"
+	rotateBackupSuffix  = ".bak"
+)
+
+// rotatedFile is a stored file that is replaced by a key rotation
+type rotatedFile struct {
+	path     string
+	required bool
+}
+
+// RotateKeys generates a new keypair and registers a new installation, device server and session with it. The stored
+// files are only replaced when all registrations succeed, the previous files are kept with a .bak suffix so the
+// rotation can be undone with RollbackKeys.
+func RotateKeys(config *util.Config, bitSize int, log *logrus.Entry) error {
+	log = log.WithField("bitSize", bitSize)
+
+	secret, err := loadSecret(config, log)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Generate new bunq keypair")
+	keyChain, err := util.GenerateKeyChain(bitSize)
+	if err != nil {
+		log.WithError(err).Error("Cannot generate keypair")
+		return err
+	}
+
+	httpClient, err := NewBunqHttpClient(config.BunqConfig.ApiBaseUrl, config.BunqConfig.UserAgent, log)
+	if err != nil {
+		return err
+	}
+	httpClient.SetKeyChain(keyChain)
+
+	files := rotatedFiles(config)
+	defer removeStagedFiles(files)
+
+	installation, err := registerInstallation(httpClient, keyChain)
+	if err != nil {
+		log.WithError(err).Error("Cannot register installation for new keypair")
+		return err
+	}
+	httpClient.SetInstallation(installation)
+
+	deviceServer, err := registerDeviceServer(httpClient, config, secret)
+	if err != nil {
+		log.WithError(err).Error("Cannot register device server for new keypair")
+		return err
+	}
+
+	// Starting a session proves the new registration works before the stored files are touched
+	session := &BunqSession{
+		apiKey:          secret,
+		sessionLocation: files[4].path + rotateStagingSuffix,
+		client:          httpClient,
+		log:             log,
+	}
+	if err := session.StartSession(); err != nil {
+		log.WithError(err).Error("Cannot start session with new keypair")
+		return err
+	}
+
+	if err := keyChain.WriteKeys(files[0].path+rotateStagingSuffix, files[1].path+rotateStagingSuffix); err != nil {
+		return err
+	}
+	if err := writeStagedJson(files[2].path+rotateStagingSuffix, installation); err != nil {
+		return err
+	}
+	if err := writeStagedJson(files[3].path+rotateStagingSuffix, deviceServer); err != nil {
+		return err
+	}
+
+	if err := swapFiles(files, rotateStagingSuffix, log); err != nil {
+		return err
+	}
+
+	log.Info("Rotated bunq keypair, the previous keypair and registration are kept as backup")
+	return nil
+}
+
+// RollbackKeys restores the keypair and registration from before the last rotation. The replaced files become the
+// backup, so a rollback can be undone by running it again.
+func RollbackKeys(config *util.Config, log *logrus.Entry) error {
+	files := rotatedFiles(config)
+	for _, file := range files {
+		if _, err := os.Stat(file.path + rotateBackupSuffix); err != nil && file.required {
+			return errors.New("no backup found to roll back to, missing " + file.path + rotateBackupSuffix)
+		}
+	}
+
+	// Move the backups aside first, swapping moves the current files to the backup location
+	for _, file := range files {
+		if err := os.Rename(file.path+rotateBackupSuffix, file.path+rotateStagingSuffix); err != nil && !os.IsNotExist(err) {
+			log.WithError(err).Error("Cannot prepare backup for rollback")
+			return err
+		}
+	}
+	defer removeStagedFiles(files)
+
+	if err := swapFiles(files, rotateStagingSuffix, log); err != nil {
+		// A failed swap puts the backups back at the staging location, they are kept as backup for another rollback
+		for _, file := range files {
+			os.Rename(file.path+rotateStagingSuffix, file.path+rotateBackupSuffix)
+		}
+		return err
+	}
+
+	log.Info("Restored bunq keypair and registration from backup")
+	return nil
+}
+
+func rotatedFiles(config *util.Config) []*rotatedFile {
+	return []*rotatedFile{
+		{path: config.StorageLocation + config.BunqConfig.PrivateKeyFileName, required: true},
+		{path: config.StorageLocation + config.BunqConfig.PublicKeyFileName, required: true},
+		{path: config.StorageLocation + config.BunqConfig.InstallationFileName, required: true},
+		{path: config.StorageLocation + config.BunqConfig.DeviceServerFileName, required: true},
+		{path: config.StorageLocation + config.BunqConfig.SessionServerFileName, required: false},
+	}
+}
+
+// swapFiles replaces the files one at a time, each current file is moved to its backup location before the staged
+// file is moved into place. When a rename fails the files that were already swapped are restored.
+func swapFiles(files []*rotatedFile, stagingSuffix string, log *logrus.Entry) error {
+	type swap struct {
+		file     *rotatedFile
+		backedUp bool
+		replaced bool
+	}
+
+	swaps := []*swap{}
+	restore := func() {
+		for i := len(swaps) - 1; i >= 0; i-- {
+			current := swaps[i]
+			if current.replaced {
+				if err := os.Rename(current.file.path, current.file.path+stagingSuffix); err != nil {
+					log.WithError(err).WithField("file", current.file.path).Error("Cannot move new file aside after failed swap")
+				}
+			}
+			if current.backedUp {
+				if err := os.Rename(current.file.path+rotateBackupSuffix, current.file.path); err != nil {
+					log.WithError(err).WithField("file", current.file.path).Error("Cannot restore file after failed swap")
+				}
+			}
+		}
+	}
+
+	for _, file := range files {
+		current := &swap{file: file}
+		swaps = append(swaps, current)
+
+		if err := os.Remove(file.path + rotateBackupSuffix); err != nil && !os.IsNotExist(err) {
+			log.WithError(err).WithField("file", file.path).Error("Cannot remove previous backup")
+			restore()
+			return err
+		}
+
+		if err := os.Rename(file.path, file.path+rotateBackupSuffix); err == nil {
+			current.backedUp = true
+		} else if !os.IsNotExist(err) {
+			log.WithError(err).WithField("file", file.path).Error("Cannot back up file")
+			restore()
+			return err
+		}
+
+		if err := os.Rename(file.path+stagingSuffix, file.path); err == nil {
+			current.replaced = true
+		} else if !os.IsNotExist(err) || file.required {
+			log.WithError(err).WithField("file", file.path).Error("Cannot move new file into place")
+			restore()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func removeStagedFiles(files []*rotatedFile) {
+	for _, file := range files {
+		os.Remove(file.path + rotateStagingSuffix)
+	}
+}
+
+func writeStagedJson(path string, data interface{}) error {
+	return util.WriteStateFile(path, data)
+}
@@ -0,0 +1,95 @@
+package bunq_test
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/daanvanberkel/fireflyiiibunq/bunq"
+	"github.com/daanvanberkel/fireflyiiibunq/bunqtest"
+)
+
+func readStoredFile(t *testing.T, path string) []byte {
+	t.Helper()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("cannot read %s: %v", path, err)
+	}
+
+	return content
+}
+
+func TestRotateKeysAndRollback(t *testing.T) {
+	server := startTestServer(t, bunqtest.DefaultFixtures())
+	storageLocation := t.TempDir() + "/"
+	config := newTestConfig(server, storageLocation)
+	startStoredSession(t, server, storageLocation)
+
+	privateKey := storageLocation + config.BunqConfig.PrivateKeyFileName
+	previousKey := readStoredFile(t, privateKey)
+
+	if err := bunq.RotateKeys(config, 2048, newTestLog()); err != nil {
+		t.Fatalf("cannot rotate keys: %v", err)
+	}
+
+	if bytes.Equal(readStoredFile(t, privateKey), previousKey) {
+		t.Error("expected the private key to be replaced")
+	}
+	if !bytes.Equal(readStoredFile(t, privateKey+".bak"), previousKey) {
+		t.Error("expected the previous private key to be kept as backup")
+	}
+	if _, err := newTestClient(t, server, storageLocation).GetUser(); err != nil {
+		t.Errorf("expected the rotated registration to be accepted, got %v", err)
+	}
+
+	if err := bunq.RollbackKeys(config, newTestLog()); err != nil {
+		t.Fatalf("cannot roll back keys: %v", err)
+	}
+
+	if !bytes.Equal(readStoredFile(t, privateKey), previousKey) {
+		t.Error("expected the previous private key to be restored")
+	}
+	if _, err := newTestClient(t, server, storageLocation).GetUser(); err != nil {
+		t.Errorf("expected the restored registration to be accepted, got %v", err)
+	}
+}
+
+func TestRotateKeysRestoresFilesWhenSwapFails(t *testing.T) {
+	server := startTestServer(t, bunqtest.DefaultFixtures())
+	storageLocation := t.TempDir() + "/"
+	config := newTestConfig(server, storageLocation)
+	startStoredSession(t, server, storageLocation)
+
+	files := []string{
+		config.BunqConfig.PrivateKeyFileName,
+		config.BunqConfig.PublicKeyFileName,
+		config.BunqConfig.InstallationFileName,
+		config.BunqConfig.DeviceServerFileName,
+	}
+	previous := map[string][]byte{}
+	for _, file := range files {
+		previous[file] = readStoredFile(t, storageLocation+file)
+	}
+
+	// A backup location that can't be removed fails the swap after the keys and installation were swapped
+	if err := os.MkdirAll(storageLocation+config.BunqConfig.DeviceServerFileName+".bak/locked", 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bunq.RotateKeys(config, 2048, newTestLog()); err == nil {
+		t.Fatal("expected the rotation to fail")
+	}
+
+	for _, file := range files {
+		if !bytes.Equal(readStoredFile(t, storageLocation+file), previous[file]) {
+			t.Errorf("expected %s to be restored", file)
+		}
+		if _, err := os.Stat(storageLocation + file + ".new"); !os.IsNotExist(err) {
+			t.Errorf("expected the staged %s to be removed", file)
+		}
+	}
+	if _, err := newTestClient(t, server, storageLocation).GetUser(); err != nil {
+		t.Errorf("expected the previous registration to be accepted, got %v", err)
+	}
+}
@@ -1,26 +1,43 @@
 package bunq
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/daanvanberkel/fireflyiiibunq/metrics"
+	"github.com/daanvanberkel/fireflyiiibunq/util"
 	"github.com/sirupsen/logrus"
 )
 
+// Sessions are refreshed this long before bunq would expire them
+const sessionRefreshMargin = time.Minute
+
 type BunqSession struct {
 	apiKey          string
 	sessionLocation string
 	sessionServer   *BunqSessionServer
+	lastUsed        time.Time
+	restarts        int
+	mutex           sync.Mutex
 	client          *BunqHttpClient
-	log             *logrus.Logger
+	reregister      func(cause error) error
+	log             *logrus.Entry
 }
 
-func NewBunqSession(apiKey string, sessionLocation string, client *BunqHttpClient, log *logrus.Logger) (*BunqSession, error) {
+// NewBunqSession loads the stored session or starts a new one. When bunq rejects the registration while starting a
+// session, reregister is called to register the client again before retrying once. reregister can be nil.
+func NewBunqSession(apiKey string, sessionLocation string, client *BunqHttpClient, reregister func(cause error) error, log *logrus.Entry) (*BunqSession, error) {
 	session := &BunqSession{
 		apiKey:          apiKey,
 		sessionLocation: sessionLocation,
 		client:          client,
+		reregister:      reregister,
 		log:             log,
 	}
 
@@ -33,29 +50,129 @@ func NewBunqSession(apiKey string, sessionLocation string, client *BunqHttpClien
 	return session, nil
 }
 
+// GetToken returns the session token, starting a new session first when the current one is about to expire
 func (s *BunqSession) GetToken() (string, error) {
-	if s.sessionServer == nil || s.sessionServer.Token.Token == "" {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.isExpiring() {
+		s.log.WithField("expiresAt", s.expiresAt()).Info("Bunq session is about to expire, start new session")
+		if err := s.startSession(); err != nil {
+			return "", err
+		}
+	}
+
+	if s.sessionServer == nil || s.sessionServer.Token == nil || s.sessionServer.Token.Token == "" {
 		return "", errors.New("no session token in storage")
 	}
 
+	s.lastUsed = time.Now()
 	return s.sessionServer.Token.Token, nil
 }
 
 func (s *BunqSession) GetUserId() (int, error) {
-	if s.sessionServer == nil || s.sessionServer.UserPerson == nil {
-		return -1, errors.New("no user id in storage")
+	user, err := s.GetUser()
+	if err != nil {
+		return -1, err
 	}
 
-	return s.sessionServer.UserPerson.Id, nil
+	return user.Id, nil
+}
+
+func (s *BunqSession) GetUser() (*BunqUser, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.sessionServer == nil {
+		return nil, errors.New("no user id in storage")
+	}
+
+	user, err := s.sessionServer.GetUser()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get user of stored session: %w", err)
+	}
+
+	return user, nil
 }
 
 func (s *BunqSession) StartSession() error {
-	s.log.Debug("Start new session")
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.startSession()
+}
+
+// RestartSession starts a new session after bunq rejected the given token. When another request already replaced
+// the rejected session, the new session is kept so parallel requests don't each start a session.
+func (s *BunqSession) RestartSession(rejectedToken string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.sessionServer != nil && s.sessionServer.Token != nil && s.sessionServer.Token.Token != rejectedToken {
+		s.log.Debug("Session already restarted by another request")
+		return nil
+	}
+
+	metrics.SessionRestarts.Inc()
+	s.restarts++
+	return s.startSession()
+}
+
+// Restarts returns how often the session was started again after bunq rejected it
+func (s *BunqSession) Restarts() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
+	return s.restarts
+}
+
+// DeleteSession ends the session at bunq and removes it from storage
+func (s *BunqSession) DeleteSession() error {
+	s.mutex.Lock()
+	sessionServer := s.sessionServer
+	s.mutex.Unlock()
+
+	if sessionServer == nil || sessionServer.Id == nil {
+		return nil
+	}
+
+	// The request itself needs the session token, so the lock cannot be held while sending it
+	if _, err := s.client.DoBunqRequest(context.Background(), "DELETE", "/session/"+strconv.Itoa(sessionServer.Id.Id), nil); err != nil {
+		s.log.WithError(err).Error("Cannot delete bunq session")
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sessionServer = nil
 	s.client.SetSession(nil)
-	response, err := s.client.DoBunqRequest("POST", "/session-server", BunqSessionServerRequest{
+	if err := os.Remove(s.sessionLocation); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	s.log.Debug("Deleted bunq session")
+	return nil
+}
+
+func (s *BunqSession) startSession() error {
+	s.log.Debug("Start new session")
+
+	// Session requests are authenticated with the installation token, see BunqHttpClient.setDefaultHeaders
+	request := BunqSessionServerRequest{
 		Secret: s.apiKey,
-	})
+	}
+	response, err := s.client.DoBunqRequest(context.Background(), "POST", "/session-server", request)
+
+	var bunqError *BunqError
+	if err != nil && s.reregister != nil && errors.As(err, &bunqError) && bunqError.IsRegistrationInvalid() {
+		if err := s.reregister(err); err != nil {
+			return err
+		}
+
+		response, err = s.client.DoBunqRequest(context.Background(), "POST", "/session-server", request)
+	}
+
 	if err != nil {
 		s.log.WithError(err).Error("Starting new session failed")
 		return err
@@ -67,7 +184,10 @@ func (s *BunqSession) StartSession() error {
 		return err
 	}
 
-	sessionServer := BunqSessionServer{}
+	createdAt := time.Now()
+	sessionServer := BunqSessionServer{
+		CreatedAt: &createdAt,
+	}
 	for _, item := range sessionServerResponse.Response {
 		if item.Id != nil {
 			sessionServer.Id = item.Id
@@ -80,6 +200,18 @@ func (s *BunqSession) StartSession() error {
 		if item.UserPerson != nil {
 			sessionServer.UserPerson = item.UserPerson
 		}
+
+		if item.UserCompany != nil {
+			sessionServer.UserCompany = item.UserCompany
+		}
+
+		if item.UserApiKey != nil {
+			sessionServer.UserApiKey = item.UserApiKey
+		}
+	}
+
+	if user, err := sessionServer.GetUser(); err == nil {
+		sessionServer.SessionTimeout = user.SessionTimeout
 	}
 
 	if err := s.writeSessionToFile(&sessionServer); err != nil {
@@ -87,10 +219,73 @@ func (s *BunqSession) StartSession() error {
 	}
 
 	s.sessionServer = &sessionServer
+	s.lastUsed = createdAt
 	s.client.SetSession(s)
 	return nil
 }
 
+// isExpiring reports whether the session expires within the refresh margin. Sessions stored before the creation
+// time was tracked are treated as expiring, sessions without a known timeout are only restarted when bunq rejects them.
+func (s *BunqSession) isExpiring() bool {
+	if s.sessionServer == nil {
+		return false
+	}
+
+	if s.sessionServer.CreatedAt == nil {
+		return true
+	}
+
+	if s.sessionServer.SessionTimeout <= 0 {
+		return false
+	}
+
+	return time.Now().Add(sessionRefreshMargin).After(s.expiresAt())
+}
+
+// expiresAt returns when bunq expires the session, every request extends the session by the session timeout
+func (s *BunqSession) expiresAt() time.Time {
+	return s.sessionServer.expiresAt(s.lastUsed)
+}
+
+// expiresAt returns when bunq expires the session when it was last used at lastUsed. A stored session is only known
+// to be used when it was created, a loaded session is restarted once that time has passed.
+func (s *BunqSessionServer) expiresAt(lastUsed time.Time) time.Time {
+	lastActivity := lastUsed
+	if s.CreatedAt != nil && s.CreatedAt.After(lastActivity) {
+		lastActivity = *s.CreatedAt
+	}
+
+	return lastActivity.Add(time.Duration(s.SessionTimeout) * time.Second)
+}
+
+// ReadStoredSession returns the session stored by the sync, without starting, refreshing or writing a session. It fails
+// when the session expired or the sync would restart it, because it was stored before the creation time was tracked.
+func ReadStoredSession(config *util.Config) (*BunqSessionServer, error) {
+	var sessionServer BunqSessionServer
+	if err := util.ReadStateFile(config.StorageLocation+config.BunqConfig.SessionServerFileName, &sessionServer); err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New("no session in storage")
+		}
+		return nil, err
+	}
+
+	if sessionServer.Token == nil || sessionServer.Token.Token == "" {
+		return nil, errors.New("no session token in storage")
+	}
+
+	if sessionServer.CreatedAt == nil {
+		return nil, errors.New("stored session has no creation time, the next sync starts a new session")
+	}
+
+	if sessionServer.SessionTimeout > 0 {
+		if expiresAt := sessionServer.expiresAt(time.Time{}); time.Now().After(expiresAt) {
+			return nil, errors.New("stored session expired at " + expiresAt.Format(time.RFC3339))
+		}
+	}
+
+	return &sessionServer, nil
+}
+
 func (s *BunqSession) loadSession() error {
 	sessionServer, err := s.readSessionFromFile()
 	if err != nil {
@@ -103,14 +298,7 @@ func (s *BunqSession) loadSession() error {
 }
 
 func (s *BunqSession) writeSessionToFile(sessionServer *BunqSessionServer) error {
-	sessionServerJson, err := json.Marshal(sessionServer)
-	if err != nil {
-		s.log.WithError(err).Error("Marshal session server failed")
-		return err
-	}
-
-	if err := os.WriteFile(s.sessionLocation, sessionServerJson, 0700); err != nil {
-		os.Remove(s.sessionLocation)
+	if err := util.WriteStateFile(s.sessionLocation, sessionServer); err != nil {
 		s.log.WithError(err).Error("Cannot write session to storage")
 		return err
 	}
@@ -124,16 +312,10 @@ func (s *BunqSession) readSessionFromFile() (*BunqSessionServer, error) {
 		return nil, errors.New("cannot load session from storage, session file not found")
 	}
 
-	sessionServerJson, err := os.ReadFile(s.sessionLocation)
-	if err != nil {
-		s.log.WithError(err).Error("Cannot read session file from storage")
-		return nil, err
-	}
-
 	var sessionServer BunqSessionServer
-	if err := json.Unmarshal(sessionServerJson, &sessionServer); err != nil {
+	if err := util.ReadStateFile(s.sessionLocation, &sessionServer); err != nil {
 		os.Remove(s.sessionLocation)
-		s.log.WithError(err).Error("Cannot unmarshal stored session")
+		s.log.WithError(err).Error("Cannot read stored session")
 		return nil, err
 	}
 
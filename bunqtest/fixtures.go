@@ -0,0 +1,153 @@
+package bunqtest
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/bunq"
+)
+
+// Fixtures is the data served by the fake bunq server. Exactly one of UserPerson and UserCompany should be set.
+type Fixtures struct {
+	ApiKey      string                `json:"api_key"`
+	UserPerson  *bunq.BunqUserPerson  `json:"user_person"`
+	UserCompany *bunq.BunqUserCompany `json:"user_company"`
+	Accounts    []*AccountFixture     `json:"accounts"`
+}
+
+// AccountFixture is a monetary account with everything that belongs to it. Notes and note attachments are keyed by
+// payment id, attachment contents by attachment id.
+type AccountFixture struct {
+	Account           *bunq.BunqMonetaryAccountBank      `json:"account"`
+	Payments          []*bunq.BunqPayment                `json:"payments"`
+	MastercardActions []*bunq.BunqMastercardAction       `json:"mastercard_actions"`
+	Notes             map[int][]*bunq.BunqNoteText       `json:"notes"`
+	NoteAttachments   map[int][]*bunq.BunqNoteAttachment `json:"note_attachments"`
+	Attachments       map[int]*AttachmentFixture         `json:"attachments"`
+}
+
+type AttachmentFixture struct {
+	ContentType string `json:"content_type"`
+	Content     []byte `json:"content"`
+}
+
+// LoadFixtures reads fixtures from a json file, timestamps use the bunq format
+func LoadFixtures(path string) (*Fixtures, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fixtures Fixtures
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		return nil, err
+	}
+
+	return &fixtures, nil
+}
+
+// DefaultFixtures returns a person with a main and a savings account, with a few payments in the last days
+func DefaultFixtures() *Fixtures {
+	now := time.Now().UTC()
+
+	mainAccount := Account(1001, "NL00BUNQ0000000001", "Main")
+	savingsAccount := Account(1002, "NL00BUNQ0000000002", "Savings")
+	mainIban, _ := mainAccount.GetIBAN()
+	savingsIban, _ := savingsAccount.GetIBAN()
+
+	return &Fixtures{
+		ApiKey: "sandbox_test_api_key",
+		UserPerson: &bunq.BunqUserPerson{
+			Id:             100,
+			DisplayName:    "Test User",
+			PublicNickName: "Test",
+			LegalName:      "Test User",
+			SessionTimeout: 3600,
+		},
+		Accounts: []*AccountFixture{
+			{
+				Account: mainAccount,
+				Payments: []*bunq.BunqPayment{
+					Payment(5004, mainAccount, "-25.00", "Groceries", "NL00SHOP0000000001", "Supermarket", now.Add(-1*time.Hour)),
+					Payment(5003, mainAccount, "-100.00", "To savings", savingsIban, "Savings", now.Add(-24*time.Hour)),
+					Payment(5002, mainAccount, "2500.00", "Salary", "NL00WORK0000000001", "Employer", now.Add(-48*time.Hour)),
+					Payment(5001, mainAccount, "-4.50", "Coffee", "", "Coffee bar", now.Add(-72*time.Hour)),
+				},
+			},
+			{
+				Account: savingsAccount,
+				Payments: []*bunq.BunqPayment{
+					Payment(6001, savingsAccount, "100.00", "To savings", mainIban, "Main", now.Add(-24*time.Hour)),
+				},
+			},
+		},
+	}
+}
+
+// Account returns an active euro monetary account with the given iban
+func Account(id int, iban string, description string) *bunq.BunqMonetaryAccountBank {
+	return &bunq.BunqMonetaryAccountBank{
+		Id:          id,
+		Currency:    "EUR",
+		Description: description,
+		DisplayName: "Test User",
+		Status:      "ACTIVE",
+		Balance:     &bunq.BunqAmount{Value: "0.00", Currency: "EUR"},
+		Alias: []*bunq.BunqPointer{
+			{Type: "IBAN", Value: iban, Name: "Test User"},
+		},
+	}
+}
+
+// Payment returns a payment of the account, amount is negative for outgoing payments
+func Payment(id int, account *bunq.BunqMonetaryAccountBank, amount string, description string, counterpartyIban string, counterpartyName string, created time.Time) *bunq.BunqPayment {
+	iban, _ := account.GetIBAN()
+	paymentType := "BUNQ"
+	if counterpartyIban == "" {
+		paymentType = "MASTERCARD"
+	}
+
+	return &bunq.BunqPayment{
+		Id:                id,
+		Created:           &bunq.BunqTime{Time: created.UTC()},
+		Updated:           &bunq.BunqTime{Time: created.UTC()},
+		MonetaryAccountId: account.Id,
+		Amount:            &bunq.BunqAmount{Value: amount, Currency: account.Currency},
+		Description:       description,
+		Type:              paymentType,
+		Alias: &bunq.BunqPaymentMonetaryAccount{
+			Iban:        iban,
+			DisplayName: account.DisplayName,
+		},
+		CounterpartyAlias: &bunq.BunqPaymentMonetaryAccount{
+			Iban:        counterpartyIban,
+			DisplayName: counterpartyName,
+		},
+	}
+}
+
+// MastercardAction returns an allowed card authorisation of the account that is not settled yet, amount is negative
+func MastercardAction(id int, account *bunq.BunqMonetaryAccountBank, amount string, counterpartyName string, created time.Time) *bunq.BunqMastercardAction {
+	iban, _ := account.GetIBAN()
+
+	return &bunq.BunqMastercardAction{
+		Id:                  id,
+		Created:             &bunq.BunqTime{Time: created.UTC()},
+		Updated:             &bunq.BunqTime{Time: created.UTC()},
+		MonetaryAccountId:   account.Id,
+		AmountLocal:         &bunq.BunqAmount{Value: amount, Currency: account.Currency},
+		AmountBilling:       &bunq.BunqAmount{Value: amount, Currency: account.Currency},
+		Decision:            bunq.MastercardActionDecisionAllowed,
+		Description:         counterpartyName,
+		AuthorisationStatus: "AUTHORISED",
+		ClearingStatus:      bunq.MastercardActionClearingPending,
+		Alias: &bunq.BunqPaymentMonetaryAccount{
+			Iban:        iban,
+			DisplayName: account.DisplayName,
+		},
+		CounterpartyAlias: &bunq.BunqPaymentMonetaryAccount{
+			DisplayName: counterpartyName,
+		},
+	}
+}
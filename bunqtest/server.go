@@ -0,0 +1,782 @@
+// Package bunqtest provides an in-process fake of the bunq api for tests and local development. It implements the
+// registration flow, validates client signatures and signs its responses with its own server key.
+package bunqtest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/bunq"
+	"github.com/google/uuid"
+)
+
+// Default and maximum number of items in a page of a list endpoint, like the bunq api
+const (
+	defaultPageSize = 10
+	maxPageSize     = 200
+)
+
+// Request is a request received by the fake server
+type Request struct {
+	Method string
+	Path   string
+	// RateLimited is set when the request was answered with 429 Too Many Requests
+	RateLimited bool
+}
+
+type installation struct {
+	id              int
+	token           string
+	clientPublicKey *rsa.PublicKey
+}
+
+type deviceServer struct {
+	id                int
+	installationToken string
+}
+
+type session struct {
+	id                int
+	token             string
+	installationToken string
+	createdAt         time.Time
+}
+
+type Server struct {
+	// URL is the api base url including /v1, only set when started with Start
+	URL string
+
+	fixtures           *Fixtures
+	serverKey          *rsa.PrivateKey
+	serverPublicKeyPem string
+	mux                *http.ServeMux
+	httpServer         *httptest.Server
+
+	mutex         sync.Mutex
+	nextId        int
+	installations map[string]*installation
+	deviceServers map[int]*deviceServer
+	sessions      map[string]*session
+	rateLimited   int
+	expireAfter   int
+	requests      []*Request
+}
+
+// NewServer creates a fake bunq server for the fixtures, serve it with an http server on any address and use
+// <address>/v1 as BUNQ_API_BASE_URL
+func NewServer(fixtures *Fixtures) (*Server, error) {
+	serverKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&serverKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		fixtures:           fixtures,
+		serverKey:          serverKey,
+		serverPublicKeyPem: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyBytes})),
+		nextId:             1,
+		installations:      map[string]*installation{},
+		deviceServers:      map[int]*deviceServer{},
+		sessions:           map[string]*session{},
+	}
+
+	for _, account := range fixtures.Accounts {
+		sort.Slice(account.Payments, func(i, j int) bool { return account.Payments[i].Id > account.Payments[j].Id })
+		sort.Slice(account.MastercardActions, func(i, j int) bool {
+			return account.MastercardActions[i].Id > account.MastercardActions[j].Id
+		})
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/installation", s.handleInstallation)
+	mux.HandleFunc("POST /v1/device-server", s.handleCreateDeviceServer)
+	mux.HandleFunc("GET /v1/device-server/{id}", s.withSession(s.handleGetDeviceServer))
+	mux.HandleFunc("POST /v1/session-server", s.handleSessionServer)
+	mux.HandleFunc("DELETE /v1/session/{id}", s.withSession(s.handleDeleteSession))
+	mux.HandleFunc("GET /v1/user/{userId}", s.withUser(s.handleGetUser))
+	mux.HandleFunc("GET /v1/user/{userId}/monetary-account-bank", s.withUser(s.handleMonetaryAccounts))
+	mux.HandleFunc("GET /v1/user/{userId}/monetary-account/{accountId}/payment", s.withAccount(s.handlePayments))
+	mux.HandleFunc("GET /v1/user/{userId}/monetary-account/{accountId}/payment/{paymentId}", s.withAccount(s.handleGetPayment))
+	mux.HandleFunc("GET /v1/user/{userId}/monetary-account/{accountId}/mastercard-action", s.withAccount(s.handleMastercardActions))
+	mux.HandleFunc("GET /v1/user/{userId}/monetary-account/{accountId}/payment/{paymentId}/note-text", s.withAccount(s.handleGetNotes))
+	mux.HandleFunc("POST /v1/user/{userId}/monetary-account/{accountId}/payment/{paymentId}/note-text", s.withAccount(s.handleCreateNote))
+	mux.HandleFunc("GET /v1/user/{userId}/monetary-account/{accountId}/payment/{paymentId}/note-attachment", s.withAccount(s.handleNoteAttachments))
+	mux.HandleFunc("GET /v1/user/{userId}/monetary-account/{accountId}/attachment/{attachmentId}/content", s.withAccount(s.handleAttachmentContent))
+	s.mux = mux
+
+	return s, nil
+}
+
+// Start creates a fake bunq server and serves it on a random local port until Close is called
+func Start(fixtures *Fixtures) (*Server, error) {
+	s, err := NewServer(fixtures)
+	if err != nil {
+		return nil, err
+	}
+
+	s.httpServer = httptest.NewServer(s)
+	s.URL = s.httpServer.URL + "/v1"
+
+	return s, nil
+}
+
+func (s *Server) Close() {
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+}
+
+// RateLimit makes the server answer the next count requests with 429 Too Many Requests
+func (s *Server) RateLimit(count int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.rateLimited = count
+}
+
+// ExpireSessions invalidates all sessions, like bunq does when the session timeout passed
+func (s *Server) ExpireSessions() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sessions = map[string]*session{}
+}
+
+// ExpireSessionsAfter invalidates all sessions once count more requests are received, to expire the session halfway
+// through a sync
+func (s *Server) ExpireSessionsAfter(count int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.expireAfter = count
+}
+
+// RevokeInstallations invalidates all installations and device servers, like bunq does when the api key is revoked
+func (s *Server) RevokeInstallations() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.installations = map[string]*installation{}
+	s.deviceServers = map[int]*deviceServer{}
+	s.sessions = map[string]*session{}
+}
+
+// AddPayment adds a payment to the account between syncs, like bunq does when a card payment is settled
+func (s *Server) AddPayment(accountId int, payment *bunq.BunqPayment) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	account := s.findAccount(accountId)
+	if account == nil {
+		return
+	}
+
+	account.Payments = append(account.Payments, payment)
+	sort.Slice(account.Payments, func(i, j int) bool { return account.Payments[i].Id > account.Payments[j].Id })
+}
+
+// UpdateMastercardAction replaces the mastercard action with the same id between syncs, to settle, reverse or expire
+// an authorisation
+func (s *Server) UpdateMastercardAction(accountId int, action *bunq.BunqMastercardAction) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	account := s.findAccount(accountId)
+	if account == nil {
+		return
+	}
+
+	for i, existing := range account.MastercardActions {
+		if existing.Id == action.Id {
+			account.MastercardActions[i] = action
+		}
+	}
+}
+
+// Requests returns all requests received so far, including rate limited and rejected ones
+func (s *Server) Requests() []*Request {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]*Request{}, s.requests...)
+}
+
+// Notes returns the notes of a payment, including the notes created through the api
+func (s *Server) Notes(accountId int, paymentId int) []*bunq.BunqNoteText {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	account := s.findAccount(accountId)
+	if account == nil {
+		return nil
+	}
+
+	return append([]*bunq.BunqNoteText{}, account.Notes[paymentId]...)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	rateLimited := s.rateLimited > 0
+	if rateLimited {
+		s.rateLimited--
+	}
+	s.requests = append(s.requests, &Request{Method: r.Method, Path: r.URL.Path, RateLimited: rateLimited})
+	if s.expireAfter > 0 {
+		s.expireAfter--
+		if s.expireAfter == 0 {
+			s.sessions = map[string]*session{}
+		}
+	}
+	s.mutex.Unlock()
+
+	if rateLimited {
+		w.Header().Set("Retry-After", "0")
+		s.writeError(w, r, http.StatusTooManyRequests, "Too many requests. You can do a maximum of 3 calls per 3 second to this endpoint.")
+		return
+	}
+
+	s.mux.ServeHTTP(w, r)
+}
+
+// HANDLERS
+
+func (s *Server) handleInstallation(w http.ResponseWriter, r *http.Request) {
+	var request bunq.BunqInstallationRequest
+	body, ok := s.readBody(w, r, &request)
+	if !ok {
+		return
+	}
+
+	block, _ := pem.Decode([]byte(request.ClientPublicKey))
+	if block == nil {
+		s.writeError(w, r, http.StatusBadRequest, "Public key is not in PEM format.")
+		return
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	publicKey, isRsa := key.(*rsa.PublicKey)
+	if err != nil || !isRsa {
+		s.writeError(w, r, http.StatusBadRequest, "Public key is not a valid RSA key.")
+		return
+	}
+
+	if !s.verifySignature(w, r, body, publicKey) {
+		return
+	}
+
+	s.mutex.Lock()
+	item := &installation{id: s.newId(), token: s.newToken(), clientPublicKey: publicKey}
+	s.installations[item.token] = item
+	tokenId := s.newId()
+	s.mutex.Unlock()
+
+	s.writeResponse(w, r, []interface{}{
+		map[string]interface{}{"Id": bunq.BunqId{Id: item.id}},
+		map[string]interface{}{"Token": bunq.BunqInstallationToken{Id: tokenId, Token: item.token}},
+		map[string]interface{}{"ServerPublicKey": bunq.BunqInstallationServerPublicKey{ServicePublicKey: s.serverPublicKeyPem}},
+	}, nil)
+}
+
+func (s *Server) handleCreateDeviceServer(w http.ResponseWriter, r *http.Request) {
+	installation, ok := s.authenticateInstallation(w, r)
+	if !ok {
+		return
+	}
+
+	var request bunq.BunqDeviceServerRequest
+	body, ok := s.readBody(w, r, &request)
+	if !ok || !s.verifySignature(w, r, body, installation.clientPublicKey) {
+		return
+	}
+
+	if request.Secret != s.fixtures.ApiKey {
+		s.writeError(w, r, http.StatusBadRequest, "User credentials are incorrect. Incorrect API key or IP address.")
+		return
+	}
+
+	s.mutex.Lock()
+	device := &deviceServer{id: s.newId(), installationToken: installation.token}
+	s.deviceServers[device.id] = device
+	s.mutex.Unlock()
+
+	s.writeResponse(w, r, []interface{}{
+		map[string]interface{}{"Id": bunq.BunqId{Id: device.id}},
+	}, nil)
+}
+
+func (s *Server) handleGetDeviceServer(w http.ResponseWriter, r *http.Request, _ *session) {
+	id, _ := strconv.Atoi(r.PathValue("id"))
+
+	s.mutex.Lock()
+	device := s.deviceServers[id]
+	s.mutex.Unlock()
+
+	if device == nil {
+		s.writeError(w, r, http.StatusNotFound, "DeviceServer not found.")
+		return
+	}
+
+	s.writeResponse(w, r, []interface{}{
+		map[string]interface{}{"DeviceServer": map[string]interface{}{"id": device.id, "status": "ACTIVE"}},
+	}, nil)
+}
+
+func (s *Server) handleSessionServer(w http.ResponseWriter, r *http.Request) {
+	installation, ok := s.authenticateInstallation(w, r)
+	if !ok {
+		return
+	}
+
+	var request bunq.BunqSessionServerRequest
+	body, ok := s.readBody(w, r, &request)
+	if !ok || !s.verifySignature(w, r, body, installation.clientPublicKey) {
+		return
+	}
+
+	s.mutex.Lock()
+	registered := false
+	for _, device := range s.deviceServers {
+		registered = registered || device.installationToken == installation.token
+	}
+	s.mutex.Unlock()
+
+	if request.Secret != s.fixtures.ApiKey || !registered {
+		s.writeError(w, r, http.StatusBadRequest, "User credentials are incorrect. Incorrect API key or IP address.")
+		return
+	}
+
+	s.mutex.Lock()
+	item := &session{id: s.newId(), token: s.newToken(), installationToken: installation.token, createdAt: time.Now()}
+	s.sessions[item.token] = item
+	s.mutex.Unlock()
+
+	response := []interface{}{
+		map[string]interface{}{"Id": bunq.BunqId{Id: item.id}},
+		map[string]interface{}{"Token": bunq.BunqSessionServerToken{Id: item.id, Token: item.token}},
+	}
+	if s.fixtures.UserCompany != nil {
+		response = append(response, map[string]interface{}{"UserCompany": s.fixtures.UserCompany})
+	} else {
+		response = append(response, map[string]interface{}{"UserPerson": s.fixtures.UserPerson})
+	}
+
+	s.writeResponse(w, r, response, nil)
+}
+
+func (s *Server) handleDeleteSession(w http.ResponseWriter, r *http.Request, current *session) {
+	id, _ := strconv.Atoi(r.PathValue("id"))
+	if id != current.id {
+		s.writeError(w, r, http.StatusNotFound, "Session not found.")
+		return
+	}
+
+	s.mutex.Lock()
+	delete(s.sessions, current.token)
+	s.mutex.Unlock()
+
+	s.writeResponse(w, r, []interface{}{}, nil)
+}
+
+func (s *Server) handleGetUser(w http.ResponseWriter, r *http.Request, _ *session) {
+	if s.fixtures.UserCompany != nil {
+		s.writeResponse(w, r, []interface{}{map[string]interface{}{"UserCompany": s.fixtures.UserCompany}}, nil)
+		return
+	}
+
+	s.writeResponse(w, r, []interface{}{map[string]interface{}{"UserPerson": s.fixtures.UserPerson}}, nil)
+}
+
+func (s *Server) handleMonetaryAccounts(w http.ResponseWriter, r *http.Request, _ *session) {
+	response := []interface{}{}
+	for _, account := range s.fixtures.Accounts {
+		response = append(response, bunq.BunqMonetaryAccountBankItem{MonetaryAccountBank: account.Account})
+	}
+
+	s.writeResponse(w, r, response, nil)
+}
+
+func (s *Server) handlePayments(w http.ResponseWriter, r *http.Request, account *AccountFixture) {
+	ids := make([]int, len(account.Payments))
+	for i, payment := range account.Payments {
+		ids[i] = payment.Id
+	}
+
+	start, end, pagination, ok := s.paginate(w, r, ids)
+	if !ok {
+		return
+	}
+
+	response := []interface{}{}
+	for _, payment := range account.Payments[start:end] {
+		response = append(response, bunq.BunqPaymentResponse{Payment: payment})
+	}
+
+	s.writeResponse(w, r, response, pagination)
+}
+
+func (s *Server) handleGetPayment(w http.ResponseWriter, r *http.Request, account *AccountFixture) {
+	paymentId, ok := s.findPayment(w, r, account)
+	if !ok {
+		return
+	}
+
+	response := []interface{}{}
+	for _, payment := range account.Payments {
+		if payment.Id == paymentId {
+			response = append(response, bunq.BunqPaymentResponse{Payment: payment})
+		}
+	}
+
+	s.writeResponse(w, r, response, nil)
+}
+
+func (s *Server) handleMastercardActions(w http.ResponseWriter, r *http.Request, account *AccountFixture) {
+	ids := make([]int, len(account.MastercardActions))
+	for i, action := range account.MastercardActions {
+		ids[i] = action.Id
+	}
+
+	start, end, pagination, ok := s.paginate(w, r, ids)
+	if !ok {
+		return
+	}
+
+	response := []interface{}{}
+	for _, action := range account.MastercardActions[start:end] {
+		response = append(response, bunq.BunqMastercardActionResponse{MastercardAction: action})
+	}
+
+	s.writeResponse(w, r, response, pagination)
+}
+
+func (s *Server) handleGetNotes(w http.ResponseWriter, r *http.Request, account *AccountFixture) {
+	paymentId, ok := s.findPayment(w, r, account)
+	if !ok {
+		return
+	}
+
+	s.mutex.Lock()
+	response := []interface{}{}
+	for _, note := range account.Notes[paymentId] {
+		response = append(response, bunq.BunqNoteTextResponse{NoteText: note})
+	}
+	s.mutex.Unlock()
+
+	s.writeResponse(w, r, response, &bunq.BunqPagination{})
+}
+
+func (s *Server) handleCreateNote(w http.ResponseWriter, r *http.Request, account *AccountFixture) {
+	paymentId, ok := s.findPayment(w, r, account)
+	if !ok {
+		return
+	}
+
+	var request bunq.BunqNoteTextRequest
+	body, ok := s.readBody(w, r, &request)
+	if !ok || !s.verifySessionSignature(w, r, body) {
+		return
+	}
+
+	now := &bunq.BunqTime{Time: time.Now().UTC()}
+
+	s.mutex.Lock()
+	note := &bunq.BunqNoteText{Id: s.newId(), Created: now, Updated: now, Content: request.Content}
+	if account.Notes == nil {
+		account.Notes = map[int][]*bunq.BunqNoteText{}
+	}
+	account.Notes[paymentId] = append(account.Notes[paymentId], note)
+	s.mutex.Unlock()
+
+	s.writeResponse(w, r, []interface{}{map[string]interface{}{"Id": bunq.BunqId{Id: note.Id}}}, nil)
+}
+
+func (s *Server) handleNoteAttachments(w http.ResponseWriter, r *http.Request, account *AccountFixture) {
+	paymentId, ok := s.findPayment(w, r, account)
+	if !ok {
+		return
+	}
+
+	response := []interface{}{}
+	for _, attachment := range account.NoteAttachments[paymentId] {
+		response = append(response, bunq.BunqNoteAttachmentResponse{NoteAttachment: attachment})
+	}
+
+	s.writeResponse(w, r, response, &bunq.BunqPagination{})
+}
+
+func (s *Server) handleAttachmentContent(w http.ResponseWriter, r *http.Request, account *AccountFixture) {
+	attachmentId, _ := strconv.Atoi(r.PathValue("attachmentId"))
+	attachment := account.Attachments[attachmentId]
+	if attachment == nil {
+		s.writeError(w, r, http.StatusNotFound, "Attachment not found.")
+		return
+	}
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	s.write(w, r, http.StatusOK, attachment.Content)
+}
+
+// MIDDLEWARE
+
+// withSession only calls the handler for requests authenticated with a valid session token
+func (s *Server) withSession(handler func(http.ResponseWriter, *http.Request, *session)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		current := s.sessions[r.Header.Get("X-Bunq-Client-Authentication")]
+		timeout := s.sessionTimeout()
+		if current != nil && timeout > 0 && time.Since(current.createdAt) > timeout {
+			delete(s.sessions, current.token)
+			current = nil
+		}
+		s.mutex.Unlock()
+
+		if current == nil {
+			s.writeError(w, r, http.StatusUnauthorized, "Insufficient authorisation.")
+			return
+		}
+
+		handler(w, r, current)
+	}
+}
+
+// withUser checks that the session belongs to the user in the path
+func (s *Server) withUser(handler func(http.ResponseWriter, *http.Request, *session)) http.HandlerFunc {
+	return s.withSession(func(w http.ResponseWriter, r *http.Request, current *session) {
+		if r.PathValue("userId") != strconv.Itoa(s.userId()) {
+			s.writeError(w, r, http.StatusForbidden, "Insufficient authorisation.")
+			return
+		}
+
+		handler(w, r, current)
+	})
+}
+
+// withAccount resolves the monetary account in the path
+func (s *Server) withAccount(handler func(http.ResponseWriter, *http.Request, *AccountFixture)) http.HandlerFunc {
+	return s.withUser(func(w http.ResponseWriter, r *http.Request, _ *session) {
+		accountId, _ := strconv.Atoi(r.PathValue("accountId"))
+
+		s.mutex.Lock()
+		account := s.findAccount(accountId)
+		s.mutex.Unlock()
+
+		if account == nil {
+			s.writeError(w, r, http.StatusNotFound, "MonetaryAccount not found.")
+			return
+		}
+
+		handler(w, r, account)
+	})
+}
+
+// UTILS
+
+func (s *Server) authenticateInstallation(w http.ResponseWriter, r *http.Request) (*installation, bool) {
+	s.mutex.Lock()
+	item := s.installations[r.Header.Get("X-Bunq-Client-Authentication")]
+	s.mutex.Unlock()
+
+	if item == nil {
+		s.writeError(w, r, http.StatusUnauthorized, "Insufficient authorisation. Installation token is invalid.")
+		return nil, false
+	}
+
+	return item, true
+}
+
+func (s *Server) readBody(w http.ResponseWriter, r *http.Request, request interface{}) ([]byte, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, "Cannot read request body.")
+		return nil, false
+	}
+
+	if err := json.Unmarshal(body, request); err != nil {
+		s.writeError(w, r, http.StatusBadRequest, "Request body is not valid JSON.")
+		return nil, false
+	}
+
+	return body, true
+}
+
+// verifySignature checks the X-Bunq-Client-Signature header, a sha256 signature of the body with the client key
+func (s *Server) verifySignature(w http.ResponseWriter, r *http.Request, body []byte, publicKey *rsa.PublicKey) bool {
+	signature, err := base64.StdEncoding.DecodeString(r.Header.Get("X-Bunq-Client-Signature"))
+	if err == nil && len(signature) > 0 {
+		hashedBody := sha256.Sum256(body)
+		err = rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hashedBody[:], signature)
+	} else if err == nil {
+		err = errors.New("missing signature")
+	}
+
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, "Request signature is invalid.")
+		return false
+	}
+
+	return true
+}
+
+func (s *Server) verifySessionSignature(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	s.mutex.Lock()
+	var publicKey *rsa.PublicKey
+	if current := s.sessions[r.Header.Get("X-Bunq-Client-Authentication")]; current != nil {
+		if item := s.installations[current.installationToken]; item != nil {
+			publicKey = item.clientPublicKey
+		}
+	}
+	s.mutex.Unlock()
+
+	if publicKey == nil {
+		s.writeError(w, r, http.StatusUnauthorized, "Insufficient authorisation.")
+		return false
+	}
+
+	return s.verifySignature(w, r, body, publicKey)
+}
+
+// paginate returns the range of items, sorted from new to old, after the older_id query parameter
+func (s *Server) paginate(w http.ResponseWriter, r *http.Request, ids []int) (int, int, *bunq.BunqPagination, bool) {
+	count := defaultPageSize
+	if value := r.URL.Query().Get("count"); value != "" {
+		var err error
+		count, err = strconv.Atoi(value)
+		if err != nil || count < 1 || count > maxPageSize {
+			s.writeError(w, r, http.StatusBadRequest, "Count must be between 1 and 200.")
+			return 0, 0, nil, false
+		}
+	}
+
+	start := 0
+	if value := r.URL.Query().Get("older_id"); value != "" {
+		olderId, err := strconv.Atoi(value)
+		if err != nil {
+			s.writeError(w, r, http.StatusBadRequest, "Older id must be a number.")
+			return 0, 0, nil, false
+		}
+
+		for start < len(ids) && ids[start] >= olderId {
+			start++
+		}
+	}
+
+	end := start + count
+	if end > len(ids) {
+		end = len(ids)
+	}
+
+	pagination := &bunq.BunqPagination{}
+	if end < len(ids) && end > start {
+		pagination.OlderUrl = r.URL.Path[len("/v1"):] + "?count=" + strconv.Itoa(count) + "&older_id=" + strconv.Itoa(ids[end-1])
+	}
+
+	return start, end, pagination, true
+}
+
+func (s *Server) findPayment(w http.ResponseWriter, r *http.Request, account *AccountFixture) (int, bool) {
+	paymentId, _ := strconv.Atoi(r.PathValue("paymentId"))
+	for _, payment := range account.Payments {
+		if payment.Id == paymentId {
+			return paymentId, true
+		}
+	}
+
+	s.writeError(w, r, http.StatusNotFound, "Payment not found.")
+	return 0, false
+}
+
+func (s *Server) findAccount(accountId int) *AccountFixture {
+	for _, account := range s.fixtures.Accounts {
+		if account.Account.Id == accountId {
+			return account
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) userId() int {
+	if s.fixtures.UserCompany != nil {
+		return s.fixtures.UserCompany.Id
+	}
+
+	return s.fixtures.UserPerson.Id
+}
+
+func (s *Server) sessionTimeout() time.Duration {
+	if s.fixtures.UserCompany != nil {
+		return time.Duration(s.fixtures.UserCompany.SessionTimeout) * time.Second
+	}
+
+	return time.Duration(s.fixtures.UserPerson.SessionTimeout) * time.Second
+}
+
+// newId returns a unique id, the mutex must be held
+func (s *Server) newId() int {
+	id := s.nextId
+	s.nextId++
+
+	return id
+}
+
+func (s *Server) newToken() string {
+	return uuid.New().String()
+}
+
+func (s *Server) writeResponse(w http.ResponseWriter, r *http.Request, response []interface{}, pagination *bunq.BunqPagination) {
+	body := map[string]interface{}{"Response": response}
+	if pagination != nil {
+		body["Pagination"] = pagination
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	s.write(w, r, http.StatusOK, data)
+}
+
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, statusCode int, description string) {
+	data, _ := json.Marshal(map[string]interface{}{
+		"Error": []map[string]string{
+			{"error_description": description, "error_description_translated": description},
+		},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	s.write(w, r, statusCode, data)
+}
+
+// write sends the body signed with the server key and with the request id of the client
+func (s *Server) write(w http.ResponseWriter, r *http.Request, statusCode int, body []byte) {
+	hashedBody := sha256.Sum256(body)
+	if signature, err := rsa.SignPKCS1v15(rand.Reader, s.serverKey, crypto.SHA256, hashedBody[:]); err == nil {
+		w.Header().Set("X-Bunq-Server-Signature", base64.StdEncoding.EncodeToString(signature))
+	}
+
+	w.Header().Set("X-Bunq-Client-Request-Id", r.Header.Get("X-Bunq-Client-Request-Id"))
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
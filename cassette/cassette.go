@@ -0,0 +1,155 @@
+// Package cassette records the http requests of the bunq and Firefly III clients to a file and serves them back, so
+// a misbehaving sync can be reproduced offline. Secrets are scrubbed before anything is written.
+package cassette
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+)
+
+// Cassette is the file format, all interactions in the order they happened
+type Cassette struct {
+	Interactions []*Interaction `json:"interactions"`
+}
+
+type Interaction struct {
+	Request  *RecordedRequest  `json:"request"`
+	Response *RecordedResponse `json:"response"`
+}
+
+type RecordedRequest struct {
+	Method string      `json:"method"`
+	Url    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   *Body       `json:"body,omitempty"`
+}
+
+type RecordedResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       *Body       `json:"body,omitempty"`
+}
+
+// Body is stored as text when possible to keep cassettes readable, binary content like attachments as base64
+type Body struct {
+	Text   string `json:"text,omitempty"`
+	Base64 string `json:"base64,omitempty"`
+}
+
+func newBody(data []byte) *Body {
+	if len(data) == 0 {
+		return nil
+	}
+
+	if utf8.Valid(data) {
+		return &Body{Text: string(data)}
+	}
+
+	return &Body{Base64: base64.StdEncoding.EncodeToString(data)}
+}
+
+func (b *Body) Bytes() ([]byte, error) {
+	if b == nil {
+		return nil, nil
+	}
+
+	if b.Base64 != "" {
+		return base64.StdEncoding.DecodeString(b.Base64)
+	}
+
+	return []byte(b.Text), nil
+}
+
+// Load reads a cassette with one interaction per line. A line cut off by a crash while recording is ignored, cassettes
+// recorded as a single json object with all interactions are read as well.
+func Load(path string) (*Cassette, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	cassette := &Cassette{Interactions: []*Interaction{}}
+	decoder := json.NewDecoder(file)
+	for {
+		var line struct {
+			Interaction
+			Interactions []*Interaction `json:"interactions"`
+		}
+		err := decoder.Decode(&line)
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return cassette, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if line.Interactions != nil {
+			cassette.Interactions = append(cassette.Interactions, line.Interactions...)
+			continue
+		}
+		cassette.Interactions = append(cassette.Interactions, &line.Interaction)
+	}
+}
+
+var (
+	transportsMutex sync.Mutex
+	transports      = map[string]http.RoundTripper{}
+)
+
+// Transport returns the recording or replaying transport configured for the profile, or nil when cassettes are not
+// enabled. The bunq and Firefly III clients of a profile share one transport, so they write to the same cassette.
+func Transport(config *util.Config) (http.RoundTripper, error) {
+	if config.CassetteConfig == nil || config.CassetteConfig.Mode == "" {
+		return nil, nil
+	}
+
+	transportsMutex.Lock()
+	defer transportsMutex.Unlock()
+
+	location := config.CassetteConfig.Location
+	key := string(config.CassetteConfig.Mode) + ":" + location
+	if transport, exists := transports[key]; exists {
+		return transport, nil
+	}
+
+	var transport http.RoundTripper
+	switch config.CassetteConfig.Mode {
+	case util.CassetteRecord:
+		transport = NewRecorder(location, http.DefaultTransport)
+	case util.CassetteReplay:
+		player, err := NewPlayer(location)
+		if err != nil {
+			return nil, err
+		}
+		transport = player
+	default:
+		return nil, errors.New("unknown cassette mode " + string(config.CassetteConfig.Mode))
+	}
+
+	transports[key] = transport
+	return transport, nil
+}
+
+// Close closes the cassette files of the recording transports, it is called when a run or command ends
+func Close() error {
+	transportsMutex.Lock()
+	defer transportsMutex.Unlock()
+
+	var err error
+	for _, transport := range transports {
+		if recorder, isRecorder := transport.(*Recorder); isRecorder {
+			err = errors.Join(err, recorder.Close())
+		}
+	}
+
+	return err
+}
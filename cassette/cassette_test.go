@@ -0,0 +1,155 @@
+package cassette_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/bunqtest"
+	"github.com/daanvanberkel/fireflyiiibunq/cassette"
+	"github.com/daanvanberkel/fireflyiiibunq/fireflytest"
+	"github.com/daanvanberkel/fireflyiiibunq/syncer"
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+	"github.com/sirupsen/logrus"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	fixtures := bunqtest.DefaultFixtures()
+	bunqServer, err := bunqtest.Start(fixtures)
+	if err != nil {
+		t.Fatalf("cannot start fake bunq server: %v", err)
+	}
+	fireflyServer := fireflytest.Start("test-token")
+
+	location := t.TempDir() + "/http_cassette.json"
+	log := logrus.New()
+	log.Out = io.Discard
+	date := time.Now().AddDate(0, 0, -30)
+
+	recordConfig := testConfig(t, bunqServer.URL, fireflyServer.URL, fixtures.ApiKey, "test-token")
+	recordConfig.CassetteConfig = &util.CassetteConfig{Mode: util.CassetteRecord, Location: location}
+	if _, err := syncer.SyncProfile(context.Background(), recordConfig, date, logrus.NewEntry(log)); err != nil {
+		t.Fatalf("recording sync failed: %v", err)
+	}
+	if err := cassette.Close(); err != nil {
+		t.Fatalf("cannot close cassette: %v", err)
+	}
+
+	recorded := len(fireflyServer.Transactions())
+	if recorded == 0 {
+		t.Fatal("recording sync created no transactions")
+	}
+
+	bunqServer.Close()
+	fireflyServer.Close()
+
+	data, err := os.ReadFile(location)
+	if err != nil {
+		t.Fatalf("cannot read cassette: %v", err)
+	}
+	for _, secret := range []string{fixtures.ApiKey, "test-token"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("cassette contains secret %q", secret)
+		}
+	}
+
+	// The servers are gone, so the replay only succeeds when every request is answered from the cassette
+	replayConfig := testConfig(t, bunqServer.URL, fireflyServer.URL, "replay", "replay")
+	replayConfig.CassetteConfig = &util.CassetteConfig{Mode: util.CassetteReplay, Location: location}
+	if _, err := syncer.SyncProfile(context.Background(), replayConfig, date, logrus.NewEntry(log)); err != nil {
+		t.Fatalf("replayed sync failed: %v", err)
+	}
+}
+
+func testConfig(t *testing.T, bunqUrl string, fireflyUrl string, bunqApiKey string, fireflyApiKey string) *util.Config {
+	return &util.Config{
+		StorageLocation: t.TempDir() + "/",
+		BunqConfig: &util.BunqConfig{
+			ApiBaseUrl:            bunqUrl,
+			ApiKey:                bunqApiKey,
+			PrivateKeyFileName:    "bunq_client.key",
+			PublicKeyFileName:     "bunq_client.pub.key",
+			KeyBitSize:            2048,
+			InstallationFileName:  "bunq_installation.json",
+			DeviceServerFileName:  "bunq_device_server.json",
+			SessionServerFileName: "bunq_session_server.json",
+			UserAgent:             "BunqFireflySync/test",
+			PermittedIps:          []string{"*"},
+		},
+		FireflyConfig: &util.FireflyConfig{
+			ApiBaseUrl: fireflyUrl,
+			ApiKey:     fireflyApiKey,
+		},
+		SyncConfig: &util.SyncConfig{
+			SyncNotes:                  true,
+			FailedPaymentsFileName:     "failed_payments.json",
+			SettledCardActionsFileName: "settled_card_actions.json",
+			RetryBackoff:               time.Hour,
+			MaxRetryAttempts:           10,
+		},
+	}
+}
+
+func TestLoadIgnoresInteractionCutOffByCrash(t *testing.T) {
+	location := t.TempDir() + "/http_cassette.json"
+	content := `{"request":{"method":"GET","url":"https://bunq/v1/user"},"response":{"status_code":200}}
+{"request":{"method":"GET","url":"https://bunq/v1/user/100"},"response":{"status_code":200}}
+{"request":{"method":"GET","url":"https://bu`
+	if err := os.WriteFile(location, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := cassette.Load(location)
+	if err != nil {
+		t.Fatalf("cannot load cassette: %v", err)
+	}
+	if len(loaded.Interactions) != 2 || loaded.Interactions[1].Request.Url != "https://bunq/v1/user/100" {
+		t.Errorf("expected the 2 complete interactions, got %d", len(loaded.Interactions))
+	}
+}
+
+func TestRecorderAppendsAfterClose(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	location := t.TempDir() + "/http_cassette.json"
+	if err := os.WriteFile(location, []byte("previous recording\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := cassette.NewRecorder(location, http.DefaultTransport)
+	client := &http.Client{Transport: recorder}
+	for run := 0; run < 2; run++ {
+		response, err := client.Get(server.URL + "/run/" + strconv.Itoa(run))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		// Like a sync on an interval, the cassette is closed after every run
+		if err := recorder.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loaded, err := cassette.Load(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Interactions) != 2 {
+		t.Fatalf("expected the interactions of both runs without the previous recording, got %d", len(loaded.Interactions))
+	}
+	for run, interaction := range loaded.Interactions {
+		if !strings.HasSuffix(interaction.Request.Url, "/run/"+strconv.Itoa(run)) {
+			t.Errorf("expected interaction %d to be of run %d, got %s", run, run, interaction.Request.Url)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package cassette
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+)
+
+// Player is a http.RoundTripper that answers requests from a cassette instead of sending them. Every recorded
+// interaction is served once, in the order of the cassette.
+//
+// The recorded bunq signatures are redacted, so the player signs the responses with its own key and hands out that key
+// as the bunq server public key. Replays start without a stored registration, the installation and device server
+// requests that were not recorded are answered with placeholders.
+type Player struct {
+	mutex    sync.Mutex
+	cassette *Cassette
+	used     []bool
+	keyChain *util.Keychain
+}
+
+func NewPlayer(path string) (*Player, error) {
+	cassette, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keyChain, err := util.GenerateKeyChain(2048)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Player{
+		cassette: cassette,
+		used:     make([]bool, len(cassette.Interactions)),
+		keyChain: keyChain,
+	}, nil
+}
+
+func (p *Player) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Body != nil {
+		request.Body.Close()
+	}
+
+	p.mutex.Lock()
+	interaction := p.next(request)
+	p.mutex.Unlock()
+
+	var statusCode int
+	var header http.Header
+	var body []byte
+	if interaction != nil {
+		var err error
+		body, err = interaction.Response.Body.Bytes()
+		if err != nil {
+			return nil, err
+		}
+
+		statusCode = interaction.Response.StatusCode
+		header = interaction.Response.Header.Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+	} else {
+		placeholder, err := p.placeholder(request)
+		if err != nil {
+			return nil, err
+		}
+
+		statusCode = http.StatusOK
+		header = http.Header{"Content-Type": []string{"application/json"}}
+		body = placeholder
+	}
+
+	if strings.HasSuffix(request.URL.Path, "/installation") {
+		var err error
+		if body, err = p.replaceServerPublicKey(body); err != nil {
+			return nil, err
+		}
+	}
+
+	if requestId := request.Header.Get("X-Bunq-Client-Request-Id"); requestId != "" {
+		header.Set("X-Bunq-Client-Request-Id", requestId)
+
+		signature, err := p.keyChain.Sign(body)
+		if err != nil {
+			return nil, err
+		}
+		header.Set("X-Bunq-Server-Signature", signature)
+	}
+
+	return &http.Response{
+		Status:        http.StatusText(statusCode),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       request,
+	}, nil
+}
+
+// next takes the first unused interaction for the method and path, preferring one with the same query. Queries can
+// differ between the recording and the replay, for example when they contain the sync date.
+func (p *Player) next(request *http.Request) *Interaction {
+	fallback := -1
+	for i, interaction := range p.cassette.Interactions {
+		if p.used[i] || interaction.Request.Method != request.Method {
+			continue
+		}
+
+		recorded, err := request.URL.Parse(interaction.Request.Url)
+		if err != nil || recorded.Path != request.URL.Path {
+			continue
+		}
+
+		if recorded.RawQuery == request.URL.RawQuery {
+			p.used[i] = true
+			return interaction
+		}
+
+		if fallback == -1 {
+			fallback = i
+		}
+	}
+
+	if fallback == -1 {
+		return nil
+	}
+
+	p.used[fallback] = true
+	return p.cassette.Interactions[fallback]
+}
+
+// placeholder answers the bunq registration requests that are missing in the cassette, because the recording run
+// reused its stored registration
+func (p *Player) placeholder(request *http.Request) ([]byte, error) {
+	var item []interface{}
+	switch {
+	case request.Method == http.MethodPost && strings.HasSuffix(request.URL.Path, "/installation"):
+		item = []interface{}{
+			map[string]interface{}{"Id": map[string]int{"id": 1}},
+			map[string]interface{}{"Token": map[string]interface{}{"id": 1, "token": Redacted}},
+			map[string]interface{}{"ServerPublicKey": map[string]string{"server_public_key": Redacted}},
+		}
+	case request.Method == http.MethodPost && strings.HasSuffix(request.URL.Path, "/device-server"):
+		item = []interface{}{
+			map[string]interface{}{"Id": map[string]int{"id": 1}},
+		}
+	default:
+		return nil, errors.New("no recorded response for " + request.Method + " " + request.URL.String())
+	}
+
+	return json.Marshal(map[string]interface{}{"Response": item})
+}
+
+// replaceServerPublicKey swaps the redacted bunq server public key for the key of the player
+func (p *Player) replaceServerPublicKey(body []byte) ([]byte, error) {
+	var response map[string]interface{}
+	if err := json.Unmarshal(body, &response); err != nil {
+		// Error responses are served as they are
+		return body, nil
+	}
+
+	items, _ := response["Response"].([]interface{})
+	for _, item := range items {
+		fields, _ := item.(map[string]interface{})
+		if serverPublicKey, exists := fields["ServerPublicKey"].(map[string]interface{}); exists {
+			serverPublicKey["server_public_key"] = string(p.keyChain.PublicKeyPem)
+		}
+	}
+
+	return json.Marshal(response)
+}
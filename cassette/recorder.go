@@ -0,0 +1,119 @@
+package cassette
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Recorder is a http.RoundTripper that sends requests with the wrapped transport and writes every redacted request
+// and response to the cassette file. Every interaction is appended to the file as one line of json, so the file holds
+// all interactions up to a crash of the sync.
+type Recorder struct {
+	path      string
+	transport http.RoundTripper
+	mutex     sync.Mutex
+	file      *os.File
+	// The file of a previous recording is replaced once, a file reopened after Close is appended to
+	replaced bool
+}
+
+func NewRecorder(path string, transport http.RoundTripper) *Recorder {
+	return &Recorder{
+		path:      path,
+		transport: transport,
+	}
+}
+
+func (r *Recorder) RoundTrip(request *http.Request) (*http.Response, error) {
+	var requestBody []byte
+	if request.Body != nil {
+		var err error
+		requestBody, err = io.ReadAll(request.Body)
+		request.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		request.Body = io.NopCloser(bytes.NewReader(requestBody))
+	}
+
+	response, err := r.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+
+	responseBody, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	response.Body = io.NopCloser(bytes.NewReader(responseBody))
+
+	interaction := &Interaction{
+		Request: &RecordedRequest{
+			Method: request.Method,
+			Url:    request.URL.String(),
+			Header: redactHeader(request.Header),
+			Body:   newBody(redactBody(requestBody, request.Header.Get("Content-Type"))),
+		},
+		Response: &RecordedResponse{
+			StatusCode: response.StatusCode,
+			Header:     redactHeader(response.Header),
+			Body:       newBody(redactBody(responseBody, response.Header.Get("Content-Type"))),
+		},
+	}
+
+	if err := r.append(interaction); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// append writes the interaction to the cassette file, the file of a previous recording is replaced by the first one
+func (r *Recorder) append(interaction *Interaction) error {
+	line, err := json.Marshal(interaction)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.file == nil {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		if !r.replaced {
+			flags |= os.O_TRUNC
+		}
+
+		r.file, err = os.OpenFile(r.path, flags, 0600)
+		if err != nil {
+			return err
+		}
+		r.replaced = true
+	}
+
+	_, err = r.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close flushes the cassette file to disk and closes it, a later interaction opens it again
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.file.Sync()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.file = nil
+
+	return err
+}
@@ -0,0 +1,99 @@
+package cassette
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Placeholder for scrubbed secrets
+const Redacted = "REDACTED"
+
+// Headers carrying credentials or signatures, compared case-insensitively
+var redactedHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Bunq-Client-Authentication",
+	"X-Bunq-Client-Signature",
+	"X-Bunq-Server-Signature",
+}
+
+// Body fields holding api keys, tokens or keys, in json bodies and form encoded OAuth requests
+var redactedFields = map[string]bool{
+	"secret":            true,
+	"token":             true,
+	"api_key":           true,
+	"access_token":      true,
+	"refresh_token":     true,
+	"client_secret":     true,
+	"code":              true,
+	"client_public_key": true,
+	"server_public_key": true,
+}
+
+func redactHeader(header http.Header) http.Header {
+	result := header.Clone()
+	for _, name := range redactedHeaders {
+		if result.Get(name) != "" {
+			result.Set(name, Redacted)
+		}
+	}
+
+	return result
+}
+
+func redactBody(body []byte, contentType string) []byte {
+	if len(body) == 0 {
+		return body
+	}
+
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return body
+		}
+
+		for key := range values {
+			if redactedFields[strings.ToLower(key)] {
+				values.Set(key, Redacted)
+			}
+		}
+
+		return []byte(values.Encode())
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		// Not json, like attachment contents, which are kept as they are
+		return body
+	}
+
+	redacted, err := json.Marshal(redactValue(data))
+	if err != nil {
+		return body
+	}
+
+	return redacted
+}
+
+func redactValue(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for key, item := range typed {
+			if _, isString := item.(string); isString && redactedFields[strings.ToLower(key)] {
+				typed[key] = Redacted
+				continue
+			}
+
+			typed[key] = redactValue(item)
+		}
+	case []interface{}:
+		for i, item := range typed {
+			typed[i] = redactValue(item)
+		}
+	}
+
+	return value
+}
@@ -0,0 +1,54 @@
+// Command bunq-fake serves the fake bunq api from the bunqtest package, point the sync at it with
+// BUNQ_API_BASE_URL=http://<listen address>/v1 and BUNQ_API_KEY set to the api key of the fixtures.
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+
+	"github.com/daanvanberkel/fireflyiiibunq/bunqtest"
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	log := logrus.New()
+	log.Out = os.Stdout
+
+	listenAddress := flag.String("listen", "localhost:8089", "address to listen on")
+	fixturesPath := flag.String("fixtures", "", "json file with fixtures, uses built-in fixtures when empty")
+	flag.Parse()
+
+	fixtures := bunqtest.DefaultFixtures()
+	if *fixturesPath != "" {
+		var err error
+		fixtures, err = bunqtest.LoadFixtures(*fixturesPath)
+		if err != nil {
+			log.WithError(err).Fatal("Cannot load fixtures")
+		}
+	}
+
+	server, err := bunqtest.NewServer(fixtures)
+	if err != nil {
+		log.WithError(err).Fatal("Cannot create fake bunq server")
+	}
+
+	log.WithFields(logrus.Fields{
+		"apiBaseUrl": "http://" + *listenAddress + "/v1",
+		"apiKey":     fixtures.ApiKey,
+	}).Info("Serving fake bunq api")
+
+	if err := http.ListenAndServe(*listenAddress, logRequests(server, log)); err != nil {
+		log.WithError(err).Fatal("Fake bunq server stopped")
+	}
+}
+
+func logRequests(handler http.Handler, log *logrus.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.WithFields(logrus.Fields{
+			"method": r.Method,
+			"path":   r.URL.Path,
+		}).Info("Request received")
+		handler.ServeHTTP(w, r)
+	})
+}
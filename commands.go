@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/daanvanberkel/fireflyiiibunq/bunq"
+	"github.com/daanvanberkel/fireflyiiibunq/firefly"
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+	"github.com/sirupsen/logrus"
+)
+
+// Commands that can be given as first argument, without a command the sync runs
+var commands = map[string]func(arguments []string, log *logrus.Logger) error{
+	"login":       runBunqLogin,
+	"firefly":     runFireflyCommand,
+	"doctor":      runDoctor,
+	"rotate-keys": runRotateKeys,
+	"healthcheck": runHealthcheck,
+	"failed":      runFailedCommand,
+}
+
+// runRotateKeys replaces the bunq keypair and registration. Usage: rotate-keys [--bits size] [profile] or
+// rotate-keys rollback [profile]
+func runRotateKeys(arguments []string, log *logrus.Logger) error {
+	if len(arguments) > 0 && arguments[0] == "rollback" {
+		config, err := loadCommandProfile(arguments[1:], log)
+		if err != nil {
+			return err
+		}
+
+		profileLog := profileLogger(config, log)
+		lock, err := lockProfile(config, "rotate-keys rollback", profileLog)
+		if err != nil {
+			return err
+		}
+		defer releaseLock(config, lock, profileLog)
+
+		return bunq.RollbackKeys(config, profileLog)
+	}
+
+	bitSize := 0
+	if len(arguments) > 0 && arguments[0] == "--bits" {
+		if len(arguments) < 2 {
+			return errors.New("missing bit size, usage: rotate-keys [--bits size] [profile]")
+		}
+
+		var err error
+		bitSize, err = strconv.Atoi(arguments[1])
+		if err != nil || bitSize < 2048 {
+			return errors.New("bit size must be a number of at least 2048")
+		}
+		arguments = arguments[2:]
+	}
+
+	config, err := loadCommandProfile(arguments, log)
+	if err != nil {
+		return err
+	}
+
+	if bitSize == 0 {
+		bitSize = config.BunqConfig.KeyBitSize
+	}
+
+	profileLog := profileLogger(config, log)
+	lock, err := lockProfile(config, "rotate-keys", profileLog)
+	if err != nil {
+		return err
+	}
+	defer releaseLock(config, lock, profileLog)
+
+	return bunq.RotateKeys(config, bitSize, profileLog)
+}
+
+// runDoctor validates the stored bunq registration against the api. Usage: doctor [profile]
+func runDoctor(arguments []string, log *logrus.Logger) error {
+	config, err := loadCommandProfile(arguments, log)
+	if err != nil {
+		return err
+	}
+
+	profileLog := profileLogger(config, log)
+	lock, err := lockProfile(config, "doctor", profileLog)
+	if err != nil {
+		return err
+	}
+	defer releaseLock(config, lock, profileLog)
+
+	failed := false
+	for _, check := range bunq.RunDoctor(config, profileLog) {
+		checkLog := profileLog.WithField("artifact", check.Artifact)
+		if check.Ok {
+			checkLog.Info("OK: " + check.Message)
+		} else {
+			checkLog.Error("FAILED: " + check.Message)
+			failed = true
+		}
+	}
+
+	if failed {
+		return errors.New("doctor found problems with the bunq registration")
+	}
+
+	return nil
+}
+
+// runFireflyCommand runs the firefly sub commands. Usage: firefly login [profile]
+func runFireflyCommand(arguments []string, log *logrus.Logger) error {
+	if len(arguments) == 0 || arguments[0] != "login" {
+		return errors.New("unknown firefly command, usage: firefly login [profile]")
+	}
+
+	config, err := loadCommandProfile(arguments[1:], log)
+	if err != nil {
+		return err
+	}
+
+	profileLog := profileLogger(config, log)
+	lock, err := lockProfile(config, "firefly login", profileLog)
+	if err != nil {
+		return err
+	}
+	defer releaseLock(config, lock, profileLog)
+
+	return firefly.FireflyOAuthLogin(config, profileLog)
+}
+
+// runBunqLogin grants the sync access to bunq through OAuth. Usage: login [profile]
+func runBunqLogin(arguments []string, log *logrus.Logger) error {
+	config, err := loadCommandProfile(arguments, log)
+	if err != nil {
+		return err
+	}
+
+	profileLog := profileLogger(config, log)
+	lock, err := lockProfile(config, "login", profileLog)
+	if err != nil {
+		return err
+	}
+	defer releaseLock(config, lock, profileLog)
+
+	return bunq.BunqOAuthLogin(config, profileLog)
+}
+
+// loadCommandProfile returns the config of the profile given as first argument. The profile can be omitted when
+// only one profile is configured.
+func loadCommandProfile(arguments []string, log *logrus.Logger) (*util.Config, error) {
+	processConfig, err := util.LoadProcessConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(arguments) == 0 {
+		if len(processConfig.Profiles) > 1 {
+			return nil, errors.New("multiple profiles configured, give the name of the profile")
+		}
+
+		warnSharedCredentials(processConfig.Profiles[0], log)
+		return processConfig.Profiles[0], nil
+	}
+
+	for _, config := range processConfig.Profiles {
+		if config.Profile == arguments[0] {
+			warnSharedCredentials(config, log)
+			return config, nil
+		}
+	}
+
+	return nil, errors.New("unknown profile " + arguments[0])
+}
+
+// waitForLock makes commands wait for another process to release the lock of a profile instead of failing, it is
+// set with the --wait flag
+var waitForLock bool
+
+// parseWaitFlag removes the --wait flag from the arguments and sets waitForLock when it is given
+func parseWaitFlag(arguments []string) []string {
+	remaining := []string{}
+	for _, argument := range arguments {
+		if argument == "--wait" {
+			waitForLock = true
+			continue
+		}
+		remaining = append(remaining, argument)
+	}
+
+	return remaining
+}
+
+// lockProfile takes the lock on the storage of the profile, so two processes don't change it at the same time
+func lockProfile(config *util.Config, command string, log *logrus.Entry) (*util.Lock, error) {
+	if err := config.PrepareStorage(); err != nil {
+		return nil, err
+	}
+
+	path := config.StorageLocation + config.SyncConfig.LockFileName
+	lock, err := util.AcquireLock(path, command, waitForLock, log)
+	if err != nil {
+		cleanupStorage(config, log)
+		return nil, err
+	}
+
+	return lock, nil
+}
+
+// releaseLock releases the lock on the storage of the profile and removes the storage when it was temporary
+func releaseLock(config *util.Config, lock *util.Lock, log *logrus.Entry) {
+	if err := lock.Release(); err != nil {
+		log.WithError(err).Warn("Cannot release lock")
+	}
+
+	cleanupStorage(config, log)
+}
+
+func cleanupStorage(config *util.Config, log *logrus.Entry) {
+	if err := config.CleanupStorage(); err != nil {
+		log.WithError(err).WithField("path", config.StorageLocation).Warn("Cannot remove temporary storage")
+	}
+}
+
+// warnSharedCredentials warns when a profile uses the credentials shared by all profiles, because its own prefixed
+// variables are missing, so a typo in a profile name does not silently sync the wrong bunq user or Firefly III
+func warnSharedCredentials(config *util.Config, log *logrus.Logger) {
+	if len(config.SharedCredentials) == 0 {
+		return
+	}
+
+	profileLogger(config, log).WithField("variables", strings.Join(config.SharedCredentials, ", ")).
+		Warn("Profile has no credentials of its own, using the variables shared by all profiles")
+}
+
+func profileLogger(config *util.Config, log *logrus.Logger) *logrus.Entry {
+	if config.Profile == "" {
+		return logrus.NewEntry(log)
+	}
+
+	return log.WithField("profile", config.Profile)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/syncer"
+	"github.com/sirupsen/logrus"
+)
+
+// runFailedCommand manages the payments that failed to import. Usage: failed list [profile],
+// failed retry [profile] or failed drop <payment id>|--all [profile]
+func runFailedCommand(arguments []string, log *logrus.Logger) error {
+	if len(arguments) == 0 {
+		return errors.New("missing failed command, usage: failed list|retry|drop")
+	}
+
+	switch arguments[0] {
+	case "list":
+		return listFailedPayments(arguments[1:], log)
+	case "retry":
+		return retryFailedPayments(arguments[1:], log)
+	case "drop":
+		return dropFailedPayments(arguments[1:], log)
+	}
+
+	return errors.New("unknown failed command " + arguments[0] + ", usage: failed list|retry|drop")
+}
+
+func listFailedPayments(arguments []string, log *logrus.Logger) error {
+	config, err := loadCommandProfile(arguments, log)
+	if err != nil {
+		return err
+	}
+
+	queue, err := syncer.LoadFailedQueue(config)
+	if err != nil {
+		return err
+	}
+
+	payments := queue.Payments()
+	if len(payments) == 0 {
+		fmt.Println("No failed payments")
+		return nil
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "PAYMENT\tIBAN\tAMOUNT\tCOUNTERPARTY\tATTEMPTS\tNEXT ATTEMPT\tERROR")
+	for _, payment := range payments {
+		nextAttempt := payment.NextAttemptAt.Format(time.RFC3339)
+		if queue.GaveUp(payment) {
+			nextAttempt = "gave up"
+		}
+
+		fmt.Fprintf(writer, "%d\t%s\t%s %s\t%s\t%d\t%s\t%s\n",
+			payment.PaymentId, payment.Iban, payment.Amount, payment.Currency, payment.Counterparty, payment.Attempts, nextAttempt, payment.Error)
+	}
+
+	return writer.Flush()
+}
+
+func retryFailedPayments(arguments []string, log *logrus.Logger) error {
+	config, err := loadCommandProfile(arguments, log)
+	if err != nil {
+		return err
+	}
+
+	profileLog := profileLogger(config, log)
+	lock, err := lockProfile(config, "failed retry", profileLog)
+	if err != nil {
+		return err
+	}
+	defer releaseLock(config, lock, profileLog)
+
+	report, err := syncer.RetryFailedPayments(context.Background(), config, profileLog)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(report.Summary()), "\n") {
+		profileLog.Info(strings.TrimSpace(line))
+	}
+
+	if report.Failed() {
+		return errors.New("retried payments failed again")
+	}
+
+	return nil
+}
+
+func dropFailedPayments(arguments []string, log *logrus.Logger) error {
+	if len(arguments) == 0 {
+		return errors.New("missing payment id, usage: failed drop <payment id>|--all [profile]")
+	}
+
+	config, err := loadCommandProfile(arguments[1:], log)
+	if err != nil {
+		return err
+	}
+
+	profileLog := profileLogger(config, log)
+	lock, err := lockProfile(config, "failed drop", profileLog)
+	if err != nil {
+		return err
+	}
+	defer releaseLock(config, lock, profileLog)
+
+	queue, err := syncer.LoadFailedQueue(config)
+	if err != nil {
+		return err
+	}
+
+	if arguments[0] == "--all" {
+		profileLog.WithField("count", queue.DropAll()).Info("Dropped all failed payments")
+		return queue.Save()
+	}
+
+	paymentId, err := strconv.Atoi(arguments[0])
+	if err != nil {
+		return errors.New("payment id must be a number")
+	}
+
+	if !queue.Drop(paymentId) {
+		return errors.New("payment " + arguments[0] + " is not in the failed payments")
+	}
+
+	profileLog.WithField("paymentId", paymentId).Info("Dropped failed payment")
+	return queue.Save()
+}
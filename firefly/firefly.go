@@ -2,42 +2,116 @@ package firefly
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 
+	"github.com/daanvanberkel/fireflyiiibunq/cassette"
+	"github.com/daanvanberkel/fireflyiiibunq/metrics"
+	"github.com/daanvanberkel/fireflyiiibunq/tracing"
 	"github.com/daanvanberkel/fireflyiiibunq/util"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 type FireflyClient struct {
-	client     *http.Client
-	apiBaseUrl string
-	apiKey     string
-	log        *logrus.Logger
+	client        *http.Client
+	profile       string
+	apiBaseUrl    string
+	apiKey        string
+	config        *util.FireflyConfig
+	tokenLocation string
+	token         *FireflyOAuthToken
+	tokenMutex    sync.Mutex
+	readOnly      bool
+	log           *logrus.Entry
 }
 
-func NewFireflyClient(config *util.Config, log *logrus.Logger) (*FireflyClient, error) {
-	return &FireflyClient{
-		client:     &http.Client{},
-		apiBaseUrl: config.FireflyConfig.ApiBaseUrl,
-		apiKey:     config.FireflyConfig.ApiKey,
-		log:        log,
-	}, nil
+func NewFireflyClient(config *util.Config, log *logrus.Entry) (*FireflyClient, error) {
+	return newFireflyClient(config, false, log)
 }
 
-func (c *FireflyClient) SearchAccounts(query string, field AccountField, accountType AccountType, page int) (*AccountsResponse, error) {
+// NewReadOnlyFireflyClient returns a client that uses the stored token as is and never refreshes or stores it, for
+// probes that run next to a sync. It never records to or replays from the cassette of the sync.
+func NewReadOnlyFireflyClient(config *util.Config, log *logrus.Entry) (*FireflyClient, error) {
+	return newFireflyClient(config, true, log)
+}
+
+func newFireflyClient(config *util.Config, readOnly bool, log *logrus.Entry) (*FireflyClient, error) {
+	client := &FireflyClient{
+		client:        &http.Client{},
+		profile:       config.Profile,
+		apiBaseUrl:    config.FireflyConfig.ApiBaseUrl,
+		apiKey:        config.FireflyConfig.ApiKey,
+		config:        config.FireflyConfig,
+		tokenLocation: config.StorageLocation + config.FireflyConfig.OAuthTokenFileName,
+		readOnly:      readOnly,
+		log:           log,
+	}
+
+	// Probes are not part of the sync, their requests are kept out of its cassette
+	var transport http.RoundTripper
+	if !readOnly {
+		var err error
+		transport, err = cassette.Transport(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	client.client.Transport = metrics.Transport("firefly", transport)
+
+	if client.apiKey != "" {
+		if !readOnly {
+			checkPersonalAccessTokenExpiry(client.apiKey, config.FireflyConfig.TokenExpiryWarning, log)
+		}
+		return client, nil
+	}
+
+	token, err := loadFireflyOAuthToken(client.tokenLocation)
+	if err != nil {
+		return nil, err
+	}
+
+	if token == nil {
+		return nil, errors.New("missing firefly api key, set FIREFLY_API_KEY or run the firefly login command")
+	}
+	client.token = token
+
+	return client, nil
+}
+
+// About returns the version of the Firefly III instance, which also checks that it is reachable with the token
+func (c *FireflyClient) About(ctx context.Context) (*About, error) {
+	response, err := c.doFireflyRequest(ctx, "GET", "/v1/about", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var aboutResponse AboutResponse
+	if err := json.Unmarshal(response, &aboutResponse); err != nil {
+		return nil, err
+	}
+
+	return aboutResponse.Data, nil
+}
+
+func (c *FireflyClient) SearchAccounts(ctx context.Context, query string, field AccountField, accountType AccountType, page int) (*AccountsResponse, error) {
 	queryParams := url.Values{
 		"page":  {strconv.Itoa(page)},
 		"query": {query},
 		"type":  {string(accountType)},
 		"field": {string(field)},
 	}
-	response, err := c.doFireflyRequest("GET", "/v1/search/accounts?"+queryParams.Encode(), nil)
+	response, err := c.doFireflyRequest(ctx, "GET", "/v1/search/accounts?"+queryParams.Encode(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -50,8 +124,8 @@ func (c *FireflyClient) SearchAccounts(query string, field AccountField, account
 	return &accounts, nil
 }
 
-func (c *FireflyClient) CreateAccount(account *AccountRequest) (*AccountRead, error) {
-	response, err := c.doFireflyRequest("POST", "/v1/accounts", account)
+func (c *FireflyClient) CreateAccount(ctx context.Context, account *AccountRequest) (*AccountRead, error) {
+	response, err := c.doFireflyRequest(ctx, "POST", "/v1/accounts", account)
 	if err != nil {
 		return nil, err
 	}
@@ -61,11 +135,12 @@ func (c *FireflyClient) CreateAccount(account *AccountRequest) (*AccountRead, er
 		return nil, err
 	}
 
+	metrics.AccountsCreated.WithLabelValues(c.profile, string(account.Type)).Inc()
 	return accountResponse.Data, nil
 }
 
-func (c *FireflyClient) FindOrCreateAssetAccount(iban string, request *AccountRequest) (*AccountRead, error) {
-	accounts, err := c.SearchAccounts(iban, IbanField, AssetType, 1)
+func (c *FireflyClient) FindOrCreateAssetAccount(ctx context.Context, iban string, request *AccountRequest) (*AccountRead, error) {
+	accounts, err := c.SearchAccounts(ctx, iban, IbanField, AssetType, 1)
 	if err != nil {
 		return nil, err
 	}
@@ -78,7 +153,7 @@ func (c *FireflyClient) FindOrCreateAssetAccount(iban string, request *AccountRe
 	}
 
 	// Account not found, try to create new account
-	account, err := c.CreateAccount(request)
+	account, err := c.CreateAccount(ctx, request)
 	if err != nil {
 		return nil, err
 	}
@@ -87,12 +162,12 @@ func (c *FireflyClient) FindOrCreateAssetAccount(iban string, request *AccountRe
 	return account, nil
 }
 
-func (c *FireflyClient) SearchTransactions(query *TransactionSearchQuery, page int) (*TransactionsResponse, error) {
+func (c *FireflyClient) SearchTransactions(ctx context.Context, query *TransactionSearchQuery, page int) (*TransactionsResponse, error) {
 	queryParams := url.Values{
 		"page":  {strconv.Itoa(page)},
 		"query": {query.Encode()},
 	}
-	response, err := c.doFireflyRequest("GET", "/v1/search/transactions?"+queryParams.Encode(), nil)
+	response, err := c.doFireflyRequest(ctx, "GET", "/v1/search/transactions?"+queryParams.Encode(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -105,8 +180,22 @@ func (c *FireflyClient) SearchTransactions(query *TransactionSearchQuery, page i
 	return &result, nil
 }
 
-func (c *FireflyClient) CreateTransaction(transaction *TransactionRequest) (*TransactionResponse, error) {
-	response, err := c.doFireflyRequest("POST", "/v1/transactions", transaction)
+func (c *FireflyClient) CreateTransaction(ctx context.Context, transaction *TransactionRequest) (*TransactionResponse, error) {
+	response, err := c.doFireflyRequest(ctx, "POST", "/v1/transactions", transaction)
+	if err != nil {
+		return nil, err
+	}
+
+	var transactionResponse TransactionResponse
+	if err := json.Unmarshal(response, &transactionResponse); err != nil {
+		return nil, err
+	}
+
+	return &transactionResponse, nil
+}
+
+func (c *FireflyClient) UpdateTransaction(ctx context.Context, id string, transaction *TransactionUpdateRequest) (*TransactionResponse, error) {
+	response, err := c.doFireflyRequest(ctx, "PUT", "/v1/transactions/"+url.PathEscape(id), transaction)
 	if err != nil {
 		return nil, err
 	}
@@ -119,33 +208,118 @@ func (c *FireflyClient) CreateTransaction(transaction *TransactionRequest) (*Tra
 	return &transactionResponse, nil
 }
 
-func (c *FireflyClient) doFireflyRequest(method string, path string, data interface{}) ([]byte, error) {
+func (c *FireflyClient) DeleteTransaction(ctx context.Context, id string) error {
+	_, err := c.doFireflyRequest(ctx, "DELETE", "/v1/transactions/"+url.PathEscape(id), nil)
+	return err
+}
+
+// GetTransactionAttachments returns the attachments of all pages
+func (c *FireflyClient) GetTransactionAttachments(ctx context.Context, id string) ([]*AttachmentRead, error) {
+	result := []*AttachmentRead{}
+	for page := 1; ; page++ {
+		response, err := c.doFireflyRequest(ctx, "GET", "/v1/transactions/"+url.PathEscape(id)+"/attachments?page="+strconv.Itoa(page), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var attachments AttachmentsResponse
+		if err := json.Unmarshal(response, &attachments); err != nil {
+			return nil, err
+		}
+		result = append(result, attachments.Data...)
+
+		if attachments.Meta == nil || attachments.Meta.Pagination == nil || page >= attachments.Meta.Pagination.TotalPages {
+			return result, nil
+		}
+	}
+}
+
+func (c *FireflyClient) CreateAttachment(ctx context.Context, attachment *AttachmentRequest) (*AttachmentRead, error) {
+	response, err := c.doFireflyRequest(ctx, "POST", "/v1/attachments", attachment)
+	if err != nil {
+		return nil, err
+	}
+
+	var attachmentResponse AttachmentResponse
+	if err := json.Unmarshal(response, &attachmentResponse); err != nil {
+		return nil, err
+	}
+
+	return attachmentResponse.Data, nil
+}
+
+func (c *FireflyClient) UploadAttachment(ctx context.Context, id string, content []byte) error {
+	_, err := c.doFireflyRawRequest(ctx, "POST", "/v1/attachments/"+url.PathEscape(id)+"/upload", content, "application/octet-stream")
+	return err
+}
+
+func (c *FireflyClient) doFireflyRequest(ctx context.Context, method string, path string, data interface{}) ([]byte, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		c.log.WithError(err).WithFields(logrus.Fields{
+			"method": method,
+			"path":   path,
+		}).Error("Cannot marshal request body")
+		return nil, err
+	}
+
+	return c.doFireflyRawRequest(ctx, method, path, body, "application/json")
+}
+
+func (c *FireflyClient) doFireflyRawRequest(ctx context.Context, method string, path string, body []byte, contentType string) ([]byte, error) {
+	return c.doActualFireflyRequest(ctx, method, path, body, contentType, 1)
+}
+
+func (c *FireflyClient) doActualFireflyRequest(ctx context.Context, method string, path string, body []byte, contentType string, try int) (responseBody []byte, err error) {
 	requestId := uuid.New()
 	log := c.log.WithFields(logrus.Fields{
 		"method":    method,
 		"path":      path,
 		"requestId": requestId.String(),
+		"try":       try,
 	})
 
-	body, err := json.Marshal(data)
+	parentCtx := ctx
+	endpoint, _, _ := strings.Cut(path, "?")
+	ctx, span := tracing.Start(ctx, "firefly "+method+" "+metrics.Endpoint(endpoint),
+		attribute.String("http.request.method", method),
+		attribute.String("url.template", metrics.Endpoint(endpoint)),
+		attribute.Int("firefly.try", try),
+	)
+	// A retry ends the span of this try before it starts its own
+	spanEnded := false
+	defer func() {
+		if !spanEnded {
+			tracing.End(span, err)
+		}
+	}()
+
+	// Firefly III logs the trace id, so its logs can be found with the trace of the sync
+	traceId := tracing.TraceId(ctx)
+	if traceId == "" {
+		traceId = requestId.String()
+	}
+
+	accessToken, err := c.getAccessToken()
 	if err != nil {
-		log.WithError(err).Error("Cannot marshal request body")
+		log.WithError(err).Error("Cannot get firefly access token")
 		return nil, err
 	}
 
 	url := c.apiBaseUrl + path
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(body))
 	if err != nil {
 		log.WithError(err).Error("Cannot create new request")
 		return nil, err
 	}
 
 	if len(body) > 0 {
-		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Type", contentType)
 	}
-	req.Header.Set("Authorization", "Bearer "+c.apiKey)
-	req.Header.Set("X-Trace-Id", requestId.String())
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("X-Trace-Id", traceId)
 	req.Header.Set("Accept", "application/json")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 
 	log.Debug("Send firefly request")
 	resp, err := c.client.Do(req)
@@ -161,11 +335,24 @@ func (c *FireflyClient) doFireflyRequest(method string, path string, data interf
 		return nil, err
 	}
 
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
 	log.WithFields(logrus.Fields{
 		"statusCode": resp.StatusCode,
 		"bodyLength": len(respBody),
 	}).Info("Response received from firefly")
 
+	// Clients without api key use an OAuth token
+	if resp.StatusCode == 401 && c.apiKey == "" && !c.readOnly && try == 1 {
+		log.Info("Received 401 from firefly, possible token expiry. Refresh token and retry request")
+		if err := c.refreshRejectedToken(accessToken); err != nil {
+			return nil, err
+		}
+
+		span.End()
+		spanEnded = true
+		return c.doActualFireflyRequest(parentCtx, method, path, body, contentType, try+1)
+	}
+
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		log.WithField("body", string(respBody)).Warn("Received error from firefly")
 		return nil, errors.New(string(respBody))
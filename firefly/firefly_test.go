@@ -0,0 +1,324 @@
+package firefly_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/firefly"
+	"github.com/daanvanberkel/fireflyiiibunq/fireflytest"
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTestClient(t *testing.T) (*firefly.FireflyClient, *fireflytest.Server) {
+	t.Helper()
+
+	server := fireflytest.Start("test-token")
+	t.Cleanup(server.Close)
+
+	log := logrus.New()
+	log.Out = io.Discard
+
+	client, err := firefly.NewFireflyClient(&util.Config{
+		StorageLocation: t.TempDir() + "/",
+		FireflyConfig: &util.FireflyConfig{
+			ApiBaseUrl: server.URL,
+			ApiKey:     "test-token",
+		},
+	}, logrus.NewEntry(log))
+	if err != nil {
+		t.Fatalf("cannot create firefly client: %v", err)
+	}
+
+	return client, server
+}
+
+func TestAbout(t *testing.T) {
+	client, _ := newTestClient(t)
+
+	about, err := client.About(context.Background())
+	if err != nil {
+		t.Fatalf("cannot get about: %v", err)
+	}
+
+	if about.Version == "" {
+		t.Errorf("expected the Firefly III version")
+	}
+}
+
+func TestFindOrCreateAssetAccountReusesAccount(t *testing.T) {
+	client, server := newTestClient(t)
+
+	request := &firefly.AccountRequest{
+		Name:        "Main",
+		Type:        firefly.AssetType,
+		Iban:        "NL00BUNQ0000000001",
+		AccountRole: firefly.DefaultAsset,
+	}
+
+	first, err := client.FindOrCreateAssetAccount(context.Background(), request.Iban, request)
+	if err != nil {
+		t.Fatalf("cannot create account: %v", err)
+	}
+
+	second, err := client.FindOrCreateAssetAccount(context.Background(), request.Iban, request)
+	if err != nil {
+		t.Fatalf("cannot find account: %v", err)
+	}
+
+	if first.Id != second.Id || len(server.Accounts(firefly.AssetType)) != 1 {
+		t.Errorf("expected the existing account to be reused")
+	}
+}
+
+func TestSearchTransactionsByExternalIdAndAccount(t *testing.T) {
+	client, server := newTestClient(t)
+
+	asset := server.AddAccount(&firefly.AccountRequest{Name: "Main", Type: firefly.AssetType, Iban: "NL00BUNQ0000000001", AccountRole: firefly.DefaultAsset})
+	otherAsset := server.AddAccount(&firefly.AccountRequest{Name: "Other", Type: firefly.AssetType, Iban: "NL00BUNQ0000000002", AccountRole: firefly.DefaultAsset})
+	expense := server.AddAccount(&firefly.AccountRequest{Name: "Shop", Type: firefly.ExpenseType})
+
+	date := time.Now()
+	for _, sourceId := range []string{asset.Id, otherAsset.Id} {
+		_, err := client.CreateTransaction(context.Background(), &firefly.TransactionRequest{
+			Transactions: []*firefly.TransactionSplitRequest{{
+				Type:          firefly.WithdrawalTransaction,
+				Date:          &date,
+				Amount:        "10.00",
+				Description:   "Groceries",
+				SourceId:      sourceId,
+				DestinationId: expense.Id,
+				ExternalId:    "5001",
+			}},
+		})
+		if err != nil {
+			t.Fatalf("cannot create transaction: %v", err)
+		}
+	}
+
+	result, err := client.SearchTransactions(context.Background(), &firefly.TransactionSearchQuery{ExternalIdIs: "5001", AccountNrIs: "NL00BUNQ0000000002"}, 1)
+	if err != nil {
+		t.Fatalf("cannot search transactions: %v", err)
+	}
+
+	if result.Meta.Pagination.Total != 1 || result.Data[0].Attributes.Transactions[0].SourceId != otherAsset.Id {
+		t.Errorf("expected only the transaction of the other account, got %d results", result.Meta.Pagination.Total)
+	}
+}
+
+func TestTransactionSplitDecodesAccounts(t *testing.T) {
+	var split firefly.TransactionSplit
+	if err := json.Unmarshal([]byte(`{"source_id":"1","destination_id":"2"}`), &split); err != nil {
+		t.Fatal(err)
+	}
+
+	if split.SourceId != "1" || split.DestinationId != "2" {
+		t.Errorf("expected source 1 and destination 2, got %q and %q", split.SourceId, split.DestinationId)
+	}
+}
+
+func TestTransactionSearchQueryEncode(t *testing.T) {
+	date := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		query    *firefly.TransactionSearchQuery
+		expected string
+	}{
+		{&firefly.TransactionSearchQuery{ExternalIdIs: "5001", AccountNrIs: "NL00BUNQ0000000001"}, "external_id_is:5001 account_nr_is:NL00BUNQ0000000001"},
+		{&firefly.TransactionSearchQuery{ExternalIdIs: "5001"}, "external_id_is:5001"},
+		{&firefly.TransactionSearchQuery{AccountNrIs: "NL00BUNQ0000000002", TypeIs: firefly.TransferTransaction, AmountIs: "50.00", DateOn: &date}, "account_nr_is:NL00BUNQ0000000002 type:transfer amount_is:50.00 date_on:2024-03-01"},
+	}
+
+	for _, test := range tests {
+		if actual := test.query.Encode(); actual != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, actual)
+		}
+	}
+}
+
+func TestCreateTransactionRejectsDuplicateHash(t *testing.T) {
+	client, server := newTestClient(t)
+
+	asset := server.AddAccount(&firefly.AccountRequest{Name: "Main", Type: firefly.AssetType, AccountRole: firefly.DefaultAsset})
+	savings := server.AddAccount(&firefly.AccountRequest{Name: "Savings", Type: firefly.AssetType, AccountRole: firefly.SavingAsset})
+
+	date := time.Now()
+	request := &firefly.TransactionRequest{
+		Transactions: []*firefly.TransactionSplitRequest{{
+			Type:          firefly.TransferTransaction,
+			Date:          &date,
+			Amount:        "100.00",
+			Description:   "To savings",
+			SourceId:      asset.Id,
+			DestinationId: savings.Id,
+		}},
+		ErrorIfDuplicateHash: true,
+	}
+
+	if _, err := client.CreateTransaction(context.Background(), request); err != nil {
+		t.Fatalf("cannot create transaction: %v", err)
+	}
+
+	if _, err := client.CreateTransaction(context.Background(), request); err == nil {
+		t.Errorf("expected duplicate transaction to be rejected")
+	}
+
+	if len(server.Transactions()) != 1 {
+		t.Errorf("expected 1 transaction, got %d", len(server.Transactions()))
+	}
+}
+
+// newOAuthTestConfig stores an OAuth token whose access token the server rejects, so the client has to refresh it
+func newOAuthTestConfig(t *testing.T, server *fireflytest.Server) *util.Config {
+	t.Helper()
+
+	server.SetRefreshToken("refresh-0")
+
+	config := &util.Config{
+		StorageLocation: t.TempDir() + "/",
+		FireflyConfig: &util.FireflyConfig{
+			ApiBaseUrl:         server.URL,
+			OAuthBaseUrl:       strings.TrimSuffix(server.URL, "/api"),
+			OAuthClientId:      "client",
+			OAuthClientSecret:  "secret",
+			OAuthTokenFileName: "firefly_oauth_token.json",
+		},
+	}
+
+	token := &firefly.FireflyOAuthToken{TokenType: "Bearer", AccessToken: "revoked", RefreshToken: "refresh-0", ExpiresAt: time.Now().Add(time.Hour)}
+	if err := util.WriteStateFile(config.StorageLocation+config.FireflyConfig.OAuthTokenFileName, token); err != nil {
+		t.Fatal(err)
+	}
+
+	return config
+}
+
+func TestReadOnlyClientDoesNotRefreshToken(t *testing.T) {
+	server := fireflytest.Start("valid")
+	t.Cleanup(server.Close)
+
+	log := logrus.New()
+	log.Out = io.Discard
+
+	config := newOAuthTestConfig(t, server)
+	client, err := firefly.NewReadOnlyFireflyClient(config, logrus.NewEntry(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.About(context.Background()); err == nil {
+		t.Error("expected the rejected token to fail")
+	}
+
+	if server.Refreshes() != 0 {
+		t.Errorf("expected the read-only client not to refresh the token, got %d refreshes", server.Refreshes())
+	}
+}
+
+func TestReadOnlyClientIsNotRecorded(t *testing.T) {
+	server := fireflytest.Start("test-token")
+	t.Cleanup(server.Close)
+
+	log := logrus.New()
+	log.Out = io.Discard
+
+	location := t.TempDir() + "/cassette.json"
+	client, err := firefly.NewReadOnlyFireflyClient(&util.Config{
+		StorageLocation: t.TempDir() + "/",
+		FireflyConfig:   &util.FireflyConfig{ApiBaseUrl: server.URL, ApiKey: "test-token"},
+		CassetteConfig:  &util.CassetteConfig{Mode: util.CassetteRecord, Location: location},
+	}, logrus.NewEntry(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.About(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(location); !os.IsNotExist(err) {
+		t.Errorf("expected the probe not to be recorded in the cassette, got %v", err)
+	}
+}
+
+func TestRejectedTokenIsRefreshedOnce(t *testing.T) {
+	server := fireflytest.Start("valid")
+	t.Cleanup(server.Close)
+
+	log := logrus.New()
+	log.Out = io.Discard
+
+	client, err := firefly.NewFireflyClient(newOAuthTestConfig(t, server), logrus.NewEntry(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Parallel requests that are all rejected refresh the token once, a second refresh would use a revoked token
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = client.About(context.Background())
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("expected the request to succeed after the refresh, got %v", err)
+		}
+	}
+
+	if server.Refreshes() != 1 {
+		t.Errorf("expected one refresh, got %d", server.Refreshes())
+	}
+}
+
+func TestRetriedRequestSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	server := fireflytest.Start("valid")
+	t.Cleanup(server.Close)
+
+	log := logrus.New()
+	log.Out = io.Discard
+
+	client, err := firefly.NewFireflyClient(newOAuthTestConfig(t, server), logrus.NewEntry(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.SearchAccounts(context.Background(), "NL11BUNQ0123456789", firefly.IbanField, firefly.AssetType, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rejected try and its retry each have a span, ended once, that does not hold the query
+	spans := recorder.Ended()
+	if len(spans) != 2 || len(recorder.Started()) != 2 {
+		t.Fatalf("expected 2 started and ended spans, got %d started and %d ended", len(recorder.Started()), len(spans))
+	}
+	for i, span := range spans {
+		for _, attribute := range span.Attributes() {
+			if strings.Contains(attribute.Value.Emit(), "NL11BUNQ0123456789") {
+				t.Errorf("expected span %d not to hold the query, got %s=%s", i, attribute.Key, attribute.Value.Emit())
+			}
+			if attribute.Key == "url.template" && attribute.Value.AsString() != "/v1/search/accounts" {
+				t.Errorf("expected span %d to have the endpoint, got %s", i, attribute.Value.AsString())
+			}
+		}
+	}
+}
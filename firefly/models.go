@@ -19,6 +19,18 @@ type Pagination struct {
 	TotalPages  int `json:"total_pages"`
 }
 
+type About struct {
+	Version    string `json:"version"`
+	ApiVersion string `json:"api_version"`
+	PhpVersion string `json:"php_version"`
+	Os         string `json:"os"`
+	Driver     string `json:"driver"`
+}
+
+type AboutResponse struct {
+	Data *About `json:"data"`
+}
+
 // FIREFLY ACCOUNT MODELS
 
 type AccountField string
@@ -116,6 +128,7 @@ type AccountRequest struct {
 	OpeningBalance     string      `json:"opening_balance"`
 	OpeningBalanceDate *time.Time  `json:"opening_balance_date"`
 	AccountRole        AccountRole `json:"account_role"`
+	CurrencyCode       string      `json:"currency_code,omitempty"`
 	Notes              string      `json:"notes"`
 }
 
@@ -124,6 +137,10 @@ type AccountRequest struct {
 type TransactionSearchQuery struct {
 	ExternalIdIs string
 	AccountNrIs  string
+	TagIs        string
+	TypeIs       TransactionType
+	AmountIs     string
+	DateOn       *time.Time
 }
 
 func (q *TransactionSearchQuery) Encode() string {
@@ -133,10 +150,26 @@ func (q *TransactionSearchQuery) Encode() string {
 		result += " external_id_is:" + q.ExternalIdIs
 	}
 
-	if q.ExternalIdIs != "" {
+	if q.AccountNrIs != "" {
 		result += " account_nr_is:" + q.AccountNrIs
 	}
 
+	if q.TagIs != "" {
+		result += " tag_is:" + q.TagIs
+	}
+
+	if q.TypeIs != "" {
+		result += " type:" + string(q.TypeIs)
+	}
+
+	if q.AmountIs != "" {
+		result += " amount_is:" + q.AmountIs
+	}
+
+	if q.DateOn != nil {
+		result += " date_on:" + q.DateOn.Format("2006-01-02")
+	}
+
 	return strings.Trim(result, " ")
 }
 
@@ -154,15 +187,21 @@ type TransactionSplit struct {
 	Type                 TransactionType `json:"type"`
 	Date                 *time.Time      `json:"date"`
 	Amount               string          `json:"amount"`
+	CurrencyCode         string          `json:"currency_code"`
+	ForeignAmount        string          `json:"foreign_amount"`
+	ForeignCurrencyCode  string          `json:"foreign_currency_code"`
 	Description          string          `json:"description"`
 	SourceId             string          `json:"source_id"`
 	SourceName           string          `json:"source_name"`
 	SourceIban           string          `json:"source_iban"`
-	DestinationId        string          `json:"destionation_id"`
+	DestinationId        string          `json:"destination_id"`
 	DestinationName      string          `json:"destination_name"`
 	DestinationIban      string          `json:"destination_iban"`
 	Notes                string          `json:"notes"`
 	ExternalId           string          `json:"external_id"`
+	InternalReference    string          `json:"internal_reference"`
+	SepaCtId             string          `json:"sepa_ct_id"`
+	Tags                 []string        `json:"tags"`
 }
 
 type Transaction struct {
@@ -189,18 +228,89 @@ type TransactionResponse struct {
 }
 
 type TransactionSplitRequest struct {
-	Type          TransactionType `json:"type"`
-	Date          *time.Time      `json:"date"`
-	Amount        string          `json:"amount"`
-	Description   string          `json:"description"`
-	CurrencyCode  string          `json:"currency_code"`
-	SourceId      string          `json:"source_id"`
-	DestinationId string          `json:"destination_id"`
-	Notes         string          `json:"notes"`
-	ExternalId    string          `json:"external_id"`
+	Type                TransactionType `json:"type"`
+	Date                *time.Time      `json:"date"`
+	Amount              string          `json:"amount"`
+	Description         string          `json:"description"`
+	CurrencyCode        string          `json:"currency_code"`
+	ForeignAmount       string          `json:"foreign_amount,omitempty"`
+	ForeignCurrencyCode string          `json:"foreign_currency_code,omitempty"`
+	SourceId            string          `json:"source_id"`
+	DestinationId       string          `json:"destination_id"`
+	Notes               string          `json:"notes"`
+	ExternalId          string          `json:"external_id"`
+	InternalReference   string          `json:"internal_reference,omitempty"`
+	SepaCountry         string          `json:"sepa_country,omitempty"`
+	SepaBatchId         string          `json:"sepa_batch_id,omitempty"`
+	SepaCtId            string          `json:"sepa_ct_id,omitempty"`
+	Latitude            *float64        `json:"latitude,omitempty"`
+	Longitude           *float64        `json:"longitude,omitempty"`
+	ZoomLevel           *int            `json:"zoom_level,omitempty"`
+	Tags                []string        `json:"tags,omitempty"`
 }
 
 type TransactionRequest struct {
 	Transactions         []*TransactionSplitRequest `json:"transactions"`
 	ErrorIfDuplicateHash bool                       `json:"error_if_duplicate_hash"`
 }
+
+type TransactionSplitUpdateRequest struct {
+	TransactionJournalId string     `json:"transaction_journal_id"`
+	Date                 *time.Time `json:"date,omitempty"`
+	Amount               string     `json:"amount,omitempty"`
+	ForeignAmount        string     `json:"foreign_amount,omitempty"`
+	Description          string     `json:"description,omitempty"`
+	ExternalId           string     `json:"external_id,omitempty"`
+	Notes                string     `json:"notes,omitempty"`
+	Tags                 []string   `json:"tags"`
+}
+
+type TransactionUpdateRequest struct {
+	Transactions []*TransactionSplitUpdateRequest `json:"transactions"`
+}
+
+// FIREFLY ATTACHMENT MODELS
+
+type AttachableType string
+
+const (
+	TransactionJournalAttachable AttachableType = "TransactionJournal"
+)
+
+type Attachment struct {
+	CreatedAt      *time.Time     `json:"created_at"`
+	UpdatedAt      *time.Time     `json:"updated_at"`
+	AttachableType AttachableType `json:"attachable_type"`
+	AttachableId   string         `json:"attachable_id"`
+	Md5            string         `json:"md5"`
+	Filename       string         `json:"filename"`
+	DownloadUrl    string         `json:"download_url"`
+	UploadUrl      string         `json:"upload_url"`
+	Title          string         `json:"title"`
+	Notes          string         `json:"notes"`
+	Mime           string         `json:"mime"`
+	Size           int            `json:"size"`
+}
+
+type AttachmentRead struct {
+	Type       string      `json:"type"`
+	Id         string      `json:"id"`
+	Attributes *Attachment `json:"attributes"`
+}
+
+type AttachmentsResponse struct {
+	Data []*AttachmentRead `json:"data"`
+	Meta *ResponseMeta     `json:"meta"`
+}
+
+type AttachmentResponse struct {
+	Data *AttachmentRead `json:"data"`
+}
+
+type AttachmentRequest struct {
+	Filename       string         `json:"filename"`
+	AttachableType AttachableType `json:"attachable_type"`
+	AttachableId   string         `json:"attachable_id"`
+	Title          string         `json:"title"`
+	Notes          string         `json:"notes"`
+}
@@ -0,0 +1,213 @@
+package firefly
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+	"github.com/sirupsen/logrus"
+)
+
+// Time the user has to authorise the application in the browser
+const oauthLoginTimeout = 10 * time.Minute
+
+// Access tokens are refreshed this long before they expire
+const oauthRefreshMargin = time.Minute
+
+type FireflyOAuthToken struct {
+	TokenType    string    `json:"token_type"`
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresIn    int       `json:"expires_in"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// FireflyOAuthLogin runs the OAuth authorisation code flow against firefly and stores the tokens, which are refreshed
+// automatically afterwards.
+func FireflyOAuthLogin(config *util.Config, log *logrus.Entry) error {
+	if config.FireflyConfig.OAuthClientId == "" || config.FireflyConfig.OAuthClientSecret == "" {
+		return errors.New("missing firefly oauth client id or client secret in env")
+	}
+
+	state, err := util.NewOAuthState()
+	if err != nil {
+		return err
+	}
+
+	authorizeUrl := config.FireflyConfig.OAuthBaseUrl + "/oauth/authorize?" + url.Values{
+		"response_type": {"code"},
+		"client_id":     {config.FireflyConfig.OAuthClientId},
+		"redirect_uri":  {config.FireflyConfig.OAuthRedirectUrl},
+		"scope":         {""},
+		"state":         {state},
+	}.Encode()
+	log.WithField("url", authorizeUrl).Info("Open the url in your browser to grant access to firefly")
+
+	code, err := util.WaitForOAuthCallback(config.FireflyConfig.OAuthRedirectUrl, state, oauthLoginTimeout)
+	if err != nil {
+		return err
+	}
+
+	token, err := requestFireflyOAuthToken(config.FireflyConfig, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {config.FireflyConfig.OAuthRedirectUrl},
+	})
+	if err != nil {
+		log.WithError(err).Error("Cannot exchange authorisation code for firefly token")
+		return err
+	}
+
+	if err := writeFireflyOAuthToken(config.StorageLocation+config.FireflyConfig.OAuthTokenFileName, token); err != nil {
+		return err
+	}
+
+	log.WithField("expiresAt", token.ExpiresAt).Info("Stored firefly token")
+	return nil
+}
+
+// getAccessToken returns the token for the authorization header, refreshing the OAuth token when it is about to expire
+func (c *FireflyClient) getAccessToken() (string, error) {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+
+	if c.token == nil {
+		return c.apiKey, nil
+	}
+
+	if c.readOnly || time.Now().Add(oauthRefreshMargin).Before(c.token.ExpiresAt) {
+		return c.token.AccessToken, nil
+	}
+
+	return c.refreshToken()
+}
+
+// refreshRejectedToken refreshes the OAuth token after firefly rejected the given access token. When another request
+// already refreshed it, the new token is kept, refreshing again would revoke the refresh token that was just rotated.
+func (c *FireflyClient) refreshRejectedToken(rejectedToken string) error {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+
+	if c.token.AccessToken != rejectedToken {
+		c.log.Debug("Firefly token already refreshed by another request")
+		return nil
+	}
+
+	_, err := c.refreshToken()
+	return err
+}
+
+// refreshToken replaces the OAuth token with a new one, the caller holds tokenMutex
+func (c *FireflyClient) refreshToken() (string, error) {
+	if c.token.RefreshToken == "" {
+		return "", errors.New("firefly token expired and cannot be refreshed, run the firefly login command")
+	}
+
+	c.log.Debug("Refresh firefly token")
+	token, err := requestFireflyOAuthToken(c.config, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {c.token.RefreshToken},
+	})
+	if err != nil {
+		c.log.WithError(err).Error("Cannot refresh firefly token")
+		return "", err
+	}
+
+	if err := writeFireflyOAuthToken(c.tokenLocation, token); err != nil {
+		c.log.WithError(err).Error("Cannot store refreshed firefly token")
+		return "", err
+	}
+	c.token = token
+
+	return token.AccessToken, nil
+}
+
+func requestFireflyOAuthToken(config *util.FireflyConfig, values url.Values) (*FireflyOAuthToken, error) {
+	values.Set("client_id", config.OAuthClientId)
+	values.Set("client_secret", config.OAuthClientSecret)
+
+	resp, err := http.PostForm(config.OAuthBaseUrl+"/oauth/token", values)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, errors.New(string(body))
+	}
+
+	var token FireflyOAuthToken
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, err
+	}
+
+	if token.AccessToken == "" {
+		return nil, errors.New("firefly did not return an access token")
+	}
+	token.ExpiresAt = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+
+	return &token, nil
+}
+
+func loadFireflyOAuthToken(tokenLocation string) (*FireflyOAuthToken, error) {
+	var token FireflyOAuthToken
+	if err := util.ReadStateFile(tokenLocation, &token); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+func writeFireflyOAuthToken(tokenLocation string, token *FireflyOAuthToken) error {
+	return util.WriteStateFile(tokenLocation, token)
+}
+
+// checkPersonalAccessTokenExpiry warns when the personal access token, a JWT, expires soon. Personal access tokens
+// cannot be refreshed, a new one has to be created in firefly.
+func checkPersonalAccessTokenExpiry(apiKey string, warning time.Duration, log *logrus.Entry) {
+	parts := strings.Split(apiKey, ".")
+	if len(parts) != 3 {
+		log.Debug("Firefly api key is not a JWT, cannot check expiry")
+		return
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		log.WithError(err).Debug("Cannot decode firefly api key")
+		return
+	}
+
+	var claims struct {
+		ExpiresAt float64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.ExpiresAt == 0 {
+		log.Debug("Firefly api key has no expiry")
+		return
+	}
+
+	expiresAt := time.Unix(int64(claims.ExpiresAt), 0)
+	expiryLog := log.WithField("expiresAt", expiresAt.Format(time.RFC3339))
+	if expiresAt.Before(time.Now()) {
+		expiryLog.Error("Firefly personal access token is expired, create a new one or use the firefly login command")
+		return
+	}
+
+	if time.Until(expiresAt) < warning {
+		expiryLog.Warn("Firefly personal access token expires soon, create a new one or use the firefly login command")
+	}
+}
@@ -0,0 +1,867 @@
+// Package fireflytest provides an in-memory fake of the Firefly III api for tests. It implements the account and
+// transaction endpoints used by the sync, including the search query semantics and duplicate hash rejection.
+package fireflytest
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/firefly"
+)
+
+// Number of items in a page of a list endpoint
+const pageSize = 50
+
+// Request is a request received by the fake server
+type Request struct {
+	Method  string
+	Path    string
+	Query   string
+	TraceId string
+}
+
+type transaction struct {
+	read *firefly.TransactionRead
+	hash string
+}
+
+type attachment struct {
+	read    *firefly.AttachmentRead
+	content []byte
+}
+
+type Server struct {
+	// URL is the api base url including /api, only set when started with Start
+	URL string
+
+	accessToken string
+	mux         *http.ServeMux
+	httpServer  *httptest.Server
+
+	mutex        sync.Mutex
+	nextId       int
+	accounts     []*firefly.AccountRead
+	transactions []*transaction
+	attachments  []*attachment
+	requests     []*Request
+	// Number of transaction creations still to fail
+	failTransactions int
+	// OAuth refresh token that is accepted once, every refresh rotates it and the access token
+	refreshToken string
+	refreshes    int
+}
+
+// NewServer creates an empty fake Firefly III server. Requests must use the access token as bearer token, any token is
+// accepted when it is empty.
+func NewServer(accessToken string) *Server {
+	s := &Server{
+		accessToken: accessToken,
+		nextId:      1,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/about", s.handleAbout)
+	mux.HandleFunc("GET /api/v1/search/accounts", s.handleSearchAccounts)
+	mux.HandleFunc("POST /api/v1/accounts", s.handleCreateAccount)
+	mux.HandleFunc("GET /api/v1/search/transactions", s.handleSearchTransactions)
+	mux.HandleFunc("POST /api/v1/transactions", s.handleCreateTransaction)
+	mux.HandleFunc("PUT /api/v1/transactions/{id}", s.handleUpdateTransaction)
+	mux.HandleFunc("DELETE /api/v1/transactions/{id}", s.handleDeleteTransaction)
+	mux.HandleFunc("GET /api/v1/transactions/{id}/attachments", s.handleTransactionAttachments)
+	mux.HandleFunc("POST /api/v1/attachments", s.handleCreateAttachment)
+	mux.HandleFunc("POST /api/v1/attachments/{id}/upload", s.handleUploadAttachment)
+	mux.HandleFunc("POST /oauth/token", s.handleOAuthToken)
+	s.mux = mux
+
+	return s
+}
+
+// Start creates an empty fake Firefly III server and serves it on a random local port until Close is called
+func Start(accessToken string) *Server {
+	s := NewServer(accessToken)
+	s.httpServer = httptest.NewServer(s)
+	s.URL = s.httpServer.URL + "/api"
+
+	return s
+}
+
+func (s *Server) Close() {
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	s.requests = append(s.requests, &Request{Method: r.Method, Path: r.URL.Path, Query: r.URL.Query().Get("query"), TraceId: r.Header.Get("X-Trace-Id")})
+	s.mutex.Unlock()
+
+	s.mutex.Lock()
+	authorized := s.accessToken == "" || r.Header.Get("Authorization") == "Bearer "+s.accessToken
+	s.mutex.Unlock()
+
+	if !authorized && r.URL.Path != "/oauth/token" {
+		writeJson(w, http.StatusUnauthorized, map[string]string{"message": "Unauthenticated."})
+		return
+	}
+
+	s.mux.ServeHTTP(w, r)
+}
+
+// INSPECTION
+
+// FailTransactions makes the server answer the next count transaction creations with 500 Internal Server Error
+func (s *Server) FailTransactions(count int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.failTransactions = count
+}
+
+// SetRefreshToken enables the OAuth token endpoint, which accepts the refresh token once and answers with a new
+// access and refresh token, like Passport revokes a refresh token when it is used
+func (s *Server) SetRefreshToken(refreshToken string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.refreshToken = refreshToken
+}
+
+// Refreshes returns how often a token was refreshed
+func (s *Server) Refreshes() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.refreshes
+}
+
+// AddAccount creates an account directly, for example an asset account that exists before the sync runs
+func (s *Server) AddAccount(request *firefly.AccountRequest) *firefly.AccountRead {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.createAccount(request)
+}
+
+// Accounts returns all accounts of the type, or all accounts for firefly.AllTypes
+func (s *Server) Accounts(accountType firefly.AccountType) []*firefly.AccountRead {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result := []*firefly.AccountRead{}
+	for _, account := range s.accounts {
+		if accountType == firefly.AllTypes || account.Attributes.Type == accountType {
+			result = append(result, account)
+		}
+	}
+
+	return result
+}
+
+// Transactions returns all transactions in the order they were created
+func (s *Server) Transactions() []*firefly.TransactionRead {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result := make([]*firefly.TransactionRead, len(s.transactions))
+	for i, item := range s.transactions {
+		result[i] = item.read
+	}
+
+	return result
+}
+
+// TransactionByExternalId returns the split with the external id, or nil when there is none
+func (s *Server) TransactionByExternalId(externalId string) *firefly.TransactionSplit {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, item := range s.transactions {
+		for _, split := range item.read.Attributes.Transactions {
+			if split.ExternalId == externalId {
+				return split
+			}
+		}
+	}
+
+	return nil
+}
+
+// AttachmentContents returns the uploaded content of the attachments of a transaction journal by file name
+func (s *Server) AttachmentContents(journalId string) map[string][]byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result := map[string][]byte{}
+	for _, item := range s.attachments {
+		if item.read.Attributes.AttachableId == journalId && item.content != nil {
+			result[item.read.Attributes.Filename] = item.content
+		}
+	}
+
+	return result
+}
+
+// Requests returns all requests received so far
+func (s *Server) Requests() []*Request {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]*Request{}, s.requests...)
+}
+
+// ABOUT HANDLERS
+
+func (s *Server) handleAbout(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, &firefly.AboutResponse{Data: &firefly.About{
+		Version:    "6.1.0",
+		ApiVersion: "2.0.14",
+		PhpVersion: "8.3.0",
+		Os:         "Linux",
+		Driver:     "fake",
+	}})
+}
+
+// OAUTH HANDLERS
+
+func (s *Server) handleOAuthToken(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.refreshToken == "" || r.PostFormValue("grant_type") != "refresh_token" || r.PostFormValue("refresh_token") != s.refreshToken {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "message": "The refresh token is invalid."})
+		return
+	}
+
+	s.refreshes++
+	s.accessToken = "access-" + strconv.Itoa(s.refreshes)
+	s.refreshToken = "refresh-" + strconv.Itoa(s.refreshes)
+
+	writeJson(w, http.StatusOK, &firefly.FireflyOAuthToken{
+		TokenType:    "Bearer",
+		AccessToken:  s.accessToken,
+		RefreshToken: s.refreshToken,
+		ExpiresIn:    3600,
+	})
+}
+
+// ACCOUNT HANDLERS
+
+func (s *Server) handleSearchAccounts(w http.ResponseWriter, r *http.Request) {
+	query := strings.ToLower(r.URL.Query().Get("query"))
+	field := firefly.AccountField(r.URL.Query().Get("field"))
+	accountType := firefly.AccountType(r.URL.Query().Get("type"))
+
+	s.mutex.Lock()
+	result := []*firefly.AccountRead{}
+	for _, account := range s.accounts {
+		if accountType != "" && accountType != firefly.AllTypes && account.Attributes.Type != accountType {
+			continue
+		}
+
+		if matchesAccountField(account.Attributes, field, account.Id, query) {
+			result = append(result, account)
+		}
+	}
+	s.mutex.Unlock()
+
+	page, data, meta := paginate(r, len(result))
+	writeJson(w, http.StatusOK, &firefly.AccountsResponse{Data: result[page:data], Meta: meta})
+}
+
+// matchesAccountField reports whether the field contains the query, like the Firefly III account search
+func matchesAccountField(account *firefly.Account, field firefly.AccountField, id string, query string) bool {
+	values := map[firefly.AccountField]string{
+		firefly.IbanField:   account.Iban,
+		firefly.NameField:   account.Name,
+		firefly.NumberField: account.AccountNumber,
+		firefly.IdField:     id,
+	}
+
+	if field == firefly.IdField {
+		return id == query
+	}
+
+	if value, exists := values[field]; exists {
+		return strings.Contains(strings.ToLower(value), query)
+	}
+
+	for _, value := range values {
+		if strings.Contains(strings.ToLower(value), query) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Server) handleCreateAccount(w http.ResponseWriter, r *http.Request) {
+	var request firefly.AccountRequest
+	if !readJson(w, r, &request) {
+		return
+	}
+
+	if request.Name == "" {
+		writeValidationError(w, "name", "The name field is required.")
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, account := range s.accounts {
+		if account.Attributes.Type == request.Type && account.Attributes.Name == request.Name {
+			writeValidationError(w, "name", "This account name is already in use.")
+			return
+		}
+	}
+
+	writeJson(w, http.StatusOK, &firefly.AccountResponse{Data: s.createAccount(&request)})
+}
+
+// createAccount stores the account, the mutex must be held
+func (s *Server) createAccount(request *firefly.AccountRequest) *firefly.AccountRead {
+	now := time.Now()
+	currencyCode := request.CurrencyCode
+	if currencyCode == "" {
+		currencyCode = "EUR"
+	}
+
+	account := &firefly.AccountRead{
+		Type: "accounts",
+		Id:   s.newId(),
+		Attributes: &firefly.Account{
+			CreatedAt:     &now,
+			UpdatedAt:     &now,
+			Active:        true,
+			Name:          request.Name,
+			Type:          request.Type,
+			AccountRole:   request.AccountRole,
+			CurrencyCode:  currencyCode,
+			Iban:          request.Iban,
+			Bic:           request.Bic,
+			AccountNumber: request.AccountNumber,
+			Notes:         request.Notes,
+		},
+	}
+	s.accounts = append(s.accounts, account)
+
+	return account
+}
+
+// TRANSACTION HANDLERS
+
+func (s *Server) handleSearchTransactions(w http.ResponseWriter, r *http.Request) {
+	filters := parseTransactionQuery(r.URL.Query().Get("query"))
+
+	s.mutex.Lock()
+	result := []*firefly.TransactionRead{}
+	for _, item := range s.transactions {
+		if s.matchesTransaction(item.read, filters) {
+			result = append(result, item.read)
+		}
+	}
+	s.mutex.Unlock()
+
+	// Firefly III returns the newest transactions first
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Attributes.Transactions[0].Date.After(*result[j].Attributes.Transactions[0].Date)
+	})
+
+	page, data, meta := paginate(r, len(result))
+	writeJson(w, http.StatusOK, &firefly.TransactionsResponse{Data: result[page:data], Meta: meta})
+}
+
+type queryFilter struct {
+	operator string
+	value    string
+}
+
+// parseTransactionQuery splits the search query into operators, words without an operator search the description
+func parseTransactionQuery(query string) []*queryFilter {
+	filters := []*queryFilter{}
+	for _, part := range splitQuery(query) {
+		operator, value, found := strings.Cut(part, ":")
+		if !found {
+			operator, value = "description_contains", part
+		}
+
+		filters = append(filters, &queryFilter{operator: operator, value: strings.Trim(value, "\"")})
+	}
+
+	return filters
+}
+
+// splitQuery splits the query on spaces outside of double quotes
+func splitQuery(query string) []string {
+	parts := []string{}
+	current := ""
+	quoted := false
+	for _, char := range query {
+		switch {
+		case char == '"':
+			quoted = !quoted
+			current += string(char)
+		case char == ' ' && !quoted:
+			if current != "" {
+				parts = append(parts, current)
+			}
+			current = ""
+		default:
+			current += string(char)
+		}
+	}
+
+	if current != "" {
+		parts = append(parts, current)
+	}
+
+	return parts
+}
+
+// matchesTransaction reports whether any split matches all filters, the mutex must be held
+func (s *Server) matchesTransaction(read *firefly.TransactionRead, filters []*queryFilter) bool {
+	for _, split := range read.Attributes.Transactions {
+		matches := true
+		for _, filter := range filters {
+			matches = matches && s.matchesSplit(split, filter)
+		}
+
+		if matches {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Server) matchesSplit(split *firefly.TransactionSplit, filter *queryFilter) bool {
+	switch filter.operator {
+	case "external_id_is":
+		return split.ExternalId == filter.value
+	case "internal_reference_is":
+		return split.InternalReference == filter.value
+	case "account_nr_is":
+		// Matches the account number or iban of either side of the transaction
+		for _, id := range []string{split.SourceId, split.DestinationId} {
+			account := s.findAccount(id)
+			if account != nil && (account.Attributes.Iban == filter.value || account.Attributes.AccountNumber == filter.value) {
+				return true
+			}
+		}
+		return false
+	case "tag_is":
+		for _, tag := range split.Tags {
+			if tag == filter.value {
+				return true
+			}
+		}
+		return false
+	case "type":
+		return string(split.Type) == filter.value
+	case "amount_is":
+		amount, err := strconv.ParseFloat(split.Amount, 64)
+		expected, expectedErr := strconv.ParseFloat(filter.value, 64)
+		return err == nil && expectedErr == nil && amount == expected
+	case "date_on":
+		return split.Date != nil && split.Date.Format("2006-01-02") == filter.value
+	case "description_contains":
+		return strings.Contains(strings.ToLower(split.Description), strings.ToLower(filter.value))
+	default:
+		// Unknown operators never match, so a typo in a query does not silently match everything
+		return false
+	}
+}
+
+func (s *Server) handleCreateTransaction(w http.ResponseWriter, r *http.Request) {
+	var request firefly.TransactionRequest
+	if !readJson(w, r, &request) {
+		return
+	}
+
+	if len(request.Transactions) == 0 {
+		writeValidationError(w, "transactions", "Need at least one transaction.")
+		return
+	}
+
+	hash := transactionHash(request.Transactions)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.failTransactions > 0 {
+		s.failTransactions--
+		writeJson(w, http.StatusInternalServerError, map[string]string{"message": "Internal Server Error"})
+		return
+	}
+
+	if request.ErrorIfDuplicateHash {
+		for _, item := range s.transactions {
+			if item.hash == hash {
+				writeValidationError(w, "transactions.0.description", "Duplicate of transaction #"+item.read.Attributes.Transactions[0].TransactionJournalId+".")
+				return
+			}
+		}
+	}
+
+	now := time.Now()
+	read := &firefly.TransactionRead{
+		Type: "transactions",
+		Id:   s.newId(),
+		Attributes: &firefly.Transaction{
+			CreatedAt: &now,
+			UpdatedAt: &now,
+			User:      "1",
+		},
+	}
+
+	for i, splitRequest := range request.Transactions {
+		split, field, message := s.newSplit(splitRequest)
+		if split == nil {
+			writeValidationError(w, "transactions."+strconv.Itoa(i)+"."+field, message)
+			return
+		}
+
+		read.Attributes.Transactions = append(read.Attributes.Transactions, split)
+	}
+
+	s.transactions = append(s.transactions, &transaction{read: read, hash: hash})
+	writeJson(w, http.StatusOK, &firefly.TransactionResponse{Data: read})
+}
+
+// newSplit validates the split request and returns the stored split, or the invalid field with a message
+func (s *Server) newSplit(request *firefly.TransactionSplitRequest) (*firefly.TransactionSplit, string, string) {
+	if request.Description == "" {
+		return nil, "description", "The description field is required."
+	}
+
+	if amount, err := strconv.ParseFloat(request.Amount, 64); err != nil || amount <= 0 {
+		return nil, "amount", "The amount must be a positive number."
+	}
+
+	if request.Date == nil {
+		return nil, "date", "The date field is required."
+	}
+
+	source := s.findAccount(request.SourceId)
+	if source == nil {
+		return nil, "source_id", "This value is invalid for this field."
+	}
+
+	destination := s.findAccount(request.DestinationId)
+	if destination == nil {
+		return nil, "destination_id", "This value is invalid for this field."
+	}
+
+	if !validAccountTypes(request.Type, source.Attributes.Type, destination.Attributes.Type) {
+		return nil, "source_id", "This account type cannot be used for a " + string(request.Type) + "."
+	}
+
+	currencyCode := request.CurrencyCode
+	if currencyCode == "" {
+		currencyCode = source.Attributes.CurrencyCode
+		if source.Attributes.Type != firefly.AssetType {
+			currencyCode = destination.Attributes.CurrencyCode
+		}
+	}
+
+	tags := request.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+
+	return &firefly.TransactionSplit{
+		User:                 "1",
+		TransactionJournalId: s.newId(),
+		Type:                 request.Type,
+		Date:                 request.Date,
+		Amount:               request.Amount,
+		CurrencyCode:         currencyCode,
+		ForeignAmount:        request.ForeignAmount,
+		ForeignCurrencyCode:  request.ForeignCurrencyCode,
+		Description:          request.Description,
+		SourceId:             source.Id,
+		SourceName:           source.Attributes.Name,
+		SourceIban:           source.Attributes.Iban,
+		DestinationId:        destination.Id,
+		DestinationName:      destination.Attributes.Name,
+		DestinationIban:      destination.Attributes.Iban,
+		Notes:                request.Notes,
+		ExternalId:           request.ExternalId,
+		InternalReference:    request.InternalReference,
+		SepaCtId:             request.SepaCtId,
+		Tags:                 tags,
+	}, "", ""
+}
+
+// validAccountTypes reports whether Firefly III accepts the accounts for the transaction type
+func validAccountTypes(transactionType firefly.TransactionType, sourceType firefly.AccountType, destinationType firefly.AccountType) bool {
+	switch transactionType {
+	case firefly.WithdrawalTransaction:
+		return sourceType == firefly.AssetType && destinationType == firefly.ExpenseType
+	case firefly.DepositTransaction:
+		return sourceType == firefly.RevenueType && destinationType == firefly.AssetType
+	case firefly.TransferTransaction:
+		return sourceType == firefly.AssetType && destinationType == firefly.AssetType
+	default:
+		return false
+	}
+}
+
+// transactionHash is the hash Firefly III compares for error_if_duplicate_hash, calculated over the split requests
+func transactionHash(splits []*firefly.TransactionSplitRequest) string {
+	data, _ := json.Marshal(splits)
+	hash := sha256.Sum256(data)
+
+	return hex.EncodeToString(hash[:])
+}
+
+func (s *Server) handleUpdateTransaction(w http.ResponseWriter, r *http.Request) {
+	var request firefly.TransactionUpdateRequest
+	if !readJson(w, r, &request) {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	item := s.findTransaction(r.PathValue("id"))
+	if item == nil {
+		writeJson(w, http.StatusNotFound, map[string]string{"message": "Resource not found"})
+		return
+	}
+
+	for _, update := range request.Transactions {
+		var split *firefly.TransactionSplit
+		for _, candidate := range item.read.Attributes.Transactions {
+			if candidate.TransactionJournalId == update.TransactionJournalId {
+				split = candidate
+			}
+		}
+
+		if split == nil {
+			writeValidationError(w, "transactions.0.transaction_journal_id", "This value is invalid for this field.")
+			return
+		}
+
+		if update.Date != nil {
+			split.Date = update.Date
+		}
+		if update.Amount != "" {
+			split.Amount = update.Amount
+		}
+		if update.ForeignAmount != "" {
+			split.ForeignAmount = update.ForeignAmount
+		}
+		if update.Description != "" {
+			split.Description = update.Description
+		}
+		if update.ExternalId != "" {
+			split.ExternalId = update.ExternalId
+		}
+		if update.Notes != "" {
+			split.Notes = update.Notes
+		}
+		if update.Tags != nil {
+			split.Tags = update.Tags
+		}
+	}
+
+	now := time.Now()
+	item.read.Attributes.UpdatedAt = &now
+	writeJson(w, http.StatusOK, &firefly.TransactionResponse{Data: item.read})
+}
+
+func (s *Server) handleDeleteTransaction(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, item := range s.transactions {
+		if item.read.Id == r.PathValue("id") {
+			s.transactions = append(s.transactions[:i], s.transactions[i+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	writeJson(w, http.StatusNotFound, map[string]string{"message": "Resource not found"})
+}
+
+// ATTACHMENT HANDLERS
+
+func (s *Server) handleTransactionAttachments(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	item := s.findTransaction(r.PathValue("id"))
+	result := []*firefly.AttachmentRead{}
+	if item != nil {
+		for _, split := range item.read.Attributes.Transactions {
+			for _, stored := range s.attachments {
+				if stored.read.Attributes.AttachableId == split.TransactionJournalId {
+					result = append(result, stored.read)
+				}
+			}
+		}
+	}
+	s.mutex.Unlock()
+
+	if item == nil {
+		writeJson(w, http.StatusNotFound, map[string]string{"message": "Resource not found"})
+		return
+	}
+
+	page, data, meta := paginate(r, len(result))
+	writeJson(w, http.StatusOK, &firefly.AttachmentsResponse{Data: result[page:data], Meta: meta})
+}
+
+func (s *Server) handleCreateAttachment(w http.ResponseWriter, r *http.Request) {
+	var request firefly.AttachmentRequest
+	if !readJson(w, r, &request) {
+		return
+	}
+
+	if request.Filename == "" {
+		writeValidationError(w, "filename", "The filename field is required.")
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	read := &firefly.AttachmentRead{
+		Type: "attachments",
+		Id:   s.newId(),
+		Attributes: &firefly.Attachment{
+			CreatedAt:      &now,
+			UpdatedAt:      &now,
+			AttachableType: request.AttachableType,
+			AttachableId:   request.AttachableId,
+			Filename:       request.Filename,
+			Title:          request.Title,
+			Notes:          request.Notes,
+		},
+	}
+	read.Attributes.UploadUrl = s.URL + "/v1/attachments/" + read.Id + "/upload"
+	s.attachments = append(s.attachments, &attachment{read: read})
+
+	writeJson(w, http.StatusOK, &firefly.AttachmentResponse{Data: read})
+}
+
+func (s *Server) handleUploadAttachment(w http.ResponseWriter, r *http.Request) {
+	content, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeJson(w, http.StatusBadRequest, map[string]string{"message": "Cannot read body"})
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, item := range s.attachments {
+		if item.read.Id == r.PathValue("id") {
+			hash := md5.Sum(content)
+			item.content = content
+			item.read.Attributes.Md5 = hex.EncodeToString(hash[:])
+			item.read.Attributes.Size = len(content)
+			item.read.Attributes.Mime = http.DetectContentType(content)
+
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	writeJson(w, http.StatusNotFound, map[string]string{"message": "Resource not found"})
+}
+
+// UTILS
+
+// findAccount returns the account with the id, the mutex must be held
+func (s *Server) findAccount(id string) *firefly.AccountRead {
+	for _, account := range s.accounts {
+		if account.Id == id {
+			return account
+		}
+	}
+
+	return nil
+}
+
+// findTransaction returns the transaction with the id, the mutex must be held
+func (s *Server) findTransaction(id string) *transaction {
+	for _, item := range s.transactions {
+		if item.read.Id == id {
+			return item
+		}
+	}
+
+	return nil
+}
+
+// newId returns a unique id, the mutex must be held
+func (s *Server) newId() string {
+	id := s.nextId
+	s.nextId++
+
+	return strconv.Itoa(id)
+}
+
+// paginate returns the range of items for the page query parameter and the pagination meta data
+func paginate(r *http.Request, total int) (int, int, *firefly.ResponseMeta) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	start := (page - 1) * pageSize
+	if start > total {
+		start = total
+	}
+
+	end := start + pageSize
+	if end > total {
+		end = total
+	}
+
+	return start, end, &firefly.ResponseMeta{
+		Pagination: &firefly.Pagination{
+			Total:       total,
+			Count:       end - start,
+			PerPage:     pageSize,
+			CurrentPage: page,
+			TotalPages:  (total + pageSize - 1) / pageSize,
+		},
+	}
+}
+
+func readJson(w http.ResponseWriter, r *http.Request, request interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		writeJson(w, http.StatusBadRequest, map[string]string{"message": "Invalid JSON: " + err.Error()})
+		return false
+	}
+
+	return true
+}
+
+// writeValidationError writes a 422 response in the format Firefly III uses for validation errors
+func writeValidationError(w http.ResponseWriter, field string, message string) {
+	writeJson(w, http.StatusUnprocessableEntity, map[string]interface{}{
+		"message": message,
+		"errors":  map[string][]string{field: {message}},
+	})
+}
+
+func writeJson(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/bunq"
+	"github.com/daanvanberkel/fireflyiiibunq/firefly"
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+	"github.com/sirupsen/logrus"
+)
+
+// syncHealth remembers when the profiles were synced last, for the readiness endpoint
+var syncHealth = &healthState{lastSuccess: map[string]time.Time{}}
+
+type healthState struct {
+	mutex       sync.Mutex
+	lastSuccess map[string]time.Time
+}
+
+func (h *healthState) recordSuccess(profile string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.lastSuccess[profile] = time.Now()
+}
+
+func (h *healthState) lastSuccessOf(profile string) (time.Time, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	lastSuccess, exists := h.lastSuccess[profile]
+	return lastSuccess, exists
+}
+
+type healthCheck struct {
+	Profile string `json:"profile"`
+	Check   string `json:"check"`
+	Ok      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+type healthResponse struct {
+	Status string         `json:"status"`
+	Checks []*healthCheck `json:"checks,omitempty"`
+}
+
+// handleHealthz reports that the process is alive
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealthResponse(w, &healthResponse{Status: "ok"})
+}
+
+// readyzHandler reports whether every profile synced recently, has a bunq session and can still reach Firefly III.
+// The checks only read the stored state, they never register, start sessions or refresh tokens next to a sync.
+func readyzHandler(processConfig *util.ProcessConfig, log *logrus.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := &healthResponse{Status: "ok"}
+		for _, config := range processConfig.Profiles {
+			response.Checks = append(response.Checks, checkReadiness(r.Context(), processConfig, config, profileLogger(config, log))...)
+		}
+
+		for _, check := range response.Checks {
+			if !check.Ok {
+				response.Status = "unavailable"
+			}
+		}
+
+		writeHealthResponse(w, response)
+	}
+}
+
+func checkReadiness(ctx context.Context, processConfig *util.ProcessConfig, config *util.Config, log *logrus.Entry) []*healthCheck {
+	lastSync := &healthCheck{Profile: config.Profile, Check: "last_sync", Ok: true}
+	if lastSuccess, exists := syncHealth.lastSuccessOf(config.Profile); !exists {
+		lastSync.Ok = false
+		lastSync.Message = "no successful sync yet"
+	} else if age := time.Since(lastSuccess); age > processConfig.ReadyMaxSyncAge {
+		lastSync.Ok = false
+		lastSync.Message = "last successful sync was " + age.Round(time.Second).String() + " ago"
+	} else {
+		lastSync.Message = "synced at " + lastSuccess.Format(time.RFC3339)
+	}
+
+	bunqSession := &healthCheck{Profile: config.Profile, Check: "bunq_session", Ok: true}
+	if sessionServer, err := bunq.ReadStoredSession(config); err != nil {
+		bunqSession.Ok = false
+		bunqSession.Message = err.Error()
+	} else if sessionServer.CreatedAt != nil {
+		bunqSession.Message = "session started at " + sessionServer.CreatedAt.Format(time.RFC3339)
+	}
+
+	fireflyApi := &healthCheck{Profile: config.Profile, Check: "firefly_api", Ok: true}
+	if about, err := checkFireflyApi(ctx, config, log); err != nil {
+		fireflyApi.Ok = false
+		fireflyApi.Message = err.Error()
+	} else {
+		fireflyApi.Message = "Firefly III " + about.Version
+	}
+
+	return []*healthCheck{lastSync, bunqSession, fireflyApi}
+}
+
+// checkFireflyApi calls the Firefly III api with the token the sync stored. The probe never refreshes the token, that
+// would revoke the refresh token of a running sync.
+func checkFireflyApi(ctx context.Context, config *util.Config, log *logrus.Entry) (*firefly.About, error) {
+	fireflyClient, err := firefly.NewReadOnlyFireflyClient(config, log)
+	if err != nil {
+		return nil, err
+	}
+
+	return fireflyClient.About(ctx)
+}
+
+func writeHealthResponse(w http.ResponseWriter, response *healthResponse) {
+	statusCode := http.StatusOK
+	if response.Status != "ok" {
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(response)
+}
+
+// runHealthcheck probes the health endpoint of a running sync and fails when it is not healthy, for the Docker
+// HEALTHCHECK. Without a listen address the sync serves no endpoints, like a one-shot or cron run, and the check
+// passes. Usage: healthcheck [--ready]
+func runHealthcheck(arguments []string, log *logrus.Logger) error {
+	path := "/healthz"
+	if len(arguments) > 0 && arguments[0] == "--ready" {
+		path = "/readyz"
+	}
+
+	address := util.LoadMetricsConfig().ListenAddress
+	if address == "" {
+		log.Info("No METRICS_LISTEN_ADDRESS configured, nothing to probe")
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	response, err := client.Get("http://" + net.JoinHostPort(host, port) + path)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return errors.New(path + " returned " + response.Status + ": " + string(body))
+	}
+
+	log.WithField("path", path).Info("Healthy")
+	return nil
+}
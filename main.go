@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/daanvanberkel/fireflyiiibunq/bunq"
-	"github.com/daanvanberkel/fireflyiiibunq/firefly"
+	"github.com/daanvanberkel/fireflyiiibunq/cassette"
+	"github.com/daanvanberkel/fireflyiiibunq/notify"
+	"github.com/daanvanberkel/fireflyiiibunq/syncer"
+	"github.com/daanvanberkel/fireflyiiibunq/tracing"
 	"github.com/daanvanberkel/fireflyiiibunq/util"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
 func main() {
@@ -18,244 +24,181 @@ func main() {
 	log.Level = logrus.InfoLevel
 	log.Out = os.Stdout
 
-	arguments := os.Args
+	arguments := parseWaitFlag(os.Args[1:])
+	if len(arguments) > 0 {
+		if command, exists := commands[arguments[0]]; exists {
+			err := command(arguments[1:], log)
+			closeCassettes(log)
+			if err != nil {
+				log.WithError(err).WithField("command", arguments[0]).Error("Command failed")
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	runSync(arguments, log)
+}
+
+func runSync(arguments []string, log *logrus.Logger) {
 	var date time.Time
-	if len(arguments) >= 2 {
+	if len(arguments) >= 1 {
 		var err error
-		date, err = time.Parse("2006-01-02", arguments[1])
+		date, err = time.Parse("2006-01-02", arguments[0])
 		if err != nil {
 			panic(err)
 		}
-	} else {
-		date = time.Now()
 	}
-	date = time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
 
-	log.WithField("date", date.Format("2006-01-02")).Info("Starting bunq -> firefly sync")
-
-	config, err := util.LoadConfig()
+	processConfig, err := util.LoadProcessConfig()
 	if err != nil {
 		panic(err)
 	}
-
-	fireflyClient, err := firefly.NewFireflyClient(config, log)
-	if err != nil {
-		panic(err)
-	}
-
-	bunqClient, err := bunq.NewBunqClient(config, log)
-	if err != nil {
-		panic(err)
+	for _, config := range processConfig.Profiles {
+		warnSharedCredentials(config, log)
 	}
 
-	bankAccounts, err := bunqClient.GetMonetaryBankAccounts()
+	shutdownTracing, err := tracing.Setup(processConfig.TracingConfig)
 	if err != nil {
 		panic(err)
 	}
 
-	for _, bankAccount := range bankAccounts {
-		iban, err := bankAccount.GetIBAN()
-		if err != nil {
-			log.WithError(err).WithField("bankAccount", bankAccount).Error("Cannot get IBAN for bankaccount")
-			continue
-		}
-
-		assetAccount, err := fireflyClient.FindOrCreateAssetAccount(iban, &firefly.AccountRequest{
-			Name:        bankAccount.DisplayName + " - " + bankAccount.Description, // Adding description after display name to prevent naming collisions
-			Type:        firefly.AssetType,
-			Iban:        iban,
-			AccountRole: firefly.DefaultAsset,
-			Notes:       "Created by Bunq sync on" + time.Now().String(),
-		})
-		if err != nil {
-			log.WithError(err).WithField("iban", iban).Error("Cannot find or create firefly account")
-			continue
+	if processConfig.MetricsConfig.ListenAddress != "" {
+		if err := startHttpServer(processConfig, log); err != nil {
+			panic(err)
 		}
+	}
 
-		lastId := 0
-		processTransactions := true
-		for processTransactions {
-			payments, err := bunqClient.GetPayments(bankAccount.Id, lastId)
-			if err != nil {
-				fmt.Println(err)
-				continue
-			}
-
-			if len(payments) == 0 {
-				// No payments found, stop loop
-				processTransactions = false
-				break
-			}
-
-			for _, payment := range payments {
-				paymentLogger := log.WithFields(logrus.Fields{
-					"paymentId":  payment.Id,
-					"sourceIban": payment.Alias.Iban,
-					"targetIban": payment.CounterpartyAlias.Iban,
-					"date":       payment.Created,
-				})
-				isWithdrawal := payment.Amount.Value[0] == '-'
-
-				if date.Compare(payment.Created.Time) >= 1 {
-					processTransactions = false
-					paymentLogger.Info("Received payment too far in the past, stop processing")
-					continue
-				}
-
-				paymentLogger.Info("Start processing payment")
-
-				transactions, err := fireflyClient.SearchTransactions(&firefly.TransactionSearchQuery{
-					ExternalIdIs: strconv.Itoa(payment.Id),
-					AccountNrIs:  iban,
-				}, 1)
-				if err != nil {
-					paymentLogger.WithError(err).Error("Error while fetching transaction from firefly")
-					continue
-				}
-
-				if transactions.Meta.Pagination.Total > 0 {
-					// Transaction already in Firefly, stop processing
-					paymentLogger.Info("Payment already in firefly, skipping payment")
-					continue
-				}
-
-				counterPartyAssetAccount, err := findCounterPartyAssetAccount(fireflyClient, payment, paymentLogger)
-				if err != nil {
-					paymentLogger.WithError(err).Error("Failed searching for counterparty asset account, skipping payment")
-					continue
-				}
-
-				if counterPartyAssetAccount != nil {
-					// Make a transfer between two asset accounts
-					if err := createTransactionSplitForPayment(firefly.TransferTransaction, payment, assetAccount.Id, counterPartyAssetAccount.Id, fireflyClient, true); err != nil {
-						paymentLogger.WithError(err).Error("Cannot create new transaction in firefly")
-						continue
-					}
-
-					paymentLogger.Info("Created new transaction in firefly")
-					continue
-				}
-
-				// Make a normal withdrawal or deposit
-				var accountType firefly.AccountType
-				if isWithdrawal {
-					accountType = firefly.ExpenseType
-				} else {
-					accountType = firefly.RevenueType
-				}
-
-				account, err := findOrCreateAccountForPayment(fireflyClient, payment, accountType, paymentLogger)
-				if err != nil {
-					paymentLogger.WithError(err).Error("Cannot search for expense or revenue accounts by iban in firefly")
-					continue
-				}
-
-				var transactionType firefly.TransactionType
-				if isWithdrawal {
-					transactionType = firefly.WithdrawalTransaction
-				} else {
-					transactionType = firefly.DepositTransaction
-				}
-
-				if err := createTransactionSplitForPayment(transactionType, payment, assetAccount.Id, account.Id, fireflyClient, false); err != nil {
-					paymentLogger.WithError(err).Error("Cannot create new transaction in firefly")
-					continue
-				}
-
-				paymentLogger.Info("Created new transaction in firefly")
-			}
-
-			lastId = payments[len(payments)-1].Id
+	if processConfig.SyncInterval == 0 {
+		succeeded := syncProfiles(processConfig, syncDate(date, 0), log)
+		closeCassettes(log)
+		pushMetrics(processConfig, log)
+		shutdownTracing()
+		if !succeeded {
+			os.Exit(1)
 		}
+		return
 	}
-}
 
-func findCounterPartyAssetAccount(fireflyClient *firefly.FireflyClient, payment *bunq.BunqPayment, log *logrus.Entry) (*firefly.AccountRead, error) {
-	if payment.CounterpartyAlias.Iban == "" {
-		return nil, nil
+	log.WithField("interval", processConfig.SyncInterval.String()).Info("Syncing on an interval")
+	for {
+		syncProfiles(processConfig, syncDate(date, processConfig.SyncInterval), log)
+		closeCassettes(log)
+		time.Sleep(processConfig.SyncInterval)
 	}
+}
 
-	counterpartyAssetAccounts, err := fireflyClient.SearchAccounts(payment.CounterpartyAlias.Iban, firefly.IbanField, firefly.AssetType, 1)
-	if err != nil {
-		log.WithError(err).Error("Failed searching for counterparty asset account, skipping payment")
-		return nil, err
+// closeCassettes flushes the recorded cassettes to disk when a run or command ends
+func closeCassettes(log *logrus.Logger) {
+	if err := cassette.Close(); err != nil {
+		log.WithError(err).Error("Cannot close http cassette")
 	}
+}
 
-	if counterpartyAssetAccounts.Meta.Pagination.Total == 0 {
-		return nil, nil
+// syncDate returns the start of the day to sync from. Without a date argument a run syncs today, runs on an interval
+// also sync the day of the previous run so payments made just before midnight are not missed.
+func syncDate(date time.Time, interval time.Duration) time.Time {
+	if date.IsZero() {
+		date = time.Now().Add(-interval)
 	}
 
-	return counterpartyAssetAccounts.Data[0], nil
+	return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
 }
 
-func findOrCreateAccountForPayment(fireflyClient *firefly.FireflyClient, payment *bunq.BunqPayment, accountType firefly.AccountType, log *logrus.Entry) (*firefly.AccountRead, error) {
-	if payment.CounterpartyAlias.Iban != "" {
-		// Find accounts by iban
-		accounts, err := fireflyClient.SearchAccounts(payment.CounterpartyAlias.Iban, firefly.IbanField, accountType, 1)
-		if err != nil {
-			log.WithError(err).Error("Cannot search for expense or revenue accounts by iban in firefly")
-			return nil, err
-		}
+// syncProfiles runs the sync for every profile and reports whether all profiles were synced
+func syncProfiles(processConfig *util.ProcessConfig, date time.Time, log *logrus.Logger) bool {
+	log.WithField("date", date.Format("2006-01-02")).Info("Starting bunq -> firefly sync")
+
+	ctx, span := tracing.Start(context.Background(), "sync run", attribute.String("date", date.Format("2006-01-02")))
+	defer span.End()
+
+	reports := make([]*syncer.Report, len(processConfig.Profiles))
+	results := make([]error, len(processConfig.Profiles))
+
+	var wg sync.WaitGroup
+	for i, config := range processConfig.Profiles {
+		profileLog := profileLogger(config, log)
 
-		if accounts.Meta.Pagination.Total > 0 {
-			return accounts.Data[0], nil
+		if !processConfig.ProfilesConcurrent {
+			reports[i], results[i] = syncLockedProfile(ctx, processConfig, config, date, profileLog)
+			continue
 		}
+
+		wg.Add(1)
+		go func(i int, config *util.Config) {
+			defer wg.Done()
+			reports[i], results[i] = syncLockedProfile(ctx, processConfig, config, date, profileLog)
+		}(i, config)
 	}
+	wg.Wait()
 
-	if payment.CounterpartyAlias.DisplayName != "" {
-		// Find accounts by name
-		accounts, err := fireflyClient.SearchAccounts(payment.CounterpartyAlias.DisplayName, firefly.NameField, accountType, 1)
+	succeeded := true
+	for i, err := range results {
+		config := processConfig.Profiles[i]
 		if err != nil {
-			log.WithError(err).Error("Cannot search for expense or revenue accounts by name in firefly")
-			return nil, err
+			log.WithError(err).WithField("profile", config.Profile).Error("Sync of profile failed")
+			succeeded = false
+			continue
 		}
 
-		if accounts.Meta.Pagination.Total > 0 {
-			return accounts.Data[0], nil
+		if reports[i].Failed() {
+			log.WithField("profile", config.Profile).Error("Sync of profile finished with failed payments")
+			succeeded = false
+			continue
 		}
+
+		syncHealth.recordSuccess(config.Profile)
 	}
 
-	// Create new account in firefly
-	accountRequest := &firefly.AccountRequest{
-		Name:  payment.CounterpartyAlias.DisplayName,
-		Type:  accountType,
-		Iban:  payment.CounterpartyAlias.Iban,
-		Notes: "Created by Bunq sync on " + time.Now().String(),
+	if !succeeded {
+		span.SetStatus(codes.Error, "sync of a profile failed")
 	}
-	return fireflyClient.CreateAccount(accountRequest)
+
+	return succeeded
 }
 
-func createTransactionSplitForPayment(transactionType firefly.TransactionType, payment *bunq.BunqPayment, sourceId string, destinationId string, fireflyClient *firefly.FireflyClient, errorIfDuplicateHash bool) error {
-	var description string
-	if payment.Description == "" {
-		description = "(empty)"
-	} else {
-		description = payment.Description
+// syncLockedProfile syncs the profile while holding the lock on its storage. The report is written and sent before the
+// lock is released, so it is not written to a storage location another process uses or that was already cleaned up.
+func syncLockedProfile(ctx context.Context, processConfig *util.ProcessConfig, config *util.Config, date time.Time, log *logrus.Entry) (*syncer.Report, error) {
+	lock, err := lockProfile(config, "sync", log)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseLock(config, lock, log)
+
+	report, err := syncer.SyncProfile(ctx, config, date, log)
+	if report != nil {
+		writeReport(processConfig, config, report, log)
+		notify.Send(ctx, config, report, log)
 	}
 
-	isWithdrawal := payment.Amount.Value[0] == '-'
+	return report, err
+}
 
-	oldSourceId := sourceId
-	if !isWithdrawal {
-		sourceId = destinationId
-		destinationId = oldSourceId
-	}
+// reportOutputMutex keeps the printed reports of profiles synced concurrently from interleaving
+var reportOutputMutex sync.Mutex
 
-	transaction := &firefly.TransactionSplitRequest{
-		Type:          transactionType,
-		Date:          &payment.Created.Time,
-		Amount:        strings.Trim(payment.Amount.Value, "-"),
-		Description:   description,
-		CurrencyCode:  payment.Amount.Currency,
-		SourceId:      sourceId,
-		DestinationId: destinationId,
-		Notes:         "Created by Bunq sync on " + time.Now().String(),
-		ExternalId:    strconv.Itoa(payment.Id),
+// writeReport stores the report of the profile in its storage location and prints it when configured
+func writeReport(processConfig *util.ProcessConfig, config *util.Config, report *syncer.Report, log *logrus.Entry) {
+	path := config.StorageLocation + config.SyncConfig.ReportFileName
+	if err := report.Write(path); err != nil {
+		log.WithError(err).WithField("path", path).Error("Cannot write sync report")
 	}
-	_, err := fireflyClient.CreateTransaction(&firefly.TransactionRequest{
-		Transactions:         []*firefly.TransactionSplitRequest{transaction},
-		ErrorIfDuplicateHash: errorIfDuplicateHash,
-	})
 
-	return err
+	// Profiles synced concurrently print their reports one at a time
+	reportOutputMutex.Lock()
+	defer reportOutputMutex.Unlock()
+
+	switch processConfig.ReportOutput {
+	case util.ReportOutputJson:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	case util.ReportOutputSummary:
+		fmt.Print(report.Summary())
+	default:
+		for _, line := range strings.Split(strings.TrimSpace(report.Summary()), "\n") {
+			log.Info(strings.TrimSpace(line))
+		}
+	}
 }
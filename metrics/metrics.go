@@ -0,0 +1,154 @@
+// Package metrics holds the Prometheus metrics of the sync, served on the metrics listener and pushed to a
+// Pushgateway after a one-shot run
+package metrics
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+const namespace = "bunq_firefly_sync"
+
+// Payment results
+const (
+	Imported = "imported"
+	Skipped  = "skipped"
+	Failed   = "failed"
+)
+
+var Registry = prometheus.NewRegistry()
+
+var (
+	PaymentsSeen = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "payments_seen_total",
+		Help:      "Payments loaded from bunq within the sync period.",
+	}, []string{"profile", "account"})
+
+	Payments = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "payments_total",
+		Help:      "Processed payments by result: imported, skipped or failed.",
+	}, []string{"profile", "account", "result"})
+
+	AccountsCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "firefly_accounts_created_total",
+		Help:      "Accounts created in Firefly III by type.",
+	}, []string{"profile", "type"})
+
+	ApiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_requests_total",
+		Help:      "Requests to the bunq and Firefly III apis by endpoint and status code.",
+	}, []string{"api", "method", "endpoint", "status"})
+
+	ApiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Duration of requests to the bunq and Firefly III apis by endpoint and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"api", "method", "endpoint", "status"})
+
+	RateLimitWaits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bunq_rate_limit_waits_total",
+		Help:      "Requests retried after bunq answered with 429 Too Many Requests.",
+	})
+
+	RateLimitWaitSeconds = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bunq_rate_limit_wait_seconds_total",
+		Help:      "Time spent waiting for the bunq rate limit.",
+	})
+
+	SessionRestarts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bunq_session_restarts_total",
+		Help:      "bunq sessions started again after bunq rejected the session token.",
+	})
+
+	LastSuccessfulSync = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_successful_sync_timestamp_seconds",
+		Help:      "Unix time of the last sync of an account without failed payments.",
+	}, []string{"profile", "account"})
+)
+
+func init() {
+	Registry.MustRegister(
+		PaymentsSeen,
+		Payments,
+		AccountsCreated,
+		ApiRequests,
+		ApiRequestDuration,
+		RateLimitWaits,
+		RateLimitWaitSeconds,
+		SessionRestarts,
+		LastSuccessfulSync,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// Push sends the metrics to a Pushgateway, used when the process exits before Prometheus can scrape it
+func Push(url string, job string) error {
+	return push.New(url, job).Gatherer(Registry).Push()
+}
+
+// ids in paths are replaced to keep the number of endpoint labels small
+var pathIdPattern = regexp.MustCompile(`/[0-9]+(/|$)`)
+
+// Endpoint returns the path with ids replaced by {id}, like /user/{id}/monetary-account/{id}/payment
+func Endpoint(path string) string {
+	// Replace twice, because adjacent ids share the slash between them
+	path = pathIdPattern.ReplaceAllString(path, "/{id}$1")
+	return pathIdPattern.ReplaceAllString(path, "/{id}$1")
+}
+
+// Transport returns a http.RoundTripper that counts and times the requests to the api. A nil transport means the
+// default transport.
+func Transport(api string, transport http.RoundTripper) http.RoundTripper {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	return &instrumentedTransport{api: api, transport: transport}
+}
+
+type instrumentedTransport struct {
+	api       string
+	transport http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	start := time.Now()
+	response, err := t.transport.RoundTrip(request)
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(response.StatusCode)
+	}
+
+	labels := prometheus.Labels{
+		"api":      t.api,
+		"method":   request.Method,
+		"endpoint": Endpoint(request.URL.Path),
+		"status":   status,
+	}
+	ApiRequests.With(labels).Inc()
+	ApiRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+
+	return response, err
+}
@@ -0,0 +1,20 @@
+package metrics
+
+import "testing"
+
+func TestEndpoint(t *testing.T) {
+	tests := map[string]string{
+		"/v1/session-server":                                        "/v1/session-server",
+		"/v1/user/100/monetary-account/1001/payment":                "/v1/user/{id}/monetary-account/{id}/payment",
+		"/v1/user/100/monetary-account/1001/payment/5004/note-text": "/v1/user/{id}/monetary-account/{id}/payment/{id}/note-text",
+		"/v1/attachment-public/12/content":                          "/v1/attachment-public/{id}/content",
+		"/api/v1/transactions/7":                                    "/api/v1/transactions/{id}",
+		"/v1/device-server/1/2":                                     "/v1/device-server/{id}/{id}",
+	}
+
+	for path, expected := range tests {
+		if actual := Endpoint(path); actual != expected {
+			t.Errorf("Endpoint(%q) = %q, expected %q", path, actual, expected)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Package notify sends failed runs, repeated bunq session errors and notable payments of a sync to email, webhooks
+// and push services
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/syncer"
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+	"github.com/sirupsen/logrus"
+)
+
+type Kind string
+
+const (
+	RunFailed       Kind = "run_failed"
+	SessionErrors   Kind = "session_errors"
+	LargePayment    Kind = "large_payment"
+	NewCounterparty Kind = "new_counterparty"
+)
+
+// Event is something of a sync that someone should know about
+type Event struct {
+	Kind    Kind                  `json:"kind"`
+	Profile string                `json:"profile"`
+	Title   string                `json:"title"`
+	Message string                `json:"message"`
+	Urgent  bool                  `json:"urgent"`
+	Payment *syncer.PaymentReport `json:"payment,omitempty"`
+}
+
+// Notifier delivers events to people
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, event *Event) error
+}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// Notifiers returns the notifiers that are configured
+func Notifiers(config *util.NotifyConfig) []Notifier {
+	notifiers := []Notifier{}
+	if config.SmtpHost != "" {
+		notifiers = append(notifiers, &smtpNotifier{config: config})
+	}
+	if config.WebhookUrl != "" {
+		notifiers = append(notifiers, &webhookNotifier{url: config.WebhookUrl})
+	}
+	if config.ChatWebhookUrl != "" {
+		notifiers = append(notifiers, &chatNotifier{url: config.ChatWebhookUrl})
+	}
+	if config.NtfyUrl != "" {
+		notifiers = append(notifiers, &ntfyNotifier{url: config.NtfyUrl, token: config.NtfyToken})
+	}
+	if config.GotifyUrl != "" {
+		notifiers = append(notifiers, &gotifyNotifier{url: config.GotifyUrl, token: config.GotifyToken})
+	}
+
+	return notifiers
+}
+
+// Events returns the events of the report that match the configured conditions
+func Events(config *util.NotifyConfig, report *syncer.Report) []*Event {
+	profile := report.Profile
+	if profile == "" {
+		profile = "default"
+	}
+
+	events := []*Event{}
+	if report.Failed() {
+		events = append(events, &Event{
+			Kind:    RunFailed,
+			Profile: profile,
+			Title:   "Sync of profile " + profile + " failed",
+			Message: report.Summary(),
+			Urgent:  true,
+		})
+	}
+
+	if config.SessionRestarts > 0 && report.SessionRestarts >= config.SessionRestarts {
+		events = append(events, &Event{
+			Kind:    SessionErrors,
+			Profile: profile,
+			Title:   "bunq keeps rejecting the session of profile " + profile,
+			Message: fmt.Sprintf("bunq rejected the session %d times during the sync, check the api key and the permitted ips", report.SessionRestarts),
+			Urgent:  true,
+		})
+	}
+
+	for _, account := range report.Accounts {
+		for _, payment := range account.Payments {
+			if payment.Outcome != syncer.Created {
+				continue
+			}
+
+			if config.AmountThreshold > 0 {
+				amount, err := strconv.ParseFloat(payment.Amount, 64)
+				if err == nil && math.Abs(amount) >= config.AmountThreshold {
+					events = append(events, &Event{
+						Kind:    LargePayment,
+						Profile: profile,
+						Title:   fmt.Sprintf("Payment of %s %s on %s", payment.Amount, payment.Currency, account.Iban),
+						Message: paymentMessage(payment),
+						Payment: payment,
+					})
+				}
+			}
+
+			if config.NewCounterparty && payment.NewCounterparty {
+				events = append(events, &Event{
+					Kind:    NewCounterparty,
+					Profile: profile,
+					Title:   "First payment with " + payment.Counterparty + " on " + account.Iban,
+					Message: paymentMessage(payment),
+					Payment: payment,
+				})
+			}
+		}
+	}
+
+	return events
+}
+
+// Send sends the events of the report to every configured notifier. Failing notifiers are logged and don't stop the
+// others.
+func Send(ctx context.Context, config *util.Config, report *syncer.Report, log *logrus.Entry) {
+	notifiers := Notifiers(config.NotifyConfig)
+	if len(notifiers) == 0 {
+		return
+	}
+
+	for _, event := range Events(config.NotifyConfig, report) {
+		for _, notifier := range notifiers {
+			if err := notifier.Notify(ctx, event); err != nil {
+				log.WithError(err).WithFields(logrus.Fields{
+					"notifier": notifier.Name(),
+					"event":    event.Kind,
+				}).Error("Cannot send notification")
+			}
+		}
+	}
+}
+
+func paymentMessage(payment *syncer.PaymentReport) string {
+	return fmt.Sprintf("%s %s with %s: %s (bunq payment %d, Firefly III transaction %s)", payment.Amount, payment.Currency, payment.Counterparty, payment.Description, payment.PaymentId, payment.FireflyId)
+}
+
+// postJson posts the body as json and returns an error when the response is not successful
+// headerTitle returns the title as value of a mail or http header, on one line and encoded when it is not ascii.
+// Titles hold counterparty names chosen by whoever sent the payment.
+func headerTitle(title string) string {
+	title = strings.NewReplacer("\r", " ", "\n", " ").Replace(title)
+	return mime.QEncoding.Encode("utf-8", title)
+}
+
+func postJson(ctx context.Context, url string, headers map[string]string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	headers["Content-Type"] = "application/json"
+	return post(ctx, url, headers, data)
+}
+
+func post(ctx context.Context, url string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		responseBody, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return errors.New(url + " returned " + res.Status + ": " + string(responseBody))
+	}
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package notify_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/mail"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/daanvanberkel/fireflyiiibunq/notify"
+	"github.com/daanvanberkel/fireflyiiibunq/notifytest"
+	"github.com/daanvanberkel/fireflyiiibunq/syncer"
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+	"github.com/sirupsen/logrus"
+)
+
+func testReport() *syncer.Report {
+	return &syncer.Report{
+		Profile:         "alice",
+		Counts:          map[syncer.Outcome]int{syncer.Created: 2, syncer.Failed: 1},
+		SessionRestarts: 3,
+		Accounts: []*syncer.AccountReport{{
+			Iban:   "NL00BUNQ0000000001",
+			Counts: map[syncer.Outcome]int{syncer.Created: 2, syncer.Failed: 1},
+			Payments: []*syncer.PaymentReport{
+				{PaymentId: 1, Amount: "-750.00", Currency: "EUR", Counterparty: "Landlord", Outcome: syncer.Created, FireflyId: "10"},
+				{PaymentId: 2, Amount: "-4.50", Currency: "EUR", Counterparty: "Bakery", Outcome: syncer.Created, FireflyId: "11", NewCounterparty: true},
+				{PaymentId: 3, Amount: "-1000.00", Currency: "EUR", Counterparty: "Shop", Outcome: syncer.Failed, Error: "firefly returned 500", NewCounterparty: true},
+			},
+		}},
+	}
+}
+
+func TestEvents(t *testing.T) {
+	config := &util.NotifyConfig{AmountThreshold: 500, NewCounterparty: true, SessionRestarts: 3}
+
+	kinds := []notify.Kind{}
+	for _, event := range notify.Events(config, testReport()) {
+		kinds = append(kinds, event.Kind)
+	}
+
+	// The failed payment is part of the run failure, only created payments are matched against the conditions
+	expected := []notify.Kind{notify.RunFailed, notify.SessionErrors, notify.LargePayment, notify.NewCounterparty}
+	if len(kinds) != len(expected) {
+		t.Fatalf("expected events %v, got %v", expected, kinds)
+	}
+	for i := range expected {
+		if kinds[i] != expected[i] {
+			t.Errorf("expected events %v, got %v", expected, kinds)
+		}
+	}
+
+	if events := notify.Events(&util.NotifyConfig{}, &syncer.Report{Counts: map[syncer.Outcome]int{}}); len(events) != 0 {
+		t.Errorf("expected no events for a successful run without conditions, got %d", len(events))
+	}
+}
+
+func TestSend(t *testing.T) {
+	httpServer := notifytest.StartHttp()
+	defer httpServer.Close()
+
+	smtpServer, err := notifytest.StartSmtp()
+	if err != nil {
+		t.Fatalf("cannot start smtp server: %v", err)
+	}
+	defer smtpServer.Close()
+
+	port, _ := strconv.Atoi(smtpServer.Port)
+	config := &util.Config{
+		Profile: "alice",
+		NotifyConfig: &util.NotifyConfig{
+			SmtpHost:       smtpServer.Host,
+			SmtpPort:       port,
+			SmtpFrom:       "sync@example.com",
+			SmtpTo:         []string{"alice@example.com"},
+			WebhookUrl:     httpServer.URL + "/webhook",
+			ChatWebhookUrl: httpServer.URL + "/chat",
+			NtfyUrl:        httpServer.URL + "/ntfy/bunq",
+			NtfyToken:      "ntfy-token",
+			GotifyUrl:      httpServer.URL + "/gotify",
+			GotifyToken:    "gotify-token",
+		},
+	}
+
+	log := logrus.New()
+	log.Out = io.Discard
+	report := &syncer.Report{Profile: "alice", Error: "bunq is down", Counts: map[syncer.Outcome]int{}}
+	notify.Send(context.Background(), config, report, logrus.NewEntry(log))
+
+	requests := map[string]*notifytest.Request{}
+	for _, request := range httpServer.Requests() {
+		requests[request.Path] = request
+	}
+
+	var event notify.Event
+	if request := requests["/webhook"]; request == nil {
+		t.Error("missing webhook request")
+	} else if err := json.Unmarshal([]byte(request.Body), &event); err != nil || event.Kind != notify.RunFailed || event.Profile != "alice" {
+		t.Errorf("unexpected webhook body %s", request.Body)
+	}
+
+	if request := requests["/chat"]; request == nil || !strings.Contains(request.Body, `"text"`) {
+		t.Error("missing chat webhook request with text")
+	}
+
+	if request := requests["/ntfy/bunq"]; request == nil {
+		t.Error("missing ntfy request")
+	} else if request.Header.Get("Priority") != "high" || request.Header.Get("Authorization") != "Bearer ntfy-token" || !strings.Contains(request.Body, "bunq is down") {
+		t.Errorf("unexpected ntfy request %v %s", request.Header, request.Body)
+	}
+
+	if request := requests["/gotify/message"]; request == nil || request.Header.Get("X-Gotify-Key") != "gotify-token" {
+		t.Error("missing gotify request with application token")
+	}
+
+	mails := smtpServer.Mails()
+	if len(mails) != 1 {
+		t.Fatalf("expected one mail, got %d", len(mails))
+	}
+	if mails[0].From != "sync@example.com" || len(mails[0].To) != 1 || mails[0].To[0] != "alice@example.com" {
+		t.Errorf("unexpected mail envelope from %s to %v", mails[0].From, mails[0].To)
+	}
+	if !strings.Contains(mails[0].Data, "Subject: Sync of profile alice failed") {
+		t.Errorf("unexpected mail %s", mails[0].Data)
+	}
+}
+
+func TestSendEncodesTitles(t *testing.T) {
+	httpServer := notifytest.StartHttp()
+	defer httpServer.Close()
+
+	smtpServer, err := notifytest.StartSmtp()
+	if err != nil {
+		t.Fatalf("cannot start smtp server: %v", err)
+	}
+	defer smtpServer.Close()
+
+	port, _ := strconv.Atoi(smtpServer.Port)
+	config := &util.Config{
+		Profile: "alice",
+		NotifyConfig: &util.NotifyConfig{
+			SmtpHost:        smtpServer.Host,
+			SmtpPort:        port,
+			SmtpFrom:        "sync@example.com",
+			SmtpTo:          []string{"alice@example.com"},
+			NtfyUrl:         httpServer.URL + "/ntfy/bunq",
+			NewCounterparty: true,
+		},
+	}
+
+	// The sender of a payment chooses the counterparty name
+	report := &syncer.Report{
+		Profile: "alice",
+		Counts:  map[syncer.Outcome]int{syncer.Created: 1},
+		Accounts: []*syncer.AccountReport{{
+			Iban: "NL00BUNQ0000000001",
+			Payments: []*syncer.PaymentReport{
+				{PaymentId: 1, Amount: "4.50", Currency: "EUR", Counterparty: "Café\r\nBcc: mallory@example.com", Outcome: syncer.Created, NewCounterparty: true},
+			},
+		}},
+	}
+
+	log := logrus.New()
+	log.Out = io.Discard
+	notify.Send(context.Background(), config, report, logrus.NewEntry(log))
+
+	expected := "First payment with Café  Bcc: mallory@example.com on NL00BUNQ0000000001"
+	decoder := &mime.WordDecoder{}
+
+	requests := httpServer.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("expected one ntfy request, got %d", len(requests))
+	}
+	if title, err := decoder.DecodeHeader(requests[0].Header.Get("Title")); err != nil || title != expected {
+		t.Errorf("expected the ntfy title %q, got %q (%v)", expected, requests[0].Header.Get("Title"), err)
+	}
+
+	mails := smtpServer.Mails()
+	if len(mails) != 1 {
+		t.Fatalf("expected one mail, got %d", len(mails))
+	}
+	message, err := mail.ReadMessage(strings.NewReader(mails[0].Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bcc := message.Header.Get("Bcc"); bcc != "" {
+		t.Errorf("expected the counterparty not to add mail headers, got Bcc %q", bcc)
+	}
+	if subject, err := decoder.DecodeHeader(message.Header.Get("Subject")); err != nil || subject != expected {
+		t.Errorf("expected the subject %q, got %q (%v)", expected, message.Header.Get("Subject"), err)
+	}
+}
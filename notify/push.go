@@ -0,0 +1,55 @@
+package notify
+
+import (
+	"context"
+	"strings"
+)
+
+// ntfyNotifier publishes the event to a ntfy topic, the url includes the topic like https://ntfy.sh/bunq-sync
+type ntfyNotifier struct {
+	url   string
+	token string
+}
+
+func (n *ntfyNotifier) Name() string {
+	return "ntfy"
+}
+
+func (n *ntfyNotifier) Notify(ctx context.Context, event *Event) error {
+	headers := map[string]string{
+		"Title":    headerTitle(event.Title),
+		"Tags":     string(event.Kind),
+		"Priority": "default",
+	}
+	if event.Urgent {
+		headers["Priority"] = "high"
+	}
+	if n.token != "" {
+		headers["Authorization"] = "Bearer " + n.token
+	}
+
+	return post(ctx, n.url, headers, []byte(event.Message))
+}
+
+// gotifyNotifier sends the event as message of a Gotify application
+type gotifyNotifier struct {
+	url   string
+	token string
+}
+
+func (n *gotifyNotifier) Name() string {
+	return "gotify"
+}
+
+func (n *gotifyNotifier) Notify(ctx context.Context, event *Event) error {
+	priority := 5
+	if event.Urgent {
+		priority = 8
+	}
+
+	return postJson(ctx, strings.TrimSuffix(n.url, "/")+"/message", map[string]string{"X-Gotify-Key": n.token}, map[string]any{
+		"title":    event.Title,
+		"message":  event.Message,
+		"priority": priority,
+	})
+}
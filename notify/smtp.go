@@ -0,0 +1,40 @@
+package notify
+
+import (
+	"context"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+)
+
+// smtpNotifier mails the event, using STARTTLS when the server supports it
+type smtpNotifier struct {
+	config *util.NotifyConfig
+}
+
+func (n *smtpNotifier) Name() string {
+	return "smtp"
+}
+
+func (n *smtpNotifier) Notify(ctx context.Context, event *Event) error {
+	var auth smtp.Auth
+	if n.config.SmtpUsername != "" {
+		auth = smtp.PlainAuth("", n.config.SmtpUsername, n.config.SmtpPassword, n.config.SmtpHost)
+	}
+
+	var message strings.Builder
+	message.WriteString("From: " + n.config.SmtpFrom + "\r\n")
+	message.WriteString("To: " + strings.Join(n.config.SmtpTo, ", ") + "\r\n")
+	message.WriteString("Subject: " + headerTitle(event.Title) + "\r\n")
+	message.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("\r\n")
+	message.WriteString(strings.ReplaceAll(event.Message, "\n", "\r\n"))
+
+	address := net.JoinHostPort(n.config.SmtpHost, strconv.Itoa(n.config.SmtpPort))
+	return smtp.SendMail(address, auth, n.config.SmtpFrom, n.config.SmtpTo, []byte(message.String()))
+}
@@ -0,0 +1,34 @@
+package notify
+
+import (
+	"context"
+)
+
+// webhookNotifier posts the event as json
+type webhookNotifier struct {
+	url string
+}
+
+func (n *webhookNotifier) Name() string {
+	return "webhook"
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, event *Event) error {
+	return postJson(ctx, n.url, map[string]string{}, event)
+}
+
+// chatNotifier posts the event as text to an incoming webhook of Slack, Mattermost or a Matrix bridge like hookshot,
+// which all accept {"text": "..."}
+type chatNotifier struct {
+	url string
+}
+
+func (n *chatNotifier) Name() string {
+	return "chat"
+}
+
+func (n *chatNotifier) Notify(ctx context.Context, event *Event) error {
+	return postJson(ctx, n.url, map[string]string{}, map[string]string{
+		"text": "*" + event.Title + "*\n" + event.Message,
+	})
+}
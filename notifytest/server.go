@@ -0,0 +1,171 @@
+// Package notifytest provides local stand-ins for the services notifications are sent to: an http server that
+// records the webhook and push requests and a plain SMTP server that records the mails.
+package notifytest
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// Request is a request received by the http server
+type Request struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   string
+}
+
+type HttpServer struct {
+	URL string
+
+	httpServer *httptest.Server
+	mutex      sync.Mutex
+	requests   []*Request
+}
+
+// StartHttp starts an http server that accepts and records every request
+func StartHttp() *HttpServer {
+	s := &HttpServer{}
+	s.httpServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		s.mutex.Lock()
+		s.requests = append(s.requests, &Request{Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone(), Body: string(body)})
+		s.mutex.Unlock()
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	s.URL = s.httpServer.URL
+
+	return s
+}
+
+// Requests returns the received requests in order
+func (s *HttpServer) Requests() []*Request {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]*Request{}, s.requests...)
+}
+
+func (s *HttpServer) Close() {
+	s.httpServer.Close()
+}
+
+// Mail is a mail received by the SMTP server
+type Mail struct {
+	From string
+	To   []string
+	Data string
+}
+
+type SmtpServer struct {
+	Host string
+	Port string
+
+	listener net.Listener
+	mutex    sync.Mutex
+	mails    []*Mail
+}
+
+// StartSmtp starts an SMTP server on localhost without TLS or authentication
+func StartSmtp() (*SmtpServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	s := &SmtpServer{Host: host, Port: port, listener: listener}
+	go s.serve()
+
+	return s, nil
+}
+
+// Mails returns the received mails in order
+func (s *SmtpServer) Mails() []*Mail {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]*Mail{}, s.mails...)
+}
+
+func (s *SmtpServer) Close() {
+	s.listener.Close()
+}
+
+func (s *SmtpServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.handle(conn)
+	}
+}
+
+func (s *SmtpServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+
+	reply("220 notifytest ESMTP")
+	mail := &Mail{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(line)
+
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 notifytest")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			mail = &Mail{From: strings.Trim(line[len("MAIL FROM:"):], "<> ")}
+			reply("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			mail.To = append(mail.To, strings.Trim(line[len("RCPT TO:"):], "<> "))
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(dataLine, "."))
+			}
+			mail.Data = data.String()
+
+			s.mutex.Lock()
+			s.mails = append(s.mails, mail)
+			s.mutex.Unlock()
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/daanvanberkel/fireflyiiibunq/metrics"
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+	"github.com/sirupsen/logrus"
+)
+
+// startHttpServer serves the metrics and health endpoints in the background while the sync runs
+func startHttpServer(processConfig *util.ProcessConfig, log *logrus.Logger) error {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Handler())
+	mux.HandleFunc("GET /healthz", handleHealthz)
+	mux.HandleFunc("GET /readyz", readyzHandler(processConfig, log))
+
+	// Listening before the first sync fails the startup when the address can't be used
+	address := processConfig.MetricsConfig.ListenAddress
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.WithError(err).WithField("address", address).Error("Cannot serve metrics and health endpoints")
+		return err
+	}
+
+	go func() {
+		log.WithField("address", address).Info("Serving metrics and health endpoints")
+		if err := http.Serve(listener, mux); err != nil {
+			log.WithError(err).Error("Http server stopped")
+		}
+	}()
+
+	return nil
+}
+
+// pushMetrics sends the metrics of a one-shot run to the Pushgateway, when configured
+func pushMetrics(processConfig *util.ProcessConfig, log *logrus.Logger) {
+	if processConfig.MetricsConfig.PushgatewayUrl == "" {
+		return
+	}
+
+	if err := metrics.Push(processConfig.MetricsConfig.PushgatewayUrl, processConfig.MetricsConfig.PushgatewayJob); err != nil {
+		log.WithError(err).Error("Cannot push metrics to Pushgateway")
+		return
+	}
+
+	log.Debug("Pushed metrics to Pushgateway")
+}
@@ -0,0 +1,116 @@
+package syncer
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/daanvanberkel/fireflyiiibunq/bunq"
+	"github.com/daanvanberkel/fireflyiiibunq/firefly"
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+	"github.com/sirupsen/logrus"
+)
+
+// syncPaymentAttachments copies the receipts and note attachments of the payment to the firefly transaction.
+// Attachments uploaded by an earlier run are recognised by their file name and not downloaded again, firefly also keeps
+// the md5 hash of every uploaded file, so an attachment that is already there under another name is not duplicated.
+func syncPaymentAttachments(ctx context.Context, config *util.Config, bunqClient *bunq.BunqClient, fireflyClient *firefly.FireflyClient, monetaryAccountId int, payment *bunq.BunqPayment, transaction *firefly.TransactionRead, log *logrus.Entry) {
+	if !config.SyncConfig.SyncAttachments || transaction == nil || len(transaction.Attributes.Transactions) == 0 {
+		return
+	}
+
+	attachments, err := bunqClient.GetPaymentAttachments(ctx, monetaryAccountId, payment)
+	if err != nil {
+		log.WithError(err).Error("Cannot load attachments of payment from bunq")
+		return
+	}
+
+	if len(attachments) == 0 {
+		return
+	}
+
+	existingAttachments, err := fireflyClient.GetTransactionAttachments(ctx, transaction.Id)
+	if err != nil {
+		log.WithError(err).Error("Cannot load attachments of transaction from firefly")
+		return
+	}
+
+	knownHashes := map[string]bool{}
+	knownNames := map[string]bool{}
+	for _, attachment := range existingAttachments {
+		knownHashes[attachment.Attributes.Md5] = true
+		name, _, _ := strings.Cut(attachment.Attributes.Filename, ".")
+		knownNames[name] = true
+	}
+
+	journalId := transaction.Attributes.Transactions[0].TransactionJournalId
+	for _, attachment := range attachments {
+		attachmentLogger := log.WithField("attachmentId", attachment.Id)
+
+		if knownNames[attachmentName(payment, attachment)] {
+			attachmentLogger.Debug("Attachment already in firefly, skipping attachment")
+			continue
+		}
+
+		content, contentType, err := bunqClient.GetAttachmentContent(ctx, attachment)
+		if err != nil {
+			attachmentLogger.WithError(err).Error("Cannot download attachment from bunq")
+			continue
+		}
+
+		hash := md5.Sum(content)
+		hashString := hex.EncodeToString(hash[:])
+		if knownHashes[hashString] {
+			attachmentLogger.Debug("Attachment already in firefly, skipping attachment")
+			continue
+		}
+
+		title := attachment.Description
+		if title == "" {
+			title = "bunq attachment " + strconv.Itoa(attachment.Id)
+		}
+
+		fireflyAttachment, err := fireflyClient.CreateAttachment(ctx, &firefly.AttachmentRequest{
+			Filename:       attachmentFileName(payment, attachment, contentType),
+			AttachableType: firefly.TransactionJournalAttachable,
+			AttachableId:   journalId,
+			Title:          title,
+		})
+		if err != nil {
+			attachmentLogger.WithError(err).Error("Cannot create attachment in firefly")
+			continue
+		}
+
+		if err := fireflyClient.UploadAttachment(ctx, fireflyAttachment.Id, content); err != nil {
+			attachmentLogger.WithError(err).Error("Cannot upload attachment to firefly")
+			continue
+		}
+
+		knownHashes[hashString] = true
+		attachmentLogger.Info("Added attachment to firefly transaction")
+	}
+}
+
+// attachmentName is the file name of the attachment in firefly without extension
+func attachmentName(payment *bunq.BunqPayment, attachment *bunq.BunqPaymentAttachment) string {
+	return "bunq-payment-" + strconv.Itoa(payment.Id) + "-" + strconv.Itoa(attachment.Id)
+}
+
+func attachmentFileName(payment *bunq.BunqPayment, attachment *bunq.BunqPaymentAttachment, contentType string) string {
+	fileName := attachmentName(payment, attachment)
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fileName
+	}
+
+	extensions, err := mime.ExtensionsByType(mediaType)
+	if err != nil || len(extensions) == 0 {
+		return fileName
+	}
+
+	return fileName + extensions[0]
+}
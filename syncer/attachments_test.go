@@ -0,0 +1,70 @@
+package syncer_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/bunq"
+	"github.com/daanvanberkel/fireflyiiibunq/bunqtest"
+	"github.com/daanvanberkel/fireflyiiibunq/fireflytest"
+	"github.com/daanvanberkel/fireflyiiibunq/syncer"
+	"github.com/sirupsen/logrus"
+)
+
+func TestAttachmentsAreCopiedOnce(t *testing.T) {
+	fixtures := bunqtest.DefaultFixtures()
+	account := fixtures.Accounts[0]
+	payment := account.Payments[0]
+	payment.Attachment = []*bunq.BunqAttachmentReference{{Id: 9001}}
+	account.NoteAttachments = map[int][]*bunq.BunqNoteAttachment{
+		payment.Id: {{Id: 1, Description: "Receipt", AttachmentId: 9002}},
+	}
+	account.Attachments = map[int]*bunqtest.AttachmentFixture{
+		9001: {ContentType: "image/png", Content: []byte("photo")},
+		9002: {ContentType: "application/pdf", Content: []byte("receipt")},
+	}
+
+	bunqServer, err := bunqtest.Start(fixtures)
+	if err != nil {
+		t.Fatalf("cannot start fake bunq server: %v", err)
+	}
+	defer bunqServer.Close()
+
+	fireflyServer := fireflytest.Start("test-token")
+	defer fireflyServer.Close()
+
+	config := testConfig(t, bunqServer, fireflyServer)
+	config.SyncConfig.SyncAttachments = true
+	log := logrus.New()
+	log.Out = io.Discard
+
+	for run := 1; run <= 2; run++ {
+		if _, err := syncer.SyncProfile(context.Background(), config, time.Now().AddDate(0, 0, -30), logrus.NewEntry(log)); err != nil {
+			t.Fatalf("sync run %d failed: %v", run, err)
+		}
+	}
+
+	split := fireflyServer.TransactionByExternalId("5004")
+	if split == nil {
+		t.Fatal("transaction of the payment not created")
+	}
+
+	contents := fireflyServer.AttachmentContents(split.TransactionJournalId)
+	if len(contents) != 2 || string(contents["bunq-payment-5004-9001.png"]) != "photo" {
+		t.Errorf("expected both attachments once, got %v", contents)
+	}
+
+	// The second run finds the attachments by name and does not download them again
+	downloads := 0
+	for _, request := range bunqServer.Requests() {
+		if strings.HasSuffix(request.Path, "/content") {
+			downloads++
+		}
+	}
+	if downloads != 2 {
+		t.Errorf("expected every attachment to be downloaded once, got %d downloads", downloads)
+	}
+}
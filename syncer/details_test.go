@@ -0,0 +1,35 @@
+package syncer_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/bunq"
+	"github.com/daanvanberkel/fireflyiiibunq/bunqtest"
+)
+
+func TestSepaEndToEndIdIsImported(t *testing.T) {
+	now := time.Now()
+	test := startCardTest(t, func(account *bunq.BunqMonetaryAccountBank) []*bunq.BunqMastercardAction {
+		return nil
+	})
+
+	sepa := bunqtest.Payment(5001, test.account, "-75.00", "Rent", "NL00LAND0000000001", "Landlord", now.Add(-time.Hour))
+	sepa.Type = "EBA_SCT"
+	sepa.EndToEndId = "E2E-2024-0001"
+	test.bunqServer.AddPayment(test.account.Id, sepa)
+
+	// Only sepa payments have an end-to-end id
+	internal := bunqtest.Payment(5002, test.account, "-5.00", "Lunch", "NL00BUNQ0000000009", "Colleague", now.Add(-time.Hour))
+	internal.EndToEndId = "not-sepa"
+	test.bunqServer.AddPayment(test.account.Id, internal)
+
+	test.sync(t)
+
+	if split := test.fireflyServer.TransactionByExternalId("5001"); split == nil || split.SepaCtId != "E2E-2024-0001" {
+		t.Errorf("expected the end-to-end id of the sepa payment, got %+v", split)
+	}
+	if split := test.fireflyServer.TransactionByExternalId("5002"); split == nil || split.SepaCtId != "" {
+		t.Errorf("expected no end-to-end id for a payment within bunq, got %+v", split)
+	}
+}
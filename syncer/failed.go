@@ -0,0 +1,193 @@
+package syncer
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+)
+
+// Backoff between retries of a failed payment never grows beyond a day
+const maxRetryBackoff = 24 * time.Hour
+
+// FailedPayment is a payment that could not be imported, it is retried in later runs
+type FailedPayment struct {
+	BunqAccountId int       `json:"bunq_account_id"`
+	PaymentId     int       `json:"payment_id"`
+	Iban          string    `json:"iban"`
+	Amount        string    `json:"amount"`
+	Currency      string    `json:"currency"`
+	Description   string    `json:"description"`
+	Counterparty  string    `json:"counterparty"`
+	Created       time.Time `json:"created"`
+	Error         string    `json:"error"`
+	Attempts      int       `json:"attempts"`
+	FirstFailedAt time.Time `json:"first_failed_at"`
+	LastAttemptAt time.Time `json:"last_attempt_at"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+}
+
+// FailedQueue holds the failed payments of a profile, stored in its storage location
+type FailedQueue struct {
+	path             string
+	retryBackoff     time.Duration
+	maxRetryAttempts int
+
+	mutex    sync.Mutex
+	payments []*FailedPayment
+}
+
+// LoadFailedQueue loads the failed payments of the profile, the queue is empty when nothing failed yet
+func LoadFailedQueue(config *util.Config) (*FailedQueue, error) {
+	queue := &FailedQueue{
+		path:             config.StorageLocation + config.SyncConfig.FailedPaymentsFileName,
+		retryBackoff:     config.SyncConfig.RetryBackoff,
+		maxRetryAttempts: config.SyncConfig.MaxRetryAttempts,
+		payments:         []*FailedPayment{},
+	}
+
+	err := util.ReadStateFile(queue.path, &queue.payments)
+	if errors.Is(err, os.ErrNotExist) {
+		return queue, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return queue, nil
+}
+
+// Save stores the queue
+func (q *FailedQueue) Save() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return util.WriteStateFile(q.path, q.payments)
+}
+
+// Payments returns the failed payments ordered by account and payment
+func (q *FailedQueue) Payments() []*FailedPayment {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	payments := append([]*FailedPayment{}, q.payments...)
+	sort.Slice(payments, func(i, j int) bool {
+		if payments[i].BunqAccountId != payments[j].BunqAccountId {
+			return payments[i].BunqAccountId < payments[j].BunqAccountId
+		}
+		return payments[i].PaymentId < payments[j].PaymentId
+	})
+
+	return payments
+}
+
+// GaveUp reports whether the payment is no longer retried by the sync, only by the failed retry command
+func (q *FailedQueue) GaveUp(payment *FailedPayment) bool {
+	return q.maxRetryAttempts > 0 && payment.Attempts >= q.maxRetryAttempts
+}
+
+// Drop removes the payment from the queue and reports whether it was queued
+func (q *FailedQueue) Drop(paymentId int) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for i, payment := range q.payments {
+		if payment.PaymentId == paymentId {
+			q.payments = append(q.payments[:i], q.payments[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// DropAll empties the queue
+func (q *FailedQueue) DropAll() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	count := len(q.payments)
+	q.payments = []*FailedPayment{}
+	return count
+}
+
+// recordFailure queues the payment or counts another attempt, the next attempt waits twice as long as the previous
+func (q *FailedQueue) recordFailure(account *AccountReport, payment *PaymentReport, created time.Time, now time.Time) *FailedPayment {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	failed := q.find(payment.PaymentId)
+	if failed == nil {
+		failed = &FailedPayment{
+			BunqAccountId: account.BunqAccountId,
+			PaymentId:     payment.PaymentId,
+			FirstFailedAt: now,
+		}
+		q.payments = append(q.payments, failed)
+	}
+
+	failed.Iban = account.Iban
+	failed.Amount = payment.Amount
+	failed.Currency = payment.Currency
+	failed.Description = payment.Description
+	failed.Counterparty = payment.Counterparty
+	failed.Created = created
+	failed.Error = payment.Error
+	failed.Attempts++
+	failed.LastAttemptAt = now
+
+	backoff := q.retryBackoff
+	for i := 1; i < failed.Attempts && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	failed.NextAttemptAt = now.Add(min(backoff, maxRetryBackoff))
+
+	return failed
+}
+
+func (q *FailedQueue) find(paymentId int) *FailedPayment {
+	for _, payment := range q.payments {
+		if payment.PaymentId == paymentId {
+			return payment
+		}
+	}
+
+	return nil
+}
+
+// due returns the payments of the account to retry now. With force every payment of the account is due.
+func (q *FailedQueue) due(bunqAccountId int, now time.Time, force bool) []*FailedPayment {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	due := []*FailedPayment{}
+	for _, payment := range q.payments {
+		if payment.BunqAccountId != bunqAccountId {
+			continue
+		}
+
+		if force || (!q.GaveUp(payment) && !now.Before(payment.NextAttemptAt)) {
+			due = append(due, payment)
+		}
+	}
+
+	return due
+}
+
+// oldestCreated returns the date of the oldest queued payment of the account, or date when that is older
+func (q *FailedQueue) oldestCreated(bunqAccountId int, date time.Time) time.Time {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	oldest := date
+	for _, payment := range q.payments {
+		if payment.BunqAccountId == bunqAccountId && (oldest.IsZero() || payment.Created.Before(oldest)) {
+			oldest = payment.Created
+		}
+	}
+
+	return oldest
+}
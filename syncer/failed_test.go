@@ -0,0 +1,74 @@
+package syncer_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/bunqtest"
+	"github.com/daanvanberkel/fireflyiiibunq/fireflytest"
+	"github.com/daanvanberkel/fireflyiiibunq/syncer"
+	"github.com/sirupsen/logrus"
+)
+
+func TestFailedPaymentsAreRetried(t *testing.T) {
+	bunqServer, err := bunqtest.Start(bunqtest.DefaultFixtures())
+	if err != nil {
+		t.Fatalf("cannot start fake bunq server: %v", err)
+	}
+	defer bunqServer.Close()
+
+	fireflyServer := fireflytest.Start("test-token")
+	defer fireflyServer.Close()
+
+	config := testConfig(t, bunqServer, fireflyServer)
+	log := logrus.New()
+	log.Out = io.Discard
+
+	fireflyServer.FailTransactions(1)
+	report, err := syncer.SyncProfile(context.Background(), config, time.Now().AddDate(0, 0, -30), logrus.NewEntry(log))
+	if err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if report.Counts[syncer.Failed] != 1 {
+		t.Fatalf("expected one failed payment, got %v", report.Counts)
+	}
+	imported := len(fireflyServer.Transactions())
+
+	queue, err := syncer.LoadFailedQueue(config)
+	if err != nil {
+		t.Fatalf("cannot load failed payments: %v", err)
+	}
+	if payments := queue.Payments(); len(payments) != 1 || payments[0].Attempts != 1 || payments[0].Error == "" {
+		t.Fatalf("expected one queued payment with its error, got %+v", payments)
+	}
+
+	// The failed payment is older than the start of the next run and its backoff has not passed yet
+	report, err = syncer.SyncProfile(context.Background(), config, time.Now(), logrus.NewEntry(log))
+	if err != nil {
+		t.Fatalf("second sync failed: %v", err)
+	}
+	if report.Counts[syncer.Created] != 0 || len(fireflyServer.Transactions()) != imported {
+		t.Fatalf("expected no retry before the backoff passed, got %v", report.Counts)
+	}
+
+	report, err = syncer.RetryFailedPayments(context.Background(), config, logrus.NewEntry(log))
+	if err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+	if report.Failed() || report.Counts[syncer.Created] != 1 {
+		t.Fatalf("expected the retried payment to be created, got %v", report.Counts)
+	}
+	if len(fireflyServer.Transactions()) != imported+1 {
+		t.Errorf("expected %d transactions after the retry, got %d", imported+1, len(fireflyServer.Transactions()))
+	}
+
+	queue, err = syncer.LoadFailedQueue(config)
+	if err != nil {
+		t.Fatalf("cannot load failed payments: %v", err)
+	}
+	if payments := queue.Payments(); len(payments) != 0 {
+		t.Errorf("expected the queue to be empty after the retry, got %+v", payments)
+	}
+}
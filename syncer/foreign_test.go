@@ -0,0 +1,101 @@
+package syncer_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/bunq"
+	"github.com/daanvanberkel/fireflyiiibunq/bunqtest"
+	"github.com/daanvanberkel/fireflyiiibunq/firefly"
+	"github.com/daanvanberkel/fireflyiiibunq/syncer"
+	"github.com/sirupsen/logrus"
+)
+
+// clearedForeignAction returns a settled card authorisation of a merchant that charged in dollars
+func clearedForeignAction(id int, account *bunq.BunqMonetaryAccountBank, billed string, local string, counterpartyName string, created time.Time) *bunq.BunqMastercardAction {
+	action := bunqtest.MastercardAction(id, account, billed, counterpartyName, created)
+	action.AmountLocal = &bunq.BunqAmount{Value: local, Currency: "USD"}
+	action.ClearingStatus = "CLEARED"
+
+	return action
+}
+
+func TestCardPaymentsKeepForeignAmount(t *testing.T) {
+	now := time.Now()
+	test := startCardTest(t, func(account *bunq.BunqMonetaryAccountBank) []*bunq.BunqMastercardAction {
+		return []*bunq.BunqMastercardAction{
+			clearedForeignAction(7001, account, "-92.00", "-100.00", "Diner", now.Add(-72*time.Hour)),
+			// The merchant captured half of the authorised amount
+			clearedForeignAction(7002, account, "-92.00", "-100.00", "Hotel", now.Add(-72*time.Hour)),
+		}
+	})
+
+	test.bunqServer.AddPayment(test.account.Id, test.cardPayment(5001, "-92.00", "Diner", now.Add(-48*time.Hour)))
+	test.bunqServer.AddPayment(test.account.Id, test.cardPayment(5002, "-46.00", "Hotel", now.Add(-48*time.Hour)))
+
+	// Payments abroad that are not card payments carry no amount in another currency
+	transfer := bunqtest.Payment(5003, test.account, "-92.00", "Diner", "US00BANK0000000001", "Diner", now.Add(-48*time.Hour))
+	transfer.Type = "SWIFT"
+	test.bunqServer.AddPayment(test.account.Id, transfer)
+
+	test.sync(t)
+
+	tests := []struct {
+		externalId      string
+		amount          string
+		foreignAmount   string
+		foreignCurrency string
+	}{
+		{"5001", "92.00", "100.00", "USD"},
+		{"5002", "46.00", "50.00", "USD"},
+		{"5003", "92.00", "", ""},
+	}
+
+	for _, expected := range tests {
+		split := test.fireflyServer.TransactionByExternalId(expected.externalId)
+		if split == nil {
+			t.Errorf("transaction of payment %s not created", expected.externalId)
+			continue
+		}
+
+		if split.Amount != expected.amount || split.CurrencyCode != "EUR" || split.ForeignAmount != expected.foreignAmount || split.ForeignCurrencyCode != expected.foreignCurrency {
+			t.Errorf("expected payment %s to be %s EUR and %q %q, got %s %s and %q %q", expected.externalId,
+				expected.amount, expected.foreignAmount, expected.foreignCurrency,
+				split.Amount, split.CurrencyCode, split.ForeignAmount, split.ForeignCurrencyCode)
+		}
+	}
+}
+
+func TestAccountWithOtherCurrencyInFireflyIsSkipped(t *testing.T) {
+	now := time.Now()
+	test := startCardTest(t, func(account *bunq.BunqMonetaryAccountBank) []*bunq.BunqMastercardAction {
+		return nil
+	})
+	test.bunqServer.AddPayment(test.account.Id, test.cardPayment(5001, "-10.00", "Diner", now.Add(-time.Hour)))
+
+	iban, _ := test.account.GetIBAN()
+	test.fireflyServer.AddAccount(&firefly.AccountRequest{
+		Name:         "Dollar account",
+		Type:         firefly.AssetType,
+		Iban:         iban,
+		AccountRole:  firefly.DefaultAsset,
+		CurrencyCode: "USD",
+	})
+
+	log := logrus.New()
+	log.Out = io.Discard
+
+	report, err := syncer.SyncProfile(context.Background(), test.config, now.AddDate(0, 0, -30), logrus.NewEntry(log))
+	if err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	if !report.Failed() {
+		t.Error("expected the account with another currency in firefly to fail the run")
+	}
+	if transactions := test.fireflyServer.Transactions(); len(transactions) != 0 {
+		t.Errorf("expected no transactions in the account with another currency, got %d", len(transactions))
+	}
+}
@@ -0,0 +1,377 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/bunq"
+	"github.com/daanvanberkel/fireflyiiibunq/firefly"
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+	"github.com/sirupsen/logrus"
+)
+
+// Tag added to firefly transactions created from card authorisations that are not settled yet
+const pendingTag = "bunq-pending"
+
+// Card payments are settled within a couple of days, older authorisations are not considered when reconciling
+const mastercardSettlementWindow = 30 * 24 * time.Hour
+
+func loadMastercardActions(ctx context.Context, bunqClient *bunq.BunqClient, monetaryAccountId int, date time.Time) ([]*bunq.BunqMastercardAction, error) {
+	result := []*bunq.BunqMastercardAction{}
+
+	lastId := 0
+	for {
+		actions, err := bunqClient.GetMastercardActions(ctx, monetaryAccountId, lastId)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(actions) == 0 {
+			return result, nil
+		}
+
+		for _, action := range actions {
+			if action.Created == nil {
+				continue
+			}
+
+			// Include authorisations from before the start date that could still be settled after it
+			if date.Add(-mastercardSettlementWindow).Compare(action.Created.Time) >= 1 {
+				return result, nil
+			}
+
+			result = append(result, action)
+		}
+
+		lastId = actions[len(actions)-1].Id
+	}
+}
+
+// settledAction is the payment that settled a card authorisation
+type settledAction struct {
+	PaymentId int       `json:"payment_id"`
+	SettledAt time.Time `json:"settled_at"`
+}
+
+// settledActions remembers which payment settled a card authorisation. bunq can still report an authorisation as
+// pending after its payment was synced, by then the pending transaction has the external id of the payment.
+type settledActions struct {
+	path string
+
+	mutex   sync.Mutex
+	actions map[int]*settledAction
+}
+
+// loadSettledActions loads the settled authorisations of the profile, forgetting those settled long enough ago that
+// bunq no longer reports them as pending
+func loadSettledActions(config *util.Config) (*settledActions, error) {
+	settled := &settledActions{
+		path:    config.StorageLocation + config.SyncConfig.SettledCardActionsFileName,
+		actions: map[int]*settledAction{},
+	}
+
+	err := util.ReadStateFile(settled.path, &settled.actions)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	for id, action := range settled.actions {
+		if time.Since(action.SettledAt) > 2*mastercardSettlementWindow {
+			delete(settled.actions, id)
+		}
+	}
+
+	return settled, nil
+}
+
+func (s *settledActions) save() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return util.WriteStateFile(s.path, s.actions)
+}
+
+// record stores the payment that settled the authorisation, nothing is stored without authorisation
+func (s *settledActions) record(action *bunq.BunqMastercardAction, payment *bunq.BunqPayment) {
+	if action == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.actions[action.Id] = &settledAction{PaymentId: payment.Id, SettledAt: time.Now()}
+}
+
+func (s *settledActions) paymentOf(action *bunq.BunqMastercardAction) (int, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if settled, exists := s.actions[action.Id]; exists {
+		return settled.PaymentId, true
+	}
+
+	return 0, false
+}
+
+func syncMastercardActions(ctx context.Context, fireflyClient *firefly.FireflyClient, locks *profileLocks, settled *settledActions, actions []*bunq.BunqMastercardAction, assetAccount *firefly.AccountRead, iban string, log *logrus.Entry) {
+	for _, action := range actions {
+		actionLogger := log.WithFields(logrus.Fields{
+			"mastercardActionId":  action.Id,
+			"authorisationStatus": action.AuthorisationStatus,
+			"clearingStatus":      action.ClearingStatus,
+			"date":                action.Created,
+		})
+
+		if !action.IsPending() && !action.IsReversed() {
+			// Declined or already settled, settled authorisations are handled by their payment
+			continue
+		}
+
+		transaction, err := findPendingTransaction(ctx, fireflyClient, action, iban)
+		if err != nil {
+			actionLogger.WithError(err).Error("Error while fetching pending transaction from firefly")
+			continue
+		}
+
+		if action.IsReversed() {
+			if transaction == nil {
+				continue
+			}
+
+			if err := fireflyClient.DeleteTransaction(ctx, transaction.Id); err != nil {
+				actionLogger.WithError(err).Error("Cannot remove reversed card transaction from firefly")
+				continue
+			}
+
+			actionLogger.Info("Removed reversed card transaction from firefly")
+			continue
+		}
+
+		if transaction != nil {
+			actionLogger.Debug("Pending card transaction already in firefly, skipping")
+			continue
+		}
+
+		if action.Created == nil || action.AmountBilling == nil || action.CounterpartyAlias == nil {
+			actionLogger.Warn("Card authorisation without date, amount or counterparty, skipping")
+			continue
+		}
+
+		// The pending transaction was settled, or its pending tag was removed in Firefly III
+		if paymentId, exists := settled.paymentOf(action); exists {
+			actionLogger.WithField("paymentId", paymentId).Debug("Card authorisation already settled by payment, skipping")
+			continue
+		}
+
+		transaction, err = findMastercardActionTransaction(ctx, fireflyClient, action, iban, "")
+		if err != nil {
+			actionLogger.WithError(err).Error("Error while fetching card transaction from firefly")
+			continue
+		}
+
+		if transaction != nil {
+			actionLogger.Debug("Card transaction already in firefly, skipping")
+			continue
+		}
+
+		account, _, err := findOrCreateAccountForCounterparty(ctx, fireflyClient, locks, action.CounterpartyAlias, firefly.ExpenseType, actionLogger)
+		if err != nil {
+			actionLogger.WithError(err).Error("Cannot search for expense accounts in firefly")
+			continue
+		}
+
+		if err := createTransactionSplitForMastercardAction(ctx, action, assetAccount.Id, account.Id, fireflyClient); err != nil {
+			actionLogger.WithError(err).Error("Cannot create pending card transaction in firefly")
+			continue
+		}
+
+		actionLogger.Info("Created pending card transaction in firefly")
+	}
+}
+
+// findMastercardActionForPayment finds the authorisation a settled card payment belongs to. Merchants are allowed to
+// capture less than the authorised amount, so the closest authorisation with an amount of at least the payment amount wins.
+func findMastercardActionForPayment(actions []*bunq.BunqMastercardAction, payment *bunq.BunqPayment) *bunq.BunqMastercardAction {
+	if payment.Type != "MASTERCARD" || payment.Created == nil || payment.Amount == nil || payment.CounterpartyAlias == nil || !strings.HasPrefix(payment.Amount.Value, "-") {
+		return nil
+	}
+
+	paymentCents, err := payment.Amount.GetCents()
+	if err != nil {
+		return nil
+	}
+
+	var result *bunq.BunqMastercardAction
+	var resultCents int64
+	for _, action := range actions {
+		if action.Decision != bunq.MastercardActionDecisionAllowed || action.AmountBilling == nil || action.Created == nil || action.CounterpartyAlias == nil {
+			continue
+		}
+
+		if action.Created.After(payment.Created.Time) || payment.Created.Sub(action.Created.Time) > mastercardSettlementWindow {
+			continue
+		}
+
+		if !strings.EqualFold(strings.TrimSpace(action.CounterpartyAlias.DisplayName), strings.TrimSpace(payment.CounterpartyAlias.DisplayName)) {
+			continue
+		}
+
+		actionCents, err := action.AmountBilling.GetCents()
+		if err != nil || actionCents < paymentCents {
+			continue
+		}
+
+		if result == nil || actionCents < resultCents || (actionCents == resultCents && action.Created.After(result.Created.Time)) {
+			result = action
+			resultCents = actionCents
+		}
+	}
+
+	return result
+}
+
+// reconcilePendingTransaction turns the pending firefly transaction of the authorisation into the settled payment.
+// Returns nil when there is no pending transaction for the authorisation.
+func reconcilePendingTransaction(ctx context.Context, fireflyClient *firefly.FireflyClient, action *bunq.BunqMastercardAction, payment *bunq.BunqPayment, notes string, iban string, log *logrus.Entry) (*firefly.TransactionRead, error) {
+	transaction, err := findPendingTransaction(ctx, fireflyClient, action, iban)
+	if err != nil {
+		return nil, err
+	}
+
+	if transaction == nil || len(transaction.Attributes.Transactions) == 0 {
+		return nil, nil
+	}
+
+	split := transaction.Attributes.Transactions[0]
+	tags := []string{}
+	for _, tag := range split.Tags {
+		if tag != pendingTag {
+			tags = append(tags, tag)
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"authorisedAmount": action.AmountBilling.Value,
+		"settledAmount":    payment.Amount.Value,
+	}).Debug("Settle pending card transaction")
+
+	foreignAmount, _ := foreignAmountForPayment(action, payment)
+	response, err := fireflyClient.UpdateTransaction(ctx, transaction.Id, &firefly.TransactionUpdateRequest{
+		Transactions: []*firefly.TransactionSplitUpdateRequest{
+			{
+				TransactionJournalId: split.TransactionJournalId,
+				Amount:               strings.Trim(payment.Amount.Value, "-"),
+				ForeignAmount:        foreignAmount,
+				ExternalId:           strconv.Itoa(payment.Id),
+				Notes:                notes,
+				Tags:                 tags,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Data, nil
+}
+
+func findPendingTransaction(ctx context.Context, fireflyClient *firefly.FireflyClient, action *bunq.BunqMastercardAction, iban string) (*firefly.TransactionRead, error) {
+	return findMastercardActionTransaction(ctx, fireflyClient, action, iban, pendingTag)
+}
+
+// findMastercardActionTransaction finds the transaction created for the authorisation, with the tag when it is given
+func findMastercardActionTransaction(ctx context.Context, fireflyClient *firefly.FireflyClient, action *bunq.BunqMastercardAction, iban string, tag string) (*firefly.TransactionRead, error) {
+	transactions, err := fireflyClient.SearchTransactions(ctx, &firefly.TransactionSearchQuery{
+		ExternalIdIs: mastercardActionExternalId(action),
+		AccountNrIs:  iban,
+		TagIs:        tag,
+	}, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if transactions.Meta.Pagination.Total == 0 || len(transactions.Data) == 0 {
+		return nil, nil
+	}
+
+	return transactions.Data[0], nil
+}
+
+func createTransactionSplitForMastercardAction(ctx context.Context, action *bunq.BunqMastercardAction, sourceId string, destinationId string, fireflyClient *firefly.FireflyClient) error {
+	description := action.Description
+	if description == "" {
+		description = action.CounterpartyAlias.DisplayName
+	}
+
+	transaction := &firefly.TransactionSplitRequest{
+		Type:          firefly.WithdrawalTransaction,
+		Date:          &action.Created.Time,
+		Amount:        strings.Trim(action.AmountBilling.Value, "-"),
+		Description:   description,
+		CurrencyCode:  action.AmountBilling.Currency,
+		SourceId:      sourceId,
+		DestinationId: destinationId,
+		ExternalId:    mastercardActionExternalId(action),
+		Tags:          append([]string{pendingTag, syncTag, paymentTypeTags["MASTERCARD"]}, merchantCategoryTags(action.CounterpartyAlias)...),
+	}
+
+	if foreignAmount := action.GetForeignAmount(); foreignAmount != nil {
+		transaction.ForeignAmount = strings.Trim(foreignAmount.Value, "-")
+		transaction.ForeignCurrencyCode = foreignAmount.Currency
+	}
+	_, err := fireflyClient.CreateTransaction(ctx, &firefly.TransactionRequest{
+		Transactions: []*firefly.TransactionSplitRequest{transaction},
+	})
+
+	return err
+}
+
+// foreignAmountForPayment returns the amount of the settled payment in the currency of the merchant. When the merchant
+// captured less than was authorised, the foreign amount is derived using the exchange rate of the authorisation.
+func foreignAmountForPayment(action *bunq.BunqMastercardAction, payment *bunq.BunqPayment) (string, string) {
+	foreignAmount := action.GetForeignAmount()
+	if foreignAmount == nil {
+		return "", ""
+	}
+
+	paymentCents, err := payment.Amount.GetCents()
+	if err != nil {
+		return "", ""
+	}
+
+	billingCents, err := action.AmountBilling.GetCents()
+	if err != nil {
+		return "", ""
+	}
+
+	if paymentCents == billingCents {
+		return strings.Trim(foreignAmount.Value, "-"), foreignAmount.Currency
+	}
+
+	exchangeRate, err := action.GetExchangeRate()
+	if err != nil || exchangeRate == 0 {
+		return "", ""
+	}
+
+	foreignCents := int64(math.Round(float64(paymentCents) / exchangeRate))
+	return strconv.FormatFloat(float64(foreignCents)/100, 'f', 2, 64), foreignAmount.Currency
+}
+
+func mastercardActionExternalId(action *bunq.BunqMastercardAction) string {
+	return "mastercard-action-" + strconv.Itoa(action.Id)
+}
+
+func merchantCategoryTags(counterparty *bunq.BunqPaymentMonetaryAccount) []string {
+	if counterparty == nil || counterparty.MerchantCategoryCode == "" {
+		return nil
+	}
+
+	return []string{"mcc:" + counterparty.MerchantCategoryCode}
+}
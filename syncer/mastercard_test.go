@@ -0,0 +1,252 @@
+package syncer_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/bunq"
+	"github.com/daanvanberkel/fireflyiiibunq/bunqtest"
+	"github.com/daanvanberkel/fireflyiiibunq/firefly"
+	"github.com/daanvanberkel/fireflyiiibunq/fireflytest"
+	"github.com/daanvanberkel/fireflyiiibunq/syncer"
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+	"github.com/sirupsen/logrus"
+)
+
+// cardTest is a main account with card authorisations and no payments yet
+type cardTest struct {
+	bunqServer    *bunqtest.Server
+	fireflyServer *fireflytest.Server
+	config        *util.Config
+	account       *bunq.BunqMonetaryAccountBank
+}
+
+func startCardTest(t *testing.T, actions func(account *bunq.BunqMonetaryAccountBank) []*bunq.BunqMastercardAction) *cardTest {
+	t.Helper()
+
+	fixtures := bunqtest.DefaultFixtures()
+	account := fixtures.Accounts[0].Account
+	fixtures.Accounts = []*bunqtest.AccountFixture{{Account: account, MastercardActions: actions(account)}}
+
+	bunqServer, err := bunqtest.Start(fixtures)
+	if err != nil {
+		t.Fatalf("cannot start fake bunq server: %v", err)
+	}
+	t.Cleanup(bunqServer.Close)
+
+	fireflyServer := fireflytest.Start("test-token")
+	t.Cleanup(fireflyServer.Close)
+
+	return &cardTest{
+		bunqServer:    bunqServer,
+		fireflyServer: fireflyServer,
+		config:        testConfig(t, bunqServer, fireflyServer),
+		account:       account,
+	}
+}
+
+func (c *cardTest) sync(t *testing.T) {
+	t.Helper()
+
+	log := logrus.New()
+	log.Out = io.Discard
+
+	report, err := syncer.SyncProfile(context.Background(), c.config, time.Now().AddDate(0, 0, -30), logrus.NewEntry(log))
+	if err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if report.Failed() {
+		t.Fatalf("sync finished with failures: %v", report.Counts)
+	}
+}
+
+func (c *cardTest) cardPayment(id int, amount string, counterpartyName string, created time.Time) *bunq.BunqPayment {
+	return bunqtest.Payment(id, c.account, amount, counterpartyName, "", counterpartyName, created)
+}
+
+func isPending(split *firefly.TransactionSplit) bool {
+	for _, tag := range split.Tags {
+		if tag == "bunq-pending" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestPendingCardPaymentIsSettled(t *testing.T) {
+	now := time.Now()
+	var authorisation *bunq.BunqMastercardAction
+	test := startCardTest(t, func(account *bunq.BunqMonetaryAccountBank) []*bunq.BunqMastercardAction {
+		authorisation = bunqtest.MastercardAction(7001, account, "-50.00", "Restaurant", now.Add(-48*time.Hour))
+		return []*bunq.BunqMastercardAction{
+			authorisation,
+			// A later visit to the same merchant that is still pending when the refund arrives
+			bunqtest.MastercardAction(7002, account, "-45.00", "Restaurant", now.Add(-2*time.Hour)),
+		}
+	})
+
+	test.sync(t)
+
+	pending := test.fireflyServer.TransactionByExternalId("mastercard-action-7001")
+	if pending == nil || !isPending(pending) || pending.Amount != "50.00" {
+		t.Fatalf("expected a pending transaction of the authorised amount, got %+v", pending)
+	}
+
+	// The merchant captures less than was authorised
+	settledAuthorisation := *authorisation
+	settledAuthorisation.ClearingStatus = "CLEARED"
+	test.bunqServer.UpdateMastercardAction(test.account.Id, &settledAuthorisation)
+	test.bunqServer.AddPayment(test.account.Id, test.cardPayment(5001, "-42.50", "Restaurant", now.Add(-24*time.Hour)))
+
+	test.sync(t)
+
+	settled := test.fireflyServer.TransactionByExternalId("5001")
+	if settled == nil || isPending(settled) || settled.Amount != "42.50" {
+		t.Fatalf("expected the pending transaction to be settled with the captured amount, got %+v", settled)
+	}
+	if settled.TransactionJournalId != pending.TransactionJournalId {
+		t.Errorf("expected the pending transaction to be updated instead of a new transaction")
+	}
+	if test.fireflyServer.TransactionByExternalId("mastercard-action-7001") != nil {
+		t.Error("expected no pending transaction after the payment settled")
+	}
+
+	// A refund is a new incoming card payment and never settles an authorisation
+	test.bunqServer.AddPayment(test.account.Id, test.cardPayment(5002, "42.50", "Restaurant", now))
+
+	test.sync(t)
+
+	refund := test.fireflyServer.TransactionByExternalId("5002")
+	if refund == nil || refund.Type != firefly.DepositTransaction || refund.Amount != "42.50" {
+		t.Fatalf("expected the refund to be a deposit, got %+v", refund)
+	}
+	if settled := test.fireflyServer.TransactionByExternalId("5001"); settled == nil || settled.Amount != "42.50" {
+		t.Errorf("expected the settled transaction to be kept, got %+v", settled)
+	}
+	if later := test.fireflyServer.TransactionByExternalId("mastercard-action-7002"); later == nil || !isPending(later) {
+		t.Errorf("expected the later authorisation to stay pending, got %+v", later)
+	}
+	if transactions := test.fireflyServer.Transactions(); len(transactions) != 3 {
+		t.Errorf("expected the settled payment, the pending authorisation and the refund, got %d transactions", len(transactions))
+	}
+}
+
+func TestCardPaymentSettlesClosestAuthorisation(t *testing.T) {
+	now := time.Now()
+	var closest *bunq.BunqMastercardAction
+	test := startCardTest(t, func(account *bunq.BunqMonetaryAccountBank) []*bunq.BunqMastercardAction {
+		closest = bunqtest.MastercardAction(7002, account, "-60.00", "Hotel", now.Add(-72*time.Hour))
+		return []*bunq.BunqMastercardAction{
+			bunqtest.MastercardAction(7001, account, "-100.00", " hotel ", now.Add(-72*time.Hour)),
+			closest,
+			bunqtest.MastercardAction(7003, account, "-55.00", "Bar", now.Add(-72*time.Hour)),
+			bunqtest.MastercardAction(7004, account, "-40.00", "Hotel", now.Add(-72*time.Hour)),
+			// Authorised after the payment, so it can't belong to it
+			bunqtest.MastercardAction(7005, account, "-55.00", "Hotel", now.Add(-1*time.Hour)),
+		}
+	})
+
+	test.sync(t)
+
+	settledAuthorisation := *closest
+	settledAuthorisation.ClearingStatus = "CLEARED"
+	test.bunqServer.UpdateMastercardAction(test.account.Id, &settledAuthorisation)
+	test.bunqServer.AddPayment(test.account.Id, test.cardPayment(5001, "-55.00", "HOTEL", now.Add(-24*time.Hour)))
+
+	test.sync(t)
+
+	if test.fireflyServer.TransactionByExternalId("mastercard-action-7002") != nil {
+		t.Error("expected the closest authorisation of the merchant with at least the payment amount to be settled")
+	}
+	for _, externalId := range []string{"mastercard-action-7001", "mastercard-action-7003", "mastercard-action-7004", "mastercard-action-7005"} {
+		if split := test.fireflyServer.TransactionByExternalId(externalId); split == nil || !isPending(split) {
+			t.Errorf("expected %s to stay pending, got %+v", externalId, split)
+		}
+	}
+	if settled := test.fireflyServer.TransactionByExternalId("5001"); settled == nil || isPending(settled) || settled.Amount != "55.00" {
+		t.Errorf("expected the payment to settle the pending transaction, got %+v", settled)
+	}
+	if transactions := test.fireflyServer.Transactions(); len(transactions) != 5 {
+		t.Errorf("expected 4 pending and 1 settled transaction, got %d transactions", len(transactions))
+	}
+}
+
+func TestExpiredAndReversedAuthorisationsAreRemoved(t *testing.T) {
+	now := time.Now()
+	var expiring, reversed *bunq.BunqMastercardAction
+	test := startCardTest(t, func(account *bunq.BunqMonetaryAccountBank) []*bunq.BunqMastercardAction {
+		expiring = bunqtest.MastercardAction(7001, account, "-80.00", "Car rental", now.Add(-48*time.Hour))
+		expiring.ReservationExpiryTime = &bunq.BunqTime{Time: now.Add(24 * time.Hour)}
+		reversed = bunqtest.MastercardAction(7002, account, "-12.00", "Parking", now.Add(-48*time.Hour))
+		return []*bunq.BunqMastercardAction{expiring, reversed}
+	})
+
+	test.sync(t)
+
+	if len(test.fireflyServer.Transactions()) != 2 {
+		t.Fatalf("expected 2 pending transactions, got %d", len(test.fireflyServer.Transactions()))
+	}
+
+	expired := *expiring
+	expired.ReservationExpiryTime = &bunq.BunqTime{Time: now.Add(-time.Hour)}
+	test.bunqServer.UpdateMastercardAction(test.account.Id, &expired)
+	reversedByMerchant := *reversed
+	reversedByMerchant.AuthorisationStatus = bunq.MastercardActionAuthorisationReversed
+	test.bunqServer.UpdateMastercardAction(test.account.Id, &reversedByMerchant)
+
+	test.sync(t)
+
+	if transactions := test.fireflyServer.Transactions(); len(transactions) != 0 {
+		t.Errorf("expected the expired and reversed authorisations to be removed, got %d transactions", len(transactions))
+	}
+}
+
+func TestSettledAuthorisationStillPendingIsNotAddedAgain(t *testing.T) {
+	now := time.Now()
+	test := startCardTest(t, func(account *bunq.BunqMonetaryAccountBank) []*bunq.BunqMastercardAction {
+		return []*bunq.BunqMastercardAction{bunqtest.MastercardAction(7001, account, "-20.00", "Bakery", now.Add(-48*time.Hour))}
+	})
+
+	test.sync(t)
+
+	// bunq books the payment while it still reports the authorisation as pending
+	test.bunqServer.AddPayment(test.account.Id, test.cardPayment(5001, "-20.00", "Bakery", now.Add(-24*time.Hour)))
+
+	test.sync(t)
+	test.sync(t)
+
+	if settled := test.fireflyServer.TransactionByExternalId("5001"); settled == nil || isPending(settled) {
+		t.Fatalf("expected the pending transaction to be settled, got %+v", settled)
+	}
+	if pending := test.fireflyServer.TransactionByExternalId("mastercard-action-7001"); pending != nil {
+		t.Errorf("expected the settled authorisation not to be added again, got %+v", pending)
+	}
+	if transactions := test.fireflyServer.Transactions(); len(transactions) != 1 {
+		t.Errorf("expected only the settled payment, got %d transactions", len(transactions))
+	}
+}
+
+func TestSparseCardResponsesAreSkipped(t *testing.T) {
+	now := time.Now()
+	test := startCardTest(t, func(account *bunq.BunqMonetaryAccountBank) []*bunq.BunqMastercardAction {
+		withoutDate := bunqtest.MastercardAction(7001, account, "-20.00", "Bakery", now.Add(-2*time.Hour))
+		withoutDate.Created = nil
+		withoutAmount := bunqtest.MastercardAction(7002, account, "-30.00", "Bakery", now.Add(-3*time.Hour))
+		withoutAmount.AmountBilling = nil
+		return []*bunq.BunqMastercardAction{withoutDate, withoutAmount}
+	})
+
+	test.bunqServer.AddPayment(test.account.Id, test.cardPayment(5001, "-20.00", "Bakery", now.Add(-time.Hour)))
+
+	test.sync(t)
+
+	if transactions := test.fireflyServer.Transactions(); len(transactions) != 1 {
+		t.Fatalf("expected only the payment, got %d transactions", len(transactions))
+	}
+	if payment := test.fireflyServer.TransactionByExternalId("5001"); payment == nil || payment.Amount != "20.00" {
+		t.Errorf("expected the payment to be created on its own, got %+v", payment)
+	}
+}
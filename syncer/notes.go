@@ -0,0 +1,136 @@
+package syncer
+
+import (
+	"context"
+	"strings"
+
+	"github.com/daanvanberkel/fireflyiiibunq/bunq"
+	"github.com/daanvanberkel/fireflyiiibunq/firefly"
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+	"github.com/sirupsen/logrus"
+)
+
+// Tag added to every firefly transaction created by the sync
+const syncTag = "bunq-sync"
+
+// Notes used to start with this marker before the sync tag was introduced, they are never pushed back to bunq
+const legacySyncMarker = "Created by Bunq sync on"
+
+// Notes are separated by an empty line in firefly
+const noteSeparator = "\n\n"
+
+// loadPaymentNotes returns all notes of the payment in bunq, formatted as firefly notes
+func loadPaymentNotes(ctx context.Context, config *util.Config, bunqClient *bunq.BunqClient, monetaryAccountId int, payment *bunq.BunqPayment) (string, error) {
+	if !config.SyncConfig.SyncNotes {
+		return "", nil
+	}
+
+	notes, err := loadBunqNoteContents(ctx, bunqClient, monetaryAccountId, payment)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join(notes, noteSeparator), nil
+}
+
+// syncPaymentNotes merges the notes of a payment already in firefly. Notes added in bunq are appended to the firefly
+// notes and, when enabled, notes written in firefly are added to the bunq payment.
+func syncPaymentNotes(ctx context.Context, config *util.Config, bunqClient *bunq.BunqClient, fireflyClient *firefly.FireflyClient, monetaryAccountId int, payment *bunq.BunqPayment, transaction *firefly.TransactionRead, log *logrus.Entry) {
+	if !config.SyncConfig.SyncNotes || transaction == nil || len(transaction.Attributes.Transactions) == 0 {
+		return
+	}
+
+	bunqNotes, err := loadBunqNoteContents(ctx, bunqClient, monetaryAccountId, payment)
+	if err != nil {
+		log.WithError(err).Error("Cannot load notes of payment from bunq")
+		return
+	}
+
+	split := transaction.Attributes.Transactions[0]
+	fireflyNotes := splitNotes(split.Notes)
+
+	if config.SyncConfig.SyncNotesToBunq {
+		for _, note := range fireflyNotes {
+			if strings.HasPrefix(note, legacySyncMarker) || containsNote(bunqNotes, note) {
+				continue
+			}
+
+			if err := bunqClient.CreatePaymentNote(ctx, monetaryAccountId, payment.Id, note); err != nil {
+				log.WithError(err).Error("Cannot add firefly note to bunq payment")
+				continue
+			}
+
+			log.Info("Added firefly note to bunq payment")
+		}
+	}
+
+	missingNotes := []string{}
+	for _, note := range bunqNotes {
+		if !containsNote(fireflyNotes, note) {
+			missingNotes = append(missingNotes, note)
+		}
+	}
+
+	if len(missingNotes) == 0 {
+		return
+	}
+
+	_, err = fireflyClient.UpdateTransaction(ctx, transaction.Id, &firefly.TransactionUpdateRequest{
+		Transactions: []*firefly.TransactionSplitUpdateRequest{
+			{
+				TransactionJournalId: split.TransactionJournalId,
+				Notes:                strings.Join(append(fireflyNotes, missingNotes...), noteSeparator),
+				Tags:                 split.Tags,
+			},
+		},
+	})
+	if err != nil {
+		log.WithError(err).Error("Cannot add bunq notes to firefly transaction")
+		return
+	}
+
+	log.WithField("notes", len(missingNotes)).Info("Added bunq notes to firefly transaction")
+}
+
+func loadBunqNoteContents(ctx context.Context, bunqClient *bunq.BunqClient, monetaryAccountId int, payment *bunq.BunqPayment) ([]string, error) {
+	notes, err := bunqClient.GetPaymentNotes(ctx, monetaryAccountId, payment.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for _, note := range notes {
+		// Empty lines separate notes in firefly, so they cannot be part of a single note
+		content := strings.TrimSpace(note.Content)
+		for strings.Contains(content, noteSeparator) {
+			content = strings.ReplaceAll(content, noteSeparator, "\n")
+		}
+
+		if content != "" {
+			result = append(result, content)
+		}
+	}
+
+	return result, nil
+}
+
+func splitNotes(notes string) []string {
+	result := []string{}
+	for _, note := range strings.Split(notes, noteSeparator) {
+		if note = strings.TrimSpace(note); note != "" {
+			result = append(result, note)
+		}
+	}
+
+	return result
+}
+
+func containsNote(notes []string, note string) bool {
+	for _, existing := range notes {
+		if existing == note {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,215 @@
+package syncer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/bunq"
+	"github.com/daanvanberkel/fireflyiiibunq/metrics"
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+)
+
+// Outcome is what the sync did with a payment
+type Outcome string
+
+const (
+	Created          Outcome = "created"
+	SkippedDuplicate Outcome = "skipped-duplicate"
+	SkippedFilter    Outcome = "skipped-filter"
+	Failed           Outcome = "failed"
+)
+
+// metricsResult returns the result label of the payments metric, payments skipped by the filter are not counted
+func (o Outcome) metricsResult() string {
+	switch o {
+	case Created:
+		return metrics.Imported
+	case SkippedDuplicate:
+		return metrics.Skipped
+	case Failed:
+		return metrics.Failed
+	}
+
+	return ""
+}
+
+// Report is the result of the sync of a profile, with the outcome of every payment
+type Report struct {
+	Profile    string           `json:"profile"`
+	Date       string           `json:"date,omitempty"`
+	StartedAt  time.Time        `json:"started_at"`
+	FinishedAt time.Time        `json:"finished_at"`
+	Duration   float64          `json:"duration_seconds"`
+	Error      string           `json:"error,omitempty"`
+	Counts     map[Outcome]int  `json:"counts"`
+	Accounts   []*AccountReport `json:"accounts"`
+	// SessionRestarts counts how often bunq rejected the session during the sync
+	SessionRestarts int `json:"session_restarts"`
+	// RetryOnly is set when only the queued failed payments were synced
+	RetryOnly bool `json:"retry_only,omitempty"`
+
+	// Accounts are synced concurrently
+	mutex sync.Mutex
+}
+
+type AccountReport struct {
+	Iban          string           `json:"iban"`
+	BunqAccountId int              `json:"bunq_account_id"`
+	Error         string           `json:"error,omitempty"`
+	Counts        map[Outcome]int  `json:"counts"`
+	Payments      []*PaymentReport `json:"payments"`
+}
+
+type PaymentReport struct {
+	PaymentId       int     `json:"payment_id"`
+	Amount          string  `json:"amount"`
+	Currency        string  `json:"currency"`
+	Description     string  `json:"description"`
+	Counterparty    string  `json:"counterparty"`
+	Outcome         Outcome `json:"outcome"`
+	Error           string  `json:"error,omitempty"`
+	FireflyId       string  `json:"firefly_id,omitempty"`
+	NewCounterparty bool    `json:"new_counterparty,omitempty"`
+	// Retry is set for payments retried from the failed payments queue
+	Retry bool `json:"retry,omitempty"`
+}
+
+func newReport(config *util.Config, date time.Time) *Report {
+	report := &Report{
+		Profile:   config.Profile,
+		StartedAt: time.Now(),
+		Counts:    map[Outcome]int{},
+		Accounts:  []*AccountReport{},
+	}
+	if !date.IsZero() {
+		report.Date = date.Format("2006-01-02")
+	}
+
+	return report
+}
+
+func newPaymentReport(payment *bunq.BunqPayment) *PaymentReport {
+	report := &PaymentReport{
+		PaymentId:   payment.Id,
+		Amount:      payment.Amount.Value,
+		Currency:    payment.Amount.Currency,
+		Description: payment.Description,
+	}
+	if payment.CounterpartyAlias != nil {
+		report.Counterparty = payment.CounterpartyAlias.DisplayName
+	}
+
+	return report
+}
+
+func (r *Report) addAccount(bunqAccountId int) *AccountReport {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	account := &AccountReport{
+		BunqAccountId: bunqAccountId,
+		Counts:        map[Outcome]int{},
+		Payments:      []*PaymentReport{},
+	}
+	r.Accounts = append(r.Accounts, account)
+
+	return account
+}
+
+func (r *Report) addPayment(account *AccountReport, payment *PaymentReport) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	account.Payments = append(account.Payments, payment)
+	account.Counts[payment.Outcome]++
+	r.Counts[payment.Outcome]++
+}
+
+func (r *Report) finish(err error) {
+	r.FinishedAt = time.Now()
+	r.Duration = r.FinishedAt.Sub(r.StartedAt).Seconds()
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// Failed reports whether the sync, an account or a payment failed
+func (r *Report) Failed() bool {
+	if r.Error != "" || r.Counts[Failed] > 0 {
+		return true
+	}
+
+	for _, account := range r.Accounts {
+		if account.Error != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Write stores the report as json
+func (r *Report) Write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return util.WriteFileAtomic(path, data, 0600)
+}
+
+// Summary returns the report as text for people, with a line per account and the failed payments
+func (r *Report) Summary() string {
+	var summary strings.Builder
+
+	profile := r.Profile
+	if profile == "" {
+		profile = "default"
+	}
+	if r.RetryOnly {
+		fmt.Fprintf(&summary, "Retry of failed payments of profile %s took %.1fs: %s\n", profile, r.Duration, formatCounts(r.Counts))
+	} else {
+		fmt.Fprintf(&summary, "Sync of profile %s since %s took %.1fs: %s\n", profile, r.Date, r.Duration, formatCounts(r.Counts))
+	}
+	if r.Error != "" {
+		fmt.Fprintf(&summary, "  failed: %s\n", r.Error)
+	}
+
+	for _, account := range r.Accounts {
+		name := account.Iban
+		if name == "" {
+			name = fmt.Sprintf("bunq account %d", account.BunqAccountId)
+		}
+
+		fmt.Fprintf(&summary, "  %s: %s\n", name, formatCounts(account.Counts))
+		if account.Error != "" {
+			fmt.Fprintf(&summary, "    account failed: %s\n", account.Error)
+		}
+
+		for _, payment := range account.Payments {
+			if payment.Outcome == Failed {
+				fmt.Fprintf(&summary, "    payment %d failed: %s\n", payment.PaymentId, payment.Error)
+			}
+		}
+	}
+
+	return summary.String()
+}
+
+func formatCounts(counts map[Outcome]int) string {
+	if len(counts) == 0 {
+		return "no payments"
+	}
+
+	outcomes := []string{}
+	for _, outcome := range []Outcome{Created, SkippedDuplicate, SkippedFilter, Failed} {
+		if counts[outcome] > 0 {
+			outcomes = append(outcomes, fmt.Sprintf("%d %s", counts[outcome], outcome))
+		}
+	}
+
+	return strings.Join(outcomes, ", ")
+}
@@ -0,0 +1,56 @@
+package syncer_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/bunqtest"
+	"github.com/daanvanberkel/fireflyiiibunq/fireflytest"
+	"github.com/daanvanberkel/fireflyiiibunq/syncer"
+	"github.com/sirupsen/logrus"
+)
+
+func TestReport(t *testing.T) {
+	bunqServer, err := bunqtest.Start(bunqtest.DefaultFixtures())
+	if err != nil {
+		t.Fatalf("cannot start fake bunq server: %v", err)
+	}
+	defer bunqServer.Close()
+
+	fireflyServer := fireflytest.Start("test-token")
+	defer fireflyServer.Close()
+
+	config := testConfig(t, bunqServer, fireflyServer)
+	log := logrus.New()
+	log.Out = io.Discard
+
+	report, err := syncer.SyncProfile(context.Background(), config, time.Now().AddDate(0, 0, -30), logrus.NewEntry(log))
+	if err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	if report.Failed() || report.Counts[syncer.Created] == 0 {
+		t.Fatalf("expected created payments and no failures, got %v", report.Counts)
+	}
+	for _, account := range report.Accounts {
+		if account.Iban == "" {
+			t.Errorf("missing iban of bunq account %d", account.BunqAccountId)
+		}
+		for _, payment := range account.Payments {
+			if payment.Outcome == syncer.Created && payment.FireflyId == "" {
+				t.Errorf("missing firefly id of created payment %d", payment.PaymentId)
+			}
+		}
+	}
+
+	report, err = syncer.SyncProfile(context.Background(), config, time.Now().AddDate(0, 0, -30), logrus.NewEntry(log))
+	if err != nil {
+		t.Fatalf("second sync failed: %v", err)
+	}
+
+	if report.Counts[syncer.Created] != 0 || report.Counts[syncer.SkippedDuplicate] == 0 {
+		t.Errorf("expected the second sync to skip every payment as duplicate, got %v", report.Counts)
+	}
+}
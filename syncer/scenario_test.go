@@ -0,0 +1,303 @@
+package syncer_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/bunqtest"
+	"github.com/daanvanberkel/fireflyiiibunq/firefly"
+	"github.com/daanvanberkel/fireflyiiibunq/fireflytest"
+	"github.com/daanvanberkel/fireflyiiibunq/syncer"
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// scenario describes the bunq accounts before a sync and what the sync must have created in Firefly III
+type scenario struct {
+	Description string          `yaml:"description"`
+	Runs        int             `yaml:"runs"`
+	Concurrency int             `yaml:"concurrency"`
+	Bunq        bunqScenario    `yaml:"bunq"`
+	Firefly     fireflyScenario `yaml:"firefly"`
+	Expect      fireflyScenario `yaml:"expect"`
+	ExpectBunq  bunqExpectation `yaml:"expect_bunq"`
+}
+
+// bunqExpectation is how the sync must have dealt with the bunq api over all runs
+type bunqExpectation struct {
+	SessionRestarts int `yaml:"session_restarts"`
+	RateLimited     int `yaml:"rate_limited"`
+}
+
+type bunqScenario struct {
+	RateLimit           int                    `yaml:"rate_limit"`
+	ExpireSessionsAfter int                    `yaml:"expire_sessions_after"`
+	Accounts            []*bunqAccountScenario `yaml:"accounts"`
+}
+
+type bunqAccountScenario struct {
+	Id          int                    `yaml:"id"`
+	Iban        string                 `yaml:"iban"`
+	Description string                 `yaml:"description"`
+	Payments    []*bunqPaymentScenario `yaml:"payments"`
+}
+
+type bunqPaymentScenario struct {
+	Id               int    `yaml:"id"`
+	Amount           string `yaml:"amount"`
+	Description      string `yaml:"description"`
+	CounterpartyIban string `yaml:"counterparty_iban"`
+	CounterpartyName string `yaml:"counterparty_name"`
+	DaysAgo          int    `yaml:"days_ago"`
+}
+
+type fireflyScenario struct {
+	Accounts     []*accountScenario     `yaml:"accounts"`
+	Transactions []*transactionScenario `yaml:"transactions"`
+}
+
+type accountScenario struct {
+	Name string              `yaml:"name"`
+	Type firefly.AccountType `yaml:"type"`
+	Iban string              `yaml:"iban"`
+}
+
+type transactionScenario struct {
+	ExternalId  string                  `yaml:"external_id"`
+	Type        firefly.TransactionType `yaml:"type"`
+	Amount      string                  `yaml:"amount"`
+	Description string                  `yaml:"description"`
+	Source      string                  `yaml:"source"`
+	Destination string                  `yaml:"destination"`
+}
+
+func TestScenarios(t *testing.T) {
+	paths, err := filepath.Glob("testdata/*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".yaml")
+		t.Run(name, func(t *testing.T) {
+			runScenario(t, loadScenario(t, path))
+		})
+	}
+}
+
+func loadScenario(t *testing.T, path string) *scenario {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result scenario
+	if err := yaml.Unmarshal(data, &result); err != nil {
+		t.Fatalf("cannot parse scenario: %v", err)
+	}
+
+	if result.Runs == 0 {
+		result.Runs = 1
+	}
+
+	return &result
+}
+
+func runScenario(t *testing.T, scenario *scenario) {
+	bunqServer, err := bunqtest.Start(bunqFixtures(scenario))
+	if err != nil {
+		t.Fatalf("cannot start fake bunq server: %v", err)
+	}
+	defer bunqServer.Close()
+
+	fireflyServer := fireflytest.Start("test-token")
+	defer fireflyServer.Close()
+
+	for _, account := range scenario.Firefly.Accounts {
+		request := &firefly.AccountRequest{Name: account.Name, Type: account.Type, Iban: account.Iban}
+		if account.Type == firefly.AssetType {
+			request.AccountRole = firefly.DefaultAsset
+		}
+		fireflyServer.AddAccount(request)
+	}
+
+	bunqServer.RateLimit(scenario.Bunq.RateLimit)
+	bunqServer.ExpireSessionsAfter(scenario.Bunq.ExpireSessionsAfter)
+
+	config := testConfig(t, bunqServer, fireflyServer)
+	config.SyncConfig.Concurrency = scenario.Concurrency
+	log := logrus.New()
+	log.Out = io.Discard
+
+	sessionRestarts := 0
+	for run := 0; run < scenario.Runs; run++ {
+		report, err := syncer.SyncProfile(context.Background(), config, time.Now().AddDate(0, 0, -30), logrus.NewEntry(log))
+		if err != nil {
+			t.Fatalf("sync run %d failed: %v", run+1, err)
+		}
+		sessionRestarts += report.SessionRestarts
+	}
+
+	assertAccounts(t, scenario.Expect.Accounts, fireflyServer.Accounts(firefly.AllTypes))
+	assertTransactions(t, scenario.Expect.Transactions, fireflyServer)
+
+	if sessionRestarts != scenario.ExpectBunq.SessionRestarts {
+		t.Errorf("expected %d session restarts, got %d", scenario.ExpectBunq.SessionRestarts, sessionRestarts)
+	}
+	assertRateLimitRetried(t, scenario.ExpectBunq.RateLimited, bunqServer.Requests())
+}
+
+// assertRateLimitRetried checks that the expected number of requests was rate limited and that every one of them was
+// sent again afterwards
+func assertRateLimitRetried(t *testing.T, expected int, requests []*bunqtest.Request) {
+	t.Helper()
+
+	rateLimited := 0
+	for i, request := range requests {
+		if !request.RateLimited {
+			continue
+		}
+		rateLimited++
+
+		retried := false
+		for _, later := range requests[i+1:] {
+			if !later.RateLimited && later.Method == request.Method && later.Path == request.Path {
+				retried = true
+				break
+			}
+		}
+		if !retried {
+			t.Errorf("rate limited request %s %s was not retried", request.Method, request.Path)
+		}
+	}
+
+	if rateLimited != expected {
+		t.Errorf("expected %d rate limited requests, got %d", expected, rateLimited)
+	}
+}
+
+func bunqFixtures(scenario *scenario) *bunqtest.Fixtures {
+	fixtures := bunqtest.DefaultFixtures()
+	fixtures.Accounts = nil
+
+	now := time.Now()
+	for _, accountScenario := range scenario.Bunq.Accounts {
+		account := &bunqtest.AccountFixture{
+			Account: bunqtest.Account(accountScenario.Id, accountScenario.Iban, accountScenario.Description),
+		}
+
+		for _, payment := range accountScenario.Payments {
+			created := now.Add(-time.Duration(payment.DaysAgo) * 24 * time.Hour)
+			account.Payments = append(account.Payments, bunqtest.Payment(payment.Id, account.Account, payment.Amount, payment.Description, payment.CounterpartyIban, payment.CounterpartyName, created))
+		}
+
+		fixtures.Accounts = append(fixtures.Accounts, account)
+	}
+
+	return fixtures
+}
+
+func testConfig(t *testing.T, bunqServer *bunqtest.Server, fireflyServer *fireflytest.Server) *util.Config {
+	return &util.Config{
+		StorageLocation: t.TempDir() + "/",
+		BunqConfig: &util.BunqConfig{
+			ApiBaseUrl:            bunqServer.URL,
+			ApiKey:                bunqtest.DefaultFixtures().ApiKey,
+			PrivateKeyFileName:    "bunq_client.key",
+			PublicKeyFileName:     "bunq_client.pub.key",
+			KeyBitSize:            2048,
+			InstallationFileName:  "bunq_installation.json",
+			DeviceServerFileName:  "bunq_device_server.json",
+			SessionServerFileName: "bunq_session_server.json",
+			UserAgent:             "BunqFireflySync/test",
+			PermittedIps:          []string{"*"},
+			MaxReregistrations:    1,
+		},
+		FireflyConfig: &util.FireflyConfig{
+			ApiBaseUrl: fireflyServer.URL,
+			ApiKey:     "test-token",
+		},
+		SyncConfig: &util.SyncConfig{
+			SyncNotes:                  true,
+			FailedPaymentsFileName:     "failed_payments.json",
+			SettledCardActionsFileName: "settled_card_actions.json",
+			RetryBackoff:               time.Hour,
+			MaxRetryAttempts:           10,
+		},
+	}
+}
+
+func assertAccounts(t *testing.T, expected []*accountScenario, actual []*firefly.AccountRead) {
+	t.Helper()
+
+	key := func(account *accountScenario) string {
+		return string(account.Type) + "|" + account.Name + "|" + account.Iban
+	}
+
+	expectedKeys := []string{}
+	for _, account := range expected {
+		expectedKeys = append(expectedKeys, key(account))
+	}
+
+	actualKeys := []string{}
+	for _, account := range actual {
+		actualKeys = append(actualKeys, key(&accountScenario{Name: account.Attributes.Name, Type: account.Attributes.Type, Iban: account.Attributes.Iban}))
+	}
+
+	sort.Strings(expectedKeys)
+	sort.Strings(actualKeys)
+	if strings.Join(expectedKeys, "\n") != strings.Join(actualKeys, "\n") {
+		t.Errorf("accounts do not match\nexpected:\n  %s\nactual:\n  %s", strings.Join(expectedKeys, "\n  "), strings.Join(actualKeys, "\n  "))
+	}
+}
+
+func assertTransactions(t *testing.T, expected []*transactionScenario, fireflyServer *fireflytest.Server) {
+	t.Helper()
+
+	if actual := fireflyServer.Transactions(); len(actual) != len(expected) {
+		t.Errorf("expected %d transactions, got %d", len(expected), len(actual))
+	}
+
+	for _, transaction := range expected {
+		split := fireflyServer.TransactionByExternalId(transaction.ExternalId)
+		if split == nil {
+			t.Errorf("transaction with external id %s not created", transaction.ExternalId)
+			continue
+		}
+
+		actual := &transactionScenario{
+			ExternalId:  split.ExternalId,
+			Type:        split.Type,
+			Amount:      split.Amount,
+			Description: split.Description,
+			Source:      split.SourceName,
+			Destination: split.DestinationName,
+		}
+		if *actual != *transaction {
+			t.Errorf("transaction %s does not match\nexpected: %+v\nactual:   %+v", transaction.ExternalId, *transaction, *actual)
+		}
+
+		if !containsTag(split.Tags, "bunq-sync") {
+			t.Errorf("transaction %s misses the sync tag", transaction.ExternalId)
+		}
+	}
+}
+
+func containsTag(tags []string, tag string) bool {
+	for _, item := range tags {
+		if item == tag {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,724 @@
+// Package syncer copies the payments of all bunq accounts of a profile to Firefly III
+package syncer
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/bunq"
+	"github.com/daanvanberkel/fireflyiiibunq/firefly"
+	"github.com/daanvanberkel/fireflyiiibunq/metrics"
+	"github.com/daanvanberkel/fireflyiiibunq/tracing"
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// SyncProfile syncs all payments since date of the bunq user of the profile to Firefly III, and retries the queued
+// failed payments that are due. The report is also returned when the sync failed.
+func SyncProfile(ctx context.Context, config *util.Config, date time.Time, log *logrus.Entry) (*Report, error) {
+	return syncProfile(ctx, config, date, false, log)
+}
+
+// RetryFailedPayments retries every queued failed payment of the profile now, without syncing new payments
+func RetryFailedPayments(ctx context.Context, config *util.Config, log *logrus.Entry) (*Report, error) {
+	return syncProfile(ctx, config, time.Time{}, true, log)
+}
+
+func syncProfile(ctx context.Context, config *util.Config, date time.Time, retryOnly bool, log *logrus.Entry) (report *Report, err error) {
+	ctx, span := tracing.Start(ctx, "sync profile",
+		attribute.String("profile", config.Profile),
+		attribute.String("date", date.Format("2006-01-02")),
+		attribute.Bool("retry_only", retryOnly),
+	)
+	report = newReport(config, date)
+	report.RetryOnly = retryOnly
+	defer func() {
+		report.finish(err)
+		tracing.End(span, err)
+	}()
+
+	queue, err := LoadFailedQueue(config)
+	if err != nil {
+		return report, err
+	}
+	defer func() {
+		if saveErr := queue.Save(); saveErr != nil {
+			log.WithError(saveErr).Error("Cannot store failed payments")
+			if err == nil {
+				err = saveErr
+			}
+		}
+	}()
+
+	settled, err := loadSettledActions(config)
+	if err != nil {
+		return report, err
+	}
+	defer func() {
+		if saveErr := settled.save(); saveErr != nil {
+			log.WithError(saveErr).Error("Cannot store settled card authorisations")
+			if err == nil {
+				err = saveErr
+			}
+		}
+	}()
+
+	fireflyClient, err := firefly.NewFireflyClient(config, log)
+	if err != nil {
+		return report, err
+	}
+
+	bunqClient, err := bunq.NewBunqClient(config, log)
+	if err != nil {
+		return report, err
+	}
+	defer func() {
+		report.SessionRestarts = bunqClient.SessionRestarts()
+		if err := bunqClient.Close(); err != nil {
+			log.WithError(err).Warn("Cannot close bunq session")
+		}
+	}()
+
+	user, err := bunqClient.GetUser()
+	if err != nil {
+		return report, err
+	}
+
+	log.WithFields(logrus.Fields{
+		"userType": user.Type,
+		"userName": user.Name,
+	}).Info("Syncing accounts of bunq user")
+
+	bankAccounts, err := bunqClient.GetMonetaryBankAccounts(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	// Asset accounts are created before accounts are synced concurrently, so a transfer to an account that is new in
+	// Firefly III still finds the asset account of the other side
+	type accountJob struct {
+		bankAccount   *bunq.BunqMonetaryAccountBank
+		assetAccount  *firefly.AccountRead
+		accountReport *AccountReport
+	}
+	jobs := []*accountJob{}
+	for _, bankAccount := range bankAccounts {
+		if retryOnly && len(queue.due(bankAccount.Id, time.Now(), true)) == 0 {
+			continue
+		}
+
+		accountReport := report.addAccount(bankAccount.Id)
+		assetAccount, err := prepareAccount(ctx, config, user, fireflyClient, bankAccount, accountReport, log)
+		if err != nil {
+			accountReport.Error = err.Error()
+			continue
+		}
+
+		jobs = append(jobs, &accountJob{bankAccount: bankAccount, assetAccount: assetAccount, accountReport: accountReport})
+	}
+
+	// Accounts are synced by a pool of workers, the report lists them in the order of bunq
+	locks := &profileLocks{}
+	pending := make(chan *accountJob)
+	var wg sync.WaitGroup
+	for worker := 0; worker < max(config.SyncConfig.Concurrency, 1); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range pending {
+				syncAccount(ctx, config, bunqClient, fireflyClient, job.bankAccount, job.assetAccount, date, retryOnly, report, job.accountReport, queue, settled, locks, log)
+			}
+		}()
+	}
+
+	for _, job := range jobs {
+		pending <- job
+	}
+	close(pending)
+	wg.Wait()
+
+	return report, nil
+}
+
+// profileLocks serialize the Firefly III writes that accounts synced at the same time can race on
+type profileLocks struct {
+	transfers      sync.Mutex
+	counterparties sync.Mutex
+}
+
+// accountSync holds what the payments of a bunq account share while they are synced
+type accountSync struct {
+	config            *util.Config
+	bunqClient        *bunq.BunqClient
+	fireflyClient     *firefly.FireflyClient
+	bankAccount       *bunq.BunqMonetaryAccountBank
+	iban              string
+	assetAccount      *firefly.AccountRead
+	mastercardActions []*bunq.BunqMastercardAction
+	report            *Report
+	accountReport     *AccountReport
+	queue             *FailedQueue
+	settledActions    *settledActions
+	locks             *profileLocks
+
+	// Transfers created for payments of this account are never the other side of another payment of this account
+	syncedPaymentIds map[string]bool
+	// Payments synced in this run are not retried from the queue in the same run
+	processedPaymentIds map[int]bool
+}
+
+// prepareAccount finds or creates the Firefly III asset account of a bunq account
+func prepareAccount(ctx context.Context, config *util.Config, user *bunq.BunqUser, fireflyClient *firefly.FireflyClient, bankAccount *bunq.BunqMonetaryAccountBank, accountReport *AccountReport, log *logrus.Entry) (assetAccount *firefly.AccountRead, err error) {
+	ctx, span := tracing.Start(ctx, "prepare account", attribute.Int("bunq.account_id", bankAccount.Id))
+	defer func() { tracing.End(span, err) }()
+
+	iban, err := bankAccount.GetIBAN()
+	if err != nil {
+		log.WithError(err).WithField("bankAccount", bankAccount).Error("Cannot get IBAN for bankaccount")
+		return nil, err
+	}
+	span.SetAttributes(attribute.String("iban", iban))
+	accountReport.Iban = iban
+
+	assetAccount, err = fireflyClient.FindOrCreateAssetAccount(ctx, iban, &firefly.AccountRequest{
+		Name:         assetAccountName(config, user, bankAccount),
+		Type:         firefly.AssetType,
+		Iban:         iban,
+		AccountRole:  firefly.DefaultAsset,
+		CurrencyCode: bankAccount.Currency,
+		Notes:        "Created by Bunq sync on" + time.Now().String(),
+	})
+	if err != nil {
+		log.WithError(err).WithField("iban", iban).Error("Cannot find or create firefly account")
+		return nil, err
+	}
+
+	if assetAccount.Attributes.CurrencyCode != "" && assetAccount.Attributes.CurrencyCode != bankAccount.Currency {
+		log.WithFields(logrus.Fields{
+			"iban":            iban,
+			"bunqCurrency":    bankAccount.Currency,
+			"fireflyCurrency": assetAccount.Attributes.CurrencyCode,
+		}).Error("Currency of firefly account does not match bunq account, skipping account")
+		return nil, errors.New("currency of firefly account does not match bunq account")
+	}
+
+	return assetAccount, nil
+}
+
+// syncAccount syncs the payments since date of a bunq account and retries its failed payments, failures are logged
+// and skip the payment or account. With retryOnly only the failed payments are synced. The payments of an account are
+// synced one by one, oldest last like bunq returns them, so their Firefly III writes are always in the same order.
+func syncAccount(ctx context.Context, config *util.Config, bunqClient *bunq.BunqClient, fireflyClient *firefly.FireflyClient, bankAccount *bunq.BunqMonetaryAccountBank, assetAccount *firefly.AccountRead, date time.Time, retryOnly bool, report *Report, accountReport *AccountReport, queue *FailedQueue, settled *settledActions, locks *profileLocks, log *logrus.Entry) {
+	iban := accountReport.Iban
+	ctx, span := tracing.Start(ctx, "sync account",
+		attribute.Int("bunq.account_id", bankAccount.Id),
+		attribute.String("iban", iban),
+	)
+	var err error
+	defer func() {
+		if err != nil {
+			accountReport.Error = err.Error()
+		}
+		tracing.End(span, err)
+	}()
+
+	// Retried payments can be older than date, their pending card transactions have to be found as well
+	mastercardActions, err := loadMastercardActions(ctx, bunqClient, bankAccount.Id, queue.oldestCreated(bankAccount.Id, date))
+	if err != nil {
+		log.WithError(err).WithField("iban", iban).Error("Cannot load mastercard actions from bunq")
+		return
+	}
+	if !retryOnly {
+		syncMastercardActions(ctx, fireflyClient, locks, settled, mastercardActions, assetAccount, iban, log)
+	}
+
+	account := &accountSync{
+		config:              config,
+		bunqClient:          bunqClient,
+		fireflyClient:       fireflyClient,
+		bankAccount:         bankAccount,
+		iban:                iban,
+		assetAccount:        assetAccount,
+		mastercardActions:   mastercardActions,
+		report:              report,
+		accountReport:       accountReport,
+		queue:               queue,
+		settledActions:      settled,
+		locks:               locks,
+		syncedPaymentIds:    map[string]bool{},
+		processedPaymentIds: map[int]bool{},
+	}
+
+	accountFailed := false
+	if !retryOnly {
+		accountFailed, err = account.syncPayments(ctx, date, log)
+	}
+	accountFailed = account.retryFailedPayments(ctx, retryOnly, log) || accountFailed
+
+	if !accountFailed {
+		metrics.LastSuccessfulSync.WithLabelValues(config.Profile, iban).SetToCurrentTime()
+	}
+}
+
+// syncPayments syncs the payments of the account since date, newest first, and reports whether a payment failed
+func (a *accountSync) syncPayments(ctx context.Context, date time.Time, log *logrus.Entry) (bool, error) {
+	accountFailed := false
+	lastId := 0
+	processTransactions := true
+	for processTransactions {
+		payments, err := a.bunqClient.GetPayments(ctx, a.bankAccount.Id, lastId)
+		if err != nil {
+			log.WithError(err).WithField("iban", a.iban).Error("Cannot load payments from bunq, skipping rest of account")
+			return true, err
+		}
+
+		if len(payments) == 0 {
+			// No payments found, stop loop
+			break
+		}
+
+		for _, payment := range payments {
+			a.syncedPaymentIds[strconv.Itoa(payment.Id)] = true
+			paymentLogger := log.WithFields(logrus.Fields{
+				"paymentId":  payment.Id,
+				"sourceIban": payment.Alias.Iban,
+				"targetIban": payment.CounterpartyAlias.Iban,
+				"date":       payment.Created,
+			})
+
+			if date.Compare(payment.Created.Time) >= 1 {
+				processTransactions = false
+				paymentLogger.Info("Received payment too far in the past, stop processing")
+				paymentReport := newPaymentReport(payment)
+				paymentReport.Outcome = SkippedFilter
+				a.report.addPayment(a.accountReport, paymentReport)
+				continue
+			}
+
+			paymentLogger.Info("Start processing payment")
+			outcome := a.processPayment(ctx, payment, false, paymentLogger)
+			accountFailed = accountFailed || outcome == Failed
+		}
+
+		lastId = payments[len(payments)-1].Id
+	}
+
+	return accountFailed, nil
+}
+
+// retryFailedPayments syncs the queued failed payments of the account that are due, or all with force, and reports
+// whether a payment failed again
+func (a *accountSync) retryFailedPayments(ctx context.Context, force bool, log *logrus.Entry) bool {
+	accountFailed := false
+	for _, failed := range a.queue.due(a.bankAccount.Id, time.Now(), force) {
+		if a.processedPaymentIds[failed.PaymentId] {
+			continue
+		}
+
+		paymentLogger := log.WithFields(logrus.Fields{
+			"paymentId": failed.PaymentId,
+			"attempts":  failed.Attempts,
+		})
+		paymentLogger.Info("Retrying failed payment")
+
+		payment, err := a.bunqClient.GetPayment(ctx, a.bankAccount.Id, failed.PaymentId)
+		if err != nil {
+			paymentLogger.WithError(err).Error("Cannot load failed payment from bunq")
+			paymentReport := &PaymentReport{
+				PaymentId:    failed.PaymentId,
+				Amount:       failed.Amount,
+				Currency:     failed.Currency,
+				Description:  failed.Description,
+				Counterparty: failed.Counterparty,
+				Outcome:      Failed,
+				Error:        err.Error(),
+				Retry:        true,
+			}
+			a.report.addPayment(a.accountReport, paymentReport)
+			a.queue.recordFailure(a.accountReport, paymentReport, failed.Created, time.Now())
+			accountFailed = true
+			continue
+		}
+
+		outcome := a.processPayment(ctx, payment, true, paymentLogger)
+		accountFailed = accountFailed || outcome == Failed
+	}
+
+	return accountFailed
+}
+
+// processPayment syncs the payment, adds it to the report and queues it when it failed
+func (a *accountSync) processPayment(ctx context.Context, payment *bunq.BunqPayment, retry bool, paymentLogger *logrus.Entry) Outcome {
+	a.processedPaymentIds[payment.Id] = true
+	metrics.PaymentsSeen.WithLabelValues(a.config.Profile, a.iban).Inc()
+
+	paymentCtx, paymentSpan := tracing.Start(ctx, "sync payment",
+		attribute.Int("bunq.payment_id", payment.Id),
+		attribute.String("amount", payment.Amount.Value),
+		attribute.Bool("retry", retry),
+	)
+	paymentReport := newPaymentReport(payment)
+	paymentReport.Retry = retry
+	outcome, err := a.syncPayment(paymentCtx, payment, paymentReport, paymentLogger)
+	paymentSpan.SetAttributes(attribute.String("outcome", string(outcome)))
+	tracing.End(paymentSpan, err)
+
+	paymentReport.Outcome = outcome
+	if err != nil {
+		paymentReport.Error = err.Error()
+	}
+	a.report.addPayment(a.accountReport, paymentReport)
+	metrics.Payments.WithLabelValues(a.config.Profile, a.iban, outcome.metricsResult()).Inc()
+
+	if outcome == Failed {
+		failed := a.queue.recordFailure(a.accountReport, paymentReport, payment.Created.Time, time.Now())
+		paymentLogger.WithField("nextAttemptAt", failed.NextAttemptAt).Warn("Queued failed payment for retry")
+	} else if a.queue.Drop(payment.Id) && retry {
+		paymentLogger.Info("Retried failed payment")
+	}
+
+	return outcome
+}
+
+// syncPayment creates the Firefly III transaction for the payment and returns the outcome. The id of the transaction
+// and whether a counterparty account was created are added to the payment report.
+func (a *accountSync) syncPayment(ctx context.Context, payment *bunq.BunqPayment, paymentReport *PaymentReport, paymentLogger *logrus.Entry) (Outcome, error) {
+	isWithdrawal := payment.Amount.Value[0] == '-'
+
+	transactions, err := a.fireflyClient.SearchTransactions(ctx, &firefly.TransactionSearchQuery{
+		ExternalIdIs: strconv.Itoa(payment.Id),
+		AccountNrIs:  a.iban,
+	}, 1)
+	if err != nil {
+		paymentLogger.WithError(err).Error("Error while fetching transaction from firefly")
+		return Failed, err
+	}
+
+	if transactions.Meta.Pagination.Total > 0 {
+		// Transaction already in Firefly, only pick up attachments added later on
+		syncPaymentAttachments(ctx, a.config, a.bunqClient, a.fireflyClient, a.bankAccount.Id, payment, transactions.Data[0], paymentLogger)
+		syncPaymentNotes(ctx, a.config, a.bunqClient, a.fireflyClient, a.bankAccount.Id, payment, transactions.Data[0], paymentLogger)
+
+		paymentLogger.Info("Payment already in firefly, skipping payment")
+		paymentReport.FireflyId = transactions.Data[0].Id
+		return SkippedDuplicate, nil
+	}
+
+	notes, err := loadPaymentNotes(ctx, a.config, a.bunqClient, a.bankAccount.Id, payment)
+	if err != nil {
+		paymentLogger.WithError(err).Error("Cannot load notes of payment from bunq")
+		return Failed, err
+	}
+
+	action := findMastercardActionForPayment(a.mastercardActions, payment)
+	if action != nil {
+		transaction, err := reconcilePendingTransaction(ctx, a.fireflyClient, action, payment, notes, a.iban, paymentLogger)
+		if err != nil {
+			paymentLogger.WithError(err).Error("Cannot reconcile pending card transaction in firefly")
+			return Failed, err
+		}
+
+		if transaction != nil {
+			paymentLogger.WithField("mastercardActionId", action.Id).Info("Settled pending card transaction in firefly")
+			a.settledActions.record(action, payment)
+			syncPaymentAttachments(ctx, a.config, a.bunqClient, a.fireflyClient, a.bankAccount.Id, payment, transaction, paymentLogger)
+			paymentReport.FireflyId = transaction.Id
+			return Created, nil
+		}
+	}
+
+	counterPartyAssetAccount, err := findCounterPartyAssetAccount(ctx, a.fireflyClient, payment, paymentLogger)
+	if err != nil {
+		paymentLogger.WithError(err).Error("Failed searching for counterparty asset account, skipping payment")
+		return Failed, err
+	}
+
+	if counterPartyAssetAccount != nil {
+		transaction, created, err := a.findOrCreateTransfer(ctx, payment, action, notes, counterPartyAssetAccount, paymentLogger)
+		if err != nil {
+			return Failed, err
+		}
+
+		if !created {
+			paymentLogger.WithField("transactionId", transaction.Id).Info("Transfer already created for counterparty account, skipping payment")
+			paymentReport.FireflyId = transaction.Id
+			return SkippedDuplicate, nil
+		}
+
+		paymentLogger.Info("Created new transaction in firefly")
+		a.settledActions.record(action, payment)
+		syncPaymentAttachments(ctx, a.config, a.bunqClient, a.fireflyClient, a.bankAccount.Id, payment, transaction, paymentLogger)
+		paymentReport.FireflyId = transaction.Id
+		return Created, nil
+	}
+
+	// Make a normal withdrawal or deposit
+	var accountType firefly.AccountType
+	if isWithdrawal {
+		accountType = firefly.ExpenseType
+	} else {
+		accountType = firefly.RevenueType
+	}
+
+	account, created, err := findOrCreateAccountForCounterparty(ctx, a.fireflyClient, a.locks, payment.CounterpartyAlias, accountType, paymentLogger)
+	if err != nil {
+		paymentLogger.WithError(err).Error("Cannot search for expense or revenue accounts by iban in firefly")
+		return Failed, err
+	}
+	paymentReport.NewCounterparty = created
+
+	var transactionType firefly.TransactionType
+	if isWithdrawal {
+		transactionType = firefly.WithdrawalTransaction
+	} else {
+		transactionType = firefly.DepositTransaction
+	}
+
+	transaction, err := createTransactionSplitForPayment(ctx, transactionType, payment, action, notes, a.assetAccount.Id, account.Id, a.fireflyClient, false)
+	if err != nil {
+		paymentLogger.WithError(err).Error("Cannot create new transaction in firefly")
+		return Failed, err
+	}
+
+	paymentLogger.Info("Created new transaction in firefly")
+	a.settledActions.record(action, payment)
+	syncPaymentAttachments(ctx, a.config, a.bunqClient, a.fireflyClient, a.bankAccount.Id, payment, transaction, paymentLogger)
+	paymentReport.FireflyId = transaction.Id
+	return Created, nil
+}
+
+// findOrCreateTransfer returns the transfer created for the other side of the payment, or creates the transfer. The
+// other side can be synced by another account at the same time, so only one account searches and creates at a time.
+func (a *accountSync) findOrCreateTransfer(ctx context.Context, payment *bunq.BunqPayment, action *bunq.BunqMastercardAction, notes string, counterPartyAssetAccount *firefly.AccountRead, paymentLogger *logrus.Entry) (*firefly.TransactionRead, bool, error) {
+	a.locks.transfers.Lock()
+	defer a.locks.transfers.Unlock()
+
+	existingTransfer, err := findExistingTransfer(ctx, a.fireflyClient, payment, a.iban, a.syncedPaymentIds)
+	if err != nil {
+		paymentLogger.WithError(err).Error("Cannot search for existing transfer in firefly")
+		return nil, false, err
+	}
+
+	if existingTransfer != nil {
+		return existingTransfer, false, nil
+	}
+
+	// Make a transfer between two asset accounts
+	transaction, err := createTransactionSplitForPayment(ctx, firefly.TransferTransaction, payment, action, notes, a.assetAccount.Id, counterPartyAssetAccount.Id, a.fireflyClient, true)
+	if err != nil {
+		paymentLogger.WithError(err).Error("Cannot create new transaction in firefly")
+		return nil, false, err
+	}
+
+	return transaction, true, nil
+}
+
+func assetAccountName(config *util.Config, user *bunq.BunqUser, bankAccount *bunq.BunqMonetaryAccountBank) string {
+	// Adding description after display name to prevent naming collisions
+	name := bankAccount.DisplayName + " - " + bankAccount.Description
+
+	if config.FireflyConfig.AccountNamePrefix != nil {
+		return *config.FireflyConfig.AccountNamePrefix + name
+	}
+
+	// Keep company accounts apart from the personal accounts in the same firefly administration
+	if user.Type == bunq.UserCompanyType && user.Name != "" {
+		return user.Name + " - " + name
+	}
+
+	return name
+}
+
+func findCounterPartyAssetAccount(ctx context.Context, fireflyClient *firefly.FireflyClient, payment *bunq.BunqPayment, log *logrus.Entry) (*firefly.AccountRead, error) {
+	if payment.CounterpartyAlias.Iban == "" {
+		return nil, nil
+	}
+
+	counterpartyAssetAccounts, err := fireflyClient.SearchAccounts(ctx, payment.CounterpartyAlias.Iban, firefly.IbanField, firefly.AssetType, 1)
+	if err != nil {
+		log.WithError(err).Error("Failed searching for counterparty asset account, skipping payment")
+		return nil, err
+	}
+
+	if counterpartyAssetAccounts.Meta.Pagination.Total == 0 {
+		return nil, nil
+	}
+
+	return counterpartyAssetAccounts.Data[0], nil
+}
+
+// findExistingTransfer returns the transfer created for the other side of an internal payment. bunq has a payment on
+// both accounts, the transfer is only created for the account that is synced first.
+func findExistingTransfer(ctx context.Context, fireflyClient *firefly.FireflyClient, payment *bunq.BunqPayment, iban string, syncedPaymentIds map[string]bool) (*firefly.TransactionRead, error) {
+	transactions, err := fireflyClient.SearchTransactions(ctx, &firefly.TransactionSearchQuery{
+		AccountNrIs: payment.CounterpartyAlias.Iban,
+		TypeIs:      firefly.TransferTransaction,
+		AmountIs:    strings.Trim(payment.Amount.Value, "-"),
+		DateOn:      &payment.Created.Time,
+	}, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	sourceIban, destinationIban := iban, payment.CounterpartyAlias.Iban
+	if payment.Amount.Value[0] != '-' {
+		sourceIban, destinationIban = destinationIban, sourceIban
+	}
+
+	for _, transaction := range transactions.Data {
+		for _, split := range transaction.Attributes.Transactions {
+			if split.SourceIban == sourceIban && split.DestinationIban == destinationIban && !syncedPaymentIds[split.ExternalId] {
+				return transaction, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// findOrCreateAccountForCounterparty returns the expense or revenue account of the counterparty and whether it was
+// created. Accounts synced at the same time can pay the same new counterparty, which must be created only once.
+func findOrCreateAccountForCounterparty(ctx context.Context, fireflyClient *firefly.FireflyClient, locks *profileLocks, counterparty *bunq.BunqPaymentMonetaryAccount, accountType firefly.AccountType, log *logrus.Entry) (*firefly.AccountRead, bool, error) {
+	locks.counterparties.Lock()
+	defer locks.counterparties.Unlock()
+
+	if counterparty.Iban != "" {
+		// Find accounts by iban
+		accounts, err := fireflyClient.SearchAccounts(ctx, counterparty.Iban, firefly.IbanField, accountType, 1)
+		if err != nil {
+			log.WithError(err).Error("Cannot search for expense or revenue accounts by iban in firefly")
+			return nil, false, err
+		}
+
+		if accounts.Meta.Pagination.Total > 0 {
+			return accounts.Data[0], false, nil
+		}
+	}
+
+	if counterparty.DisplayName != "" {
+		// Find accounts by name
+		accounts, err := fireflyClient.SearchAccounts(ctx, counterparty.DisplayName, firefly.NameField, accountType, 1)
+		if err != nil {
+			log.WithError(err).Error("Cannot search for expense or revenue accounts by name in firefly")
+			return nil, false, err
+		}
+
+		if accounts.Meta.Pagination.Total > 0 {
+			return accounts.Data[0], false, nil
+		}
+	}
+
+	// Create new account in firefly
+	accountRequest := &firefly.AccountRequest{
+		Name:  counterparty.DisplayName,
+		Type:  accountType,
+		Iban:  counterparty.Iban,
+		Notes: "Created by Bunq sync on " + time.Now().String(),
+	}
+	account, err := fireflyClient.CreateAccount(ctx, accountRequest)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return account, true, nil
+}
+
+func createTransactionSplitForPayment(ctx context.Context, transactionType firefly.TransactionType, payment *bunq.BunqPayment, action *bunq.BunqMastercardAction, notes string, sourceId string, destinationId string, fireflyClient *firefly.FireflyClient, errorIfDuplicateHash bool) (*firefly.TransactionRead, error) {
+	var description string
+	if payment.Description == "" {
+		description = "(empty)"
+	} else {
+		description = payment.Description
+	}
+
+	isWithdrawal := payment.Amount.Value[0] == '-'
+
+	oldSourceId := sourceId
+	if !isWithdrawal {
+		sourceId = destinationId
+		destinationId = oldSourceId
+	}
+
+	transaction := &firefly.TransactionSplitRequest{
+		Type:              transactionType,
+		Date:              &payment.Created.Time,
+		Amount:            strings.Trim(payment.Amount.Value, "-"),
+		Description:       description,
+		CurrencyCode:      payment.Amount.Currency,
+		SourceId:          sourceId,
+		DestinationId:     destinationId,
+		Notes:             notes,
+		ExternalId:        strconv.Itoa(payment.Id),
+		InternalReference: payment.MerchantReference,
+		Tags:              append([]string{syncTag}, paymentTags(payment)...),
+	}
+	setPaymentDetails(transaction, payment)
+
+	if action != nil {
+		// Card payments in another currency keep the amount in the currency of the merchant
+		transaction.ForeignAmount, transaction.ForeignCurrencyCode = foreignAmountForPayment(action, payment)
+	}
+
+	response, err := fireflyClient.CreateTransaction(ctx, &firefly.TransactionRequest{
+		Transactions:         []*firefly.TransactionSplitRequest{transaction},
+		ErrorIfDuplicateHash: errorIfDuplicateHash,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Data, nil
+}
+
+// Zoom level used by firefly to show the location of a payment on the map
+const paymentLocationZoomLevel = 15
+
+// Payment types of bunq mapped to the tag added to the firefly transaction
+var paymentTypeTags = map[string]string{
+	"BUNQ":       "BUNQ",
+	"IDEAL":      "IDEAL",
+	"MASTERCARD": "MASTERCARD",
+	"EBA_SCT":    "SEPA",
+	"EBA_SDD":    "SEPA",
+	"SWIFT":      "SWIFT",
+	"SOFORT":     "SOFORT",
+}
+
+func paymentTags(payment *bunq.BunqPayment) []string {
+	tags := []string{}
+	if tag, exists := paymentTypeTags[payment.Type]; exists {
+		tags = append(tags, tag)
+	}
+
+	return append(tags, merchantCategoryTags(payment.CounterpartyAlias)...)
+}
+
+// setPaymentDetails copies the location and sepa details bunq knows about the payment to the transaction
+func setPaymentDetails(transaction *firefly.TransactionSplitRequest, payment *bunq.BunqPayment) {
+	if payment.Geolocation != nil && (payment.Geolocation.Latitude != 0 || payment.Geolocation.Longitude != 0) {
+		latitude := payment.Geolocation.Latitude
+		longitude := payment.Geolocation.Longitude
+		zoomLevel := paymentLocationZoomLevel
+
+		transaction.Latitude = &latitude
+		transaction.Longitude = &longitude
+		transaction.ZoomLevel = &zoomLevel
+	}
+
+	if payment.Type == "EBA_SCT" || payment.Type == "EBA_SDD" {
+		if payment.BatchId > 0 {
+			transaction.SepaBatchId = strconv.Itoa(payment.BatchId)
+		}
+
+		transaction.SepaCtId = payment.EndToEndId
+
+		if payment.CounterpartyAlias != nil {
+			transaction.SepaCountry = payment.CounterpartyAlias.Country
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package syncer_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/bunqtest"
+	"github.com/daanvanberkel/fireflyiiibunq/fireflytest"
+	"github.com/daanvanberkel/fireflyiiibunq/syncer"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSyncSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previous)
+
+	bunqServer, err := bunqtest.Start(bunqtest.DefaultFixtures())
+	if err != nil {
+		t.Fatalf("cannot start fake bunq server: %v", err)
+	}
+	defer bunqServer.Close()
+
+	fireflyServer := fireflytest.Start("test-token")
+	defer fireflyServer.Close()
+
+	log := logrus.New()
+	log.Out = io.Discard
+
+	if _, err := syncer.SyncProfile(context.Background(), testConfig(t, bunqServer, fireflyServer), time.Now().AddDate(0, 0, -30), logrus.NewEntry(log)); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	spans := recorder.Ended()
+	names := map[string]int{}
+	for _, span := range spans {
+		names[span.Name()]++
+	}
+
+	if names["sync profile"] != 1 || names["sync account"] != 2 || names["sync payment"] == 0 {
+		t.Errorf("expected a profile span, two account spans and payment spans, got %v", names)
+	}
+
+	var profileSpan sdktrace.ReadOnlySpan
+	for _, span := range spans {
+		if span.Name() == "sync profile" {
+			profileSpan = span
+		}
+	}
+	if profileSpan == nil {
+		t.Fatal("missing profile span")
+	}
+
+	traceId := profileSpan.SpanContext().TraceID().String()
+	for _, request := range fireflyServer.Requests() {
+		if request.TraceId != traceId {
+			t.Errorf("firefly request %s %s has trace id %q, expected %q", request.Method, request.Path, request.TraceId, traceId)
+		}
+	}
+}
@@ -1,62 +1,410 @@
 package util
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type BunqConfig struct {
 	ApiBaseUrl            string
 	ApiKey                string
+	OAuthClientId         string
+	OAuthClientSecret     string
+	OAuthRedirectUrl      string
+	OAuthAuthorizeUrl     string
+	OAuthTokenUrl         string
+	OAuthTokenFileName    string
 	PrivateKeyFileName    string
 	PublicKeyFileName     string
+	KeyBitSize            int
 	InstallationFileName  string
 	DeviceServerFileName  string
 	SessionServerFileName string
 	UserAgent             string
 	PermittedIps          []string
+	DeleteSessionOnExit   bool
+	MaxReregistrations    int
+	RequestsPerSecond     float64
 }
 
 type FireflyConfig struct {
-	ApiBaseUrl string
-	ApiKey     string
+	ApiBaseUrl         string
+	ApiKey             string
+	AccountNamePrefix  *string
+	OAuthBaseUrl       string
+	OAuthClientId      string
+	OAuthClientSecret  string
+	OAuthRedirectUrl   string
+	OAuthTokenFileName string
+	TokenExpiryWarning time.Duration
+}
+
+type SyncConfig struct {
+	SyncAttachments bool
+	SyncNotes       bool
+	SyncNotesToBunq bool
+	ReportFileName  string
+	// Number of accounts synced at the same time
+	Concurrency int
+	// Payments that failed to import are retried in later runs, waiting RetryBackoff after the first failure and
+	// twice as long after every next failure
+	FailedPaymentsFileName string
+	RetryBackoff           time.Duration
+	MaxRetryAttempts       int
+	// Card authorisations settled by a payment, so an authorisation bunq still reports as pending is not added again
+	SettledCardActionsFileName string
+	// Commands that change the storage hold the lock file
+	LockFileName string
+}
+
+// NotifyConfig holds the notifiers to send events of the sync to and when to send them. Notifiers without a url
+// or host are disabled.
+type NotifyConfig struct {
+	SmtpHost        string
+	SmtpPort        int
+	SmtpUsername    string
+	SmtpPassword    string
+	SmtpFrom        string
+	SmtpTo          []string
+	WebhookUrl      string
+	ChatWebhookUrl  string
+	NtfyUrl         string
+	NtfyToken       string
+	GotifyUrl       string
+	GotifyToken     string
+	AmountThreshold float64
+	NewCounterparty bool
+	SessionRestarts int
+}
+
+type CassetteMode string
+
+const (
+	CassetteRecord CassetteMode = "record"
+	CassetteReplay CassetteMode = "replay"
+)
+
+// CassetteConfig enables recording the http requests of a sync to a file, or replaying them from it
+type CassetteConfig struct {
+	Mode     CassetteMode
+	Location string
 }
 
 type Config struct {
+	Profile         string
 	BunqConfig      *BunqConfig
 	FireflyConfig   *FireflyConfig
+	SyncConfig      *SyncConfig
+	NotifyConfig    *NotifyConfig
+	CassetteConfig  *CassetteConfig
 	StorageLocation string
+	// SharedCredentials lists the credential variables the profile takes from the variables shared by all profiles
+	SharedCredentials []string
+}
+
+// ProcessConfig holds the settings of the process and the config of every profile it syncs
+type ProcessConfig struct {
+	Profiles           []*Config
+	ProfilesConcurrent bool
+	SyncInterval       time.Duration
+	ReadyMaxSyncAge    time.Duration
+	ReportOutput       ReportOutput
+	MetricsConfig      *MetricsConfig
+	TracingConfig      *TracingConfig
+}
+
+type ReportOutput string
+
+const (
+	ReportOutputJson    ReportOutput = "json"
+	ReportOutputSummary ReportOutput = "summary"
+)
+
+type TracingConfig struct {
+	OtlpEndpoint string
+	ServiceName  string
+}
+
+type MetricsConfig struct {
+	ListenAddress  string
+	PushgatewayUrl string
+	PushgatewayJob string
+}
+
+// profileEnv looks up environment variables for a profile. Variables prefixed with the profile name, like
+// ALICE_BUNQ_API_KEY, take precedence over the unprefixed variables, which are shared by all profiles.
+type profileEnv struct {
+	prefix string
+	// shared lists the credential variables a profile took from the unprefixed variables
+	shared []string
+}
+
+// Variables holding the credentials of the bunq user and Firefly III, a profile is expected to have its own
+var credentialVariables = map[string]bool{
+	"BUNQ_API_KEY":                true,
+	"BUNQ_OAUTH_CLIENT_ID":        true,
+	"BUNQ_OAUTH_CLIENT_SECRET":    true,
+	"FIREFLY_API_KEY":             true,
+	"FIREFLY_OAUTH_CLIENT_ID":     true,
+	"FIREFLY_OAUTH_CLIENT_SECRET": true,
+}
+
+func (e *profileEnv) LookupEnv(key string) (string, bool) {
+	if e.prefix != "" {
+		if value, exists := os.LookupEnv(e.prefix + key); exists {
+			return value, true
+		}
+	}
+
+	value, exists := os.LookupEnv(key)
+	if exists && value != "" && e.prefix != "" && credentialVariables[key] {
+		e.shared = append(e.shared, key)
+	}
+
+	return value, exists
+}
+
+func LoadProcessConfig() (*ProcessConfig, error) {
+	profilesConcurrent, err := lookupBoolEnv(&profileEnv{}, "PROFILES_CONCURRENT", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without an interval the process syncs once and exits
+	var syncInterval time.Duration
+	if value, exists := os.LookupEnv("SYNC_INTERVAL"); exists && value != "" {
+		syncInterval, err = time.ParseDuration(value)
+		if err != nil || syncInterval <= 0 {
+			return nil, errors.New("sync interval must be a positive duration like 1h")
+		}
+	}
+
+	// Ready means the last sync succeeded within this age, by default two intervals or a day and an hour for runs
+	// started by cron
+	readyMaxSyncAge := 25 * time.Hour
+	if syncInterval > 0 {
+		readyMaxSyncAge = 2 * syncInterval
+	}
+	if value, exists := os.LookupEnv("READY_MAX_SYNC_AGE"); exists && value != "" {
+		readyMaxSyncAge, err = time.ParseDuration(value)
+		if err != nil || readyMaxSyncAge <= 0 {
+			return nil, errors.New("ready max sync age must be a positive duration like 2h")
+		}
+	}
+
+	// The report of a run is always stored, printing it to stdout is optional
+	reportOutput, _ := os.LookupEnv("REPORT_OUTPUT")
+	switch ReportOutput(reportOutput) {
+	case "", ReportOutputJson, ReportOutputSummary:
+	default:
+		return nil, errors.New("report output must be json or summary")
+	}
+
+	metricsConfig := LoadMetricsConfig()
+	tracingConfig := loadTracingConfig()
+
+	profileNames, exists := os.LookupEnv("PROFILES")
+	if !exists || strings.TrimSpace(profileNames) == "" {
+		config, err := LoadConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		return &ProcessConfig{
+			Profiles:           []*Config{config},
+			ProfilesConcurrent: profilesConcurrent,
+			SyncInterval:       syncInterval,
+			ReadyMaxSyncAge:    readyMaxSyncAge,
+			ReportOutput:       ReportOutput(reportOutput),
+			MetricsConfig:      metricsConfig,
+			TracingConfig:      tracingConfig,
+		}, nil
+	}
+
+	profiles := []*Config{}
+	// Profiles are told apart by the upper-cased prefix of their variables, names differing only in case would share
+	// their credentials
+	seen := map[string]string{}
+	for _, profile := range strings.Split(profileNames, ",") {
+		profile = strings.TrimSpace(profile)
+		if profile == "" {
+			continue
+		}
+
+		if other, exists := seen[strings.ToUpper(profile)]; exists {
+			if other == profile {
+				return nil, errors.New("profile " + profile + " is configured more than once")
+			}
+			return nil, errors.New("profiles " + other + " and " + profile + " only differ in case, they would share the variables prefixed with " + strings.ToUpper(profile) + "_")
+		}
+		seen[strings.ToUpper(profile)] = profile
+
+		config, err := LoadProfileConfig(profile)
+		if err != nil {
+			return nil, errors.New("profile " + profile + ": " + err.Error())
+		}
+		profiles = append(profiles, config)
+	}
+
+	return &ProcessConfig{
+		Profiles:           profiles,
+		ProfilesConcurrent: profilesConcurrent,
+		SyncInterval:       syncInterval,
+		ReadyMaxSyncAge:    readyMaxSyncAge,
+		ReportOutput:       ReportOutput(reportOutput),
+		MetricsConfig:      metricsConfig,
+		TracingConfig:      tracingConfig,
+	}, nil
+}
+
+// LoadMetricsConfig loads the settings of the metrics and health endpoints, which are shared by all profiles
+func LoadMetricsConfig() *MetricsConfig {
+	// The http server is disabled without a listen address, pushing without a Pushgateway url
+	listenAddress, _ := os.LookupEnv("METRICS_LISTEN_ADDRESS")
+	pushgatewayUrl, _ := os.LookupEnv("METRICS_PUSHGATEWAY_URL")
+
+	pushgatewayJob, exists := os.LookupEnv("METRICS_PUSHGATEWAY_JOB")
+	if !exists {
+		pushgatewayJob = "firefly_iii_bunq_sync"
+	}
+
+	return &MetricsConfig{
+		ListenAddress:  listenAddress,
+		PushgatewayUrl: pushgatewayUrl,
+		PushgatewayJob: pushgatewayJob,
+	}
+}
+
+func loadTracingConfig() *TracingConfig {
+	// Tracing is disabled without an endpoint, like http://localhost:4318
+	otlpEndpoint, _ := os.LookupEnv("TRACING_OTLP_ENDPOINT")
+
+	serviceName, exists := os.LookupEnv("TRACING_SERVICE_NAME")
+	if !exists {
+		serviceName = "firefly-iii-bunq-sync"
+	}
+
+	return &TracingConfig{
+		OtlpEndpoint: otlpEndpoint,
+		ServiceName:  serviceName,
+	}
 }
 
 func LoadConfig() (*Config, error) {
-	storageLocation, exists := os.LookupEnv("STORAGE_LOCATION")
+	return loadConfig("", &profileEnv{})
+}
+
+// LoadProfileConfig loads the config of a named profile, which stores its files in a subdirectory of the storage location
+func LoadProfileConfig(profile string) (*Config, error) {
+	for _, character := range profile {
+		if !(character >= 'a' && character <= 'z') && !(character >= 'A' && character <= 'Z') && !(character >= '0' && character <= '9') && character != '_' {
+			return nil, errors.New("profile names can only contain letters, digits and underscores")
+		}
+	}
+
+	return loadConfig(profile, &profileEnv{prefix: strings.ToUpper(profile) + "_"})
+}
+
+func loadConfig(profile string, env *profileEnv) (*Config, error) {
+	storageLocation, exists := env.LookupEnv("STORAGE_LOCATION")
 	if !exists {
 		storageLocation = "./storage/"
 	}
-	if string(storageLocation[len(storageLocation)-1]) != "/" {
+	if storageLocation == "" || string(storageLocation[len(storageLocation)-1]) != "/" {
 		return nil, errors.New("storage location must end with a slash")
 	}
 
-	bunqConfig, err := loadBunqConfig()
+	// The storage location is created by PrepareStorage once a command uses it
+	if profile != "" {
+		storageLocation += profile + "/"
+	}
+
+	bunqConfig, err := loadBunqConfig(env)
+	if err != nil {
+		return nil, err
+	}
+
+	fireflyConfig, err := loadFireflyConfig(env)
 	if err != nil {
 		return nil, err
 	}
 
-	fireflyConfig, err := loadFireflyConfig()
+	syncConfig, err := loadSyncConfig(env)
 	if err != nil {
 		return nil, err
 	}
 
+	notifyConfig, err := loadNotifyConfig(env)
+	if err != nil {
+		return nil, err
+	}
+
+	cassetteConfig, err := loadCassetteConfig(env, storageLocation)
+	if err != nil {
+		return nil, err
+	}
+
+	// A replay must not touch the stored registration and needs no real credentials, the cassette has the responses.
+	// The temporary storage location is only created by PrepareStorage.
+	if cassetteConfig.Mode == CassetteReplay {
+		storageLocation, err = replayStorageLocation()
+		if err != nil {
+			return nil, err
+		}
+
+		if bunqConfig.ApiKey == "" {
+			bunqConfig.ApiKey = "replay"
+		}
+		if fireflyConfig.ApiKey == "" {
+			fireflyConfig.ApiKey = "replay"
+		}
+	}
+
 	return &Config{
+		Profile:         profile,
 		StorageLocation: storageLocation,
 		BunqConfig:      bunqConfig,
 		FireflyConfig:   fireflyConfig,
+		SyncConfig:      syncConfig,
+		NotifyConfig:    notifyConfig,
+		CassetteConfig:  cassetteConfig,
+
+		SharedCredentials: env.shared,
 	}, nil
 }
 
-func loadBunqConfig() (*BunqConfig, error) {
-	apiBaseUrl, exists := os.LookupEnv("BUNQ_API_BASE_URL")
+// PrepareStorage creates the storage location when it does not exist yet, it is called before the storage is used
+func (c *Config) PrepareStorage() error {
+	return os.MkdirAll(c.StorageLocation, 0700)
+}
+
+// CleanupStorage removes the temporary storage location of a replay, the storage of other modes is kept
+func (c *Config) CleanupStorage() error {
+	if c.CassetteConfig == nil || c.CassetteConfig.Mode != CassetteReplay {
+		return nil
+	}
+
+	return os.RemoveAll(c.StorageLocation)
+}
+
+// replayStorageLocation returns a new temporary storage location, the random name can't be guessed in advance
+func replayStorageLocation() (string, error) {
+	name := make([]byte, 16)
+	if _, err := rand.Read(name); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(os.TempDir(), "bunq-firefly-replay-"+hex.EncodeToString(name)) + "/", nil
+}
+
+func loadBunqConfig(env *profileEnv) (*BunqConfig, error) {
+	apiBaseUrl, exists := env.LookupEnv("BUNQ_API_BASE_URL")
 	if !exists {
 		apiBaseUrl = "https://public-api.sandbox.bunq.com/v1"
 	}
@@ -64,62 +412,131 @@ func loadBunqConfig() (*BunqConfig, error) {
 		return nil, errors.New("bunq api base url cannot end with a slash")
 	}
 
-	apiKey, exists := os.LookupEnv("BUNQ_API_KEY")
+	// The api key is optional when an OAuth access token is stored by the login command
+	apiKey, _ := env.LookupEnv("BUNQ_API_KEY")
+
+	oauthClientId, _ := env.LookupEnv("BUNQ_OAUTH_CLIENT_ID")
+	oauthClientSecret, _ := env.LookupEnv("BUNQ_OAUTH_CLIENT_SECRET")
+
+	oauthRedirectUrl, exists := env.LookupEnv("BUNQ_OAUTH_REDIRECT_URL")
 	if !exists {
-		return nil, errors.New("missing bunq api key in env")
+		oauthRedirectUrl = "http://localhost:8765/callback"
 	}
 
-	privateKeyFileName, exists := os.LookupEnv("BUNQ_PRIVATE_KEY_FILE_NAME")
+	defaultOAuthAuthorizeUrl := "https://oauth.bunq.com/auth"
+	defaultOAuthTokenUrl := "https://api.oauth.bunq.com/v1/token"
+	if strings.Contains(apiBaseUrl, "sandbox") {
+		defaultOAuthAuthorizeUrl = "https://oauth.sandbox.bunq.com/auth"
+		defaultOAuthTokenUrl = "https://api-oauth.sandbox.bunq.com/v1/token"
+	}
+
+	oauthAuthorizeUrl, exists := env.LookupEnv("BUNQ_OAUTH_AUTHORIZE_URL")
+	if !exists {
+		oauthAuthorizeUrl = defaultOAuthAuthorizeUrl
+	}
+
+	oauthTokenUrl, exists := env.LookupEnv("BUNQ_OAUTH_TOKEN_URL")
+	if !exists {
+		oauthTokenUrl = defaultOAuthTokenUrl
+	}
+
+	oauthTokenFileName, exists := env.LookupEnv("BUNQ_OAUTH_TOKEN_FILE_NAME")
+	if !exists {
+		oauthTokenFileName = "bunq_oauth_token.json"
+	}
+
+	privateKeyFileName, exists := env.LookupEnv("BUNQ_PRIVATE_KEY_FILE_NAME")
 	if !exists {
 		privateKeyFileName = "bunq_client.key"
 	}
 
-	publicKeyFileName, exists := os.LookupEnv("BUNQ_PUBLIC_KEY_FILE_NAME")
+	publicKeyFileName, exists := env.LookupEnv("BUNQ_PUBLIC_KEY_FILE_NAME")
 	if !exists {
 		publicKeyFileName = "bunq_client.pub.key"
 	}
 
-	installationFileName, exists := os.LookupEnv("BUNQ_INSTALLATION_FILE_NAME")
+	keyBitSize := 2048
+	if value, exists := env.LookupEnv("BUNQ_KEY_BIT_SIZE"); exists {
+		var err error
+		keyBitSize, err = strconv.Atoi(value)
+		if err != nil || keyBitSize < 2048 {
+			return nil, errors.New("bunq key bit size must be a number of at least 2048")
+		}
+	}
+
+	installationFileName, exists := env.LookupEnv("BUNQ_INSTALLATION_FILE_NAME")
 	if !exists {
 		installationFileName = "bunq_installation.json"
 	}
 
-	deviceServerFileName, exists := os.LookupEnv("BUNQ_DEVICE_SERVER_FILE_NAME")
+	deviceServerFileName, exists := env.LookupEnv("BUNQ_DEVICE_SERVER_FILE_NAME")
 	if !exists {
 		deviceServerFileName = "bunq_device_server.json"
 	}
 
-	sessionServerFileName, exists := os.LookupEnv("BUNQ_SESSION_SERVER_FILE_NAME")
+	sessionServerFileName, exists := env.LookupEnv("BUNQ_SESSION_SERVER_FILE_NAME")
 	if !exists {
 		sessionServerFileName = "bunq_session_server.json"
 	}
 
-	userAgent, exists := os.LookupEnv("BUNQ_USER_AGENT")
+	userAgent, exists := env.LookupEnv("BUNQ_USER_AGENT")
 	if !exists {
 		userAgent = "BunqFireflySync/1.0"
 	}
 
-	permittedIps, exists := os.LookupEnv("BUNQ_PERMITTED_IPS")
+	permittedIps, exists := env.LookupEnv("BUNQ_PERMITTED_IPS")
 	if !exists {
 		permittedIps = "*"
 	}
 	permittedIpsSplitted := strings.Split(permittedIps, ",")
 
+	deleteSessionOnExit, err := lookupBoolEnv(env, "BUNQ_DELETE_SESSION_ON_EXIT", false)
+	if err != nil {
+		return nil, err
+	}
+
+	maxReregistrations := 1
+	if value, exists := env.LookupEnv("BUNQ_MAX_REREGISTRATIONS"); exists {
+		maxReregistrations, err = strconv.Atoi(value)
+		if err != nil || maxReregistrations < 0 {
+			return nil, errors.New("bunq max reregistrations must be a positive number")
+		}
+	}
+
+	// Without a rate requests only wait after bunq answered 429 Too Many Requests
+	var requestsPerSecond float64
+	if value, exists := env.LookupEnv("BUNQ_REQUESTS_PER_SECOND"); exists && value != "" {
+		requestsPerSecond, err = strconv.ParseFloat(value, 64)
+		if err != nil || requestsPerSecond < 0 {
+			return nil, errors.New("bunq requests per second must be a positive number")
+		}
+	}
+
 	return &BunqConfig{
 		ApiBaseUrl:            apiBaseUrl,
 		ApiKey:                apiKey,
+		OAuthClientId:         oauthClientId,
+		OAuthClientSecret:     oauthClientSecret,
+		OAuthRedirectUrl:      oauthRedirectUrl,
+		OAuthAuthorizeUrl:     oauthAuthorizeUrl,
+		OAuthTokenUrl:         oauthTokenUrl,
+		OAuthTokenFileName:    oauthTokenFileName,
 		PrivateKeyFileName:    privateKeyFileName,
 		PublicKeyFileName:     publicKeyFileName,
+		KeyBitSize:            keyBitSize,
 		InstallationFileName:  installationFileName,
 		DeviceServerFileName:  deviceServerFileName,
 		SessionServerFileName: sessionServerFileName,
 		UserAgent:             userAgent,
 		PermittedIps:          permittedIpsSplitted,
+		DeleteSessionOnExit:   deleteSessionOnExit,
+		MaxReregistrations:    maxReregistrations,
+		RequestsPerSecond:     requestsPerSecond,
 	}, nil
 }
 
-func loadFireflyConfig() (*FireflyConfig, error) {
-	apiBaseUrl, exists := os.LookupEnv("FIREFLY_API_BASE_URL")
+func loadFireflyConfig(env *profileEnv) (*FireflyConfig, error) {
+	apiBaseUrl, exists := env.LookupEnv("FIREFLY_API_BASE_URL")
 	if !exists {
 		return nil, errors.New("missing firefly api base url")
 	}
@@ -127,13 +544,239 @@ func loadFireflyConfig() (*FireflyConfig, error) {
 		return nil, errors.New("firefly api base url cannot end with a slash")
 	}
 
-	apiKey, exists := os.LookupEnv("FIREFLY_API_KEY")
+	// The api key is optional when an OAuth token is stored by the firefly login command
+	apiKey, _ := env.LookupEnv("FIREFLY_API_KEY")
+
+	oauthBaseUrl, exists := env.LookupEnv("FIREFLY_OAUTH_BASE_URL")
+	if !exists {
+		oauthBaseUrl = strings.TrimSuffix(apiBaseUrl, "/api")
+	}
+
+	oauthClientId, _ := env.LookupEnv("FIREFLY_OAUTH_CLIENT_ID")
+	oauthClientSecret, _ := env.LookupEnv("FIREFLY_OAUTH_CLIENT_SECRET")
+
+	oauthRedirectUrl, exists := env.LookupEnv("FIREFLY_OAUTH_REDIRECT_URL")
+	if !exists {
+		oauthRedirectUrl = "http://localhost:8765/callback"
+	}
+
+	oauthTokenFileName, exists := env.LookupEnv("FIREFLY_OAUTH_TOKEN_FILE_NAME")
 	if !exists {
-		return nil, errors.New("missing firefly api key")
+		oauthTokenFileName = "firefly_oauth_token.json"
+	}
+
+	tokenExpiryWarning := 30 * 24 * time.Hour
+	if value, exists := env.LookupEnv("FIREFLY_TOKEN_EXPIRY_WARNING"); exists {
+		var err error
+		tokenExpiryWarning, err = time.ParseDuration(value)
+		if err != nil {
+			return nil, errors.New("firefly token expiry warning must be a duration like 720h")
+		}
+	}
+
+	// Unset prefix means the default prefix for the type of bunq user is used
+	var accountNamePrefix *string
+	if prefix, exists := env.LookupEnv("FIREFLY_ACCOUNT_NAME_PREFIX"); exists {
+		accountNamePrefix = &prefix
 	}
 
 	return &FireflyConfig{
-		ApiBaseUrl: apiBaseUrl,
-		ApiKey:     apiKey,
+		ApiBaseUrl:         apiBaseUrl,
+		ApiKey:             apiKey,
+		AccountNamePrefix:  accountNamePrefix,
+		OAuthBaseUrl:       oauthBaseUrl,
+		OAuthClientId:      oauthClientId,
+		OAuthClientSecret:  oauthClientSecret,
+		OAuthRedirectUrl:   oauthRedirectUrl,
+		OAuthTokenFileName: oauthTokenFileName,
+		TokenExpiryWarning: tokenExpiryWarning,
 	}, nil
 }
+
+func loadSyncConfig(env *profileEnv) (*SyncConfig, error) {
+	syncAttachments, err := lookupBoolEnv(env, "SYNC_ATTACHMENTS", false)
+	if err != nil {
+		return nil, err
+	}
+
+	syncNotes, err := lookupBoolEnv(env, "SYNC_NOTES", false)
+	if err != nil {
+		return nil, err
+	}
+
+	syncNotesToBunq, err := lookupBoolEnv(env, "SYNC_NOTES_TO_BUNQ", false)
+	if err != nil {
+		return nil, err
+	}
+
+	reportFileName, exists := env.LookupEnv("REPORT_FILE_NAME")
+	if !exists {
+		reportFileName = "sync_report.json"
+	}
+
+	concurrency := 1
+	if value, exists := env.LookupEnv("SYNC_CONCURRENCY"); exists && value != "" {
+		concurrency, err = strconv.Atoi(value)
+		if err != nil || concurrency < 1 {
+			return nil, errors.New("sync concurrency must be a number of at least 1")
+		}
+	}
+
+	failedPaymentsFileName, exists := env.LookupEnv("FAILED_PAYMENTS_FILE_NAME")
+	if !exists {
+		failedPaymentsFileName = "failed_payments.json"
+	}
+
+	retryBackoff := time.Hour
+	if value, exists := env.LookupEnv("FAILED_RETRY_BACKOFF"); exists && value != "" {
+		retryBackoff, err = time.ParseDuration(value)
+		if err != nil || retryBackoff < 0 {
+			return nil, errors.New("failed retry backoff must be a duration like 1h")
+		}
+	}
+
+	// After this many attempts a payment is only retried with the failed retry command, 0 retries forever
+	maxRetryAttempts := 10
+	if value, exists := env.LookupEnv("FAILED_MAX_ATTEMPTS"); exists && value != "" {
+		maxRetryAttempts, err = strconv.Atoi(value)
+		if err != nil || maxRetryAttempts < 0 {
+			return nil, errors.New("failed max attempts must be a positive number")
+		}
+	}
+
+	settledCardActionsFileName, exists := env.LookupEnv("SETTLED_CARD_ACTIONS_FILE_NAME")
+	if !exists || settledCardActionsFileName == "" {
+		settledCardActionsFileName = "settled_card_actions.json"
+	}
+
+	lockFileName, exists := env.LookupEnv("LOCK_FILE_NAME")
+	if !exists || lockFileName == "" {
+		lockFileName = "sync.lock"
+	}
+
+	return &SyncConfig{
+		SyncAttachments:            syncAttachments,
+		SyncNotes:                  syncNotes,
+		SyncNotesToBunq:            syncNotesToBunq,
+		ReportFileName:             reportFileName,
+		Concurrency:                concurrency,
+		FailedPaymentsFileName:     failedPaymentsFileName,
+		RetryBackoff:               retryBackoff,
+		MaxRetryAttempts:           maxRetryAttempts,
+		SettledCardActionsFileName: settledCardActionsFileName,
+		LockFileName:               lockFileName,
+	}, nil
+}
+
+func loadNotifyConfig(env *profileEnv) (*NotifyConfig, error) {
+	smtpHost, _ := env.LookupEnv("NOTIFY_SMTP_HOST")
+
+	smtpPort := 587
+	if value, exists := env.LookupEnv("NOTIFY_SMTP_PORT"); exists && value != "" {
+		var err error
+		smtpPort, err = strconv.Atoi(value)
+		if err != nil || smtpPort <= 0 {
+			return nil, errors.New("notify smtp port must be a positive number")
+		}
+	}
+
+	smtpUsername, _ := env.LookupEnv("NOTIFY_SMTP_USERNAME")
+	smtpPassword, _ := env.LookupEnv("NOTIFY_SMTP_PASSWORD")
+	smtpFrom, _ := env.LookupEnv("NOTIFY_SMTP_FROM")
+
+	smtpTo := []string{}
+	if value, exists := env.LookupEnv("NOTIFY_SMTP_TO"); exists {
+		for _, address := range strings.Split(value, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				smtpTo = append(smtpTo, address)
+			}
+		}
+	}
+	if smtpHost != "" && (smtpFrom == "" || len(smtpTo) == 0) {
+		return nil, errors.New("notify smtp needs a from and to address")
+	}
+
+	webhookUrl, _ := env.LookupEnv("NOTIFY_WEBHOOK_URL")
+	chatWebhookUrl, _ := env.LookupEnv("NOTIFY_CHAT_WEBHOOK_URL")
+	ntfyUrl, _ := env.LookupEnv("NOTIFY_NTFY_URL")
+	ntfyToken, _ := env.LookupEnv("NOTIFY_NTFY_TOKEN")
+	gotifyUrl, _ := env.LookupEnv("NOTIFY_GOTIFY_URL")
+	gotifyToken, _ := env.LookupEnv("NOTIFY_GOTIFY_TOKEN")
+	if gotifyUrl != "" && gotifyToken == "" {
+		return nil, errors.New("notify gotify needs an application token")
+	}
+
+	// Payments are only notified when they match a condition, a threshold of 0 disables the amount condition
+	var amountThreshold float64
+	if value, exists := env.LookupEnv("NOTIFY_AMOUNT_THRESHOLD"); exists && value != "" {
+		var err error
+		amountThreshold, err = strconv.ParseFloat(value, 64)
+		if err != nil || amountThreshold < 0 {
+			return nil, errors.New("notify amount threshold must be a positive amount like 500.00")
+		}
+	}
+
+	newCounterparty, err := lookupBoolEnv(env, "NOTIFY_NEW_COUNTERPARTY", false)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionRestarts := 3
+	if value, exists := env.LookupEnv("NOTIFY_SESSION_RESTARTS"); exists && value != "" {
+		sessionRestarts, err = strconv.Atoi(value)
+		if err != nil || sessionRestarts < 0 {
+			return nil, errors.New("notify session restarts must be a positive number")
+		}
+	}
+
+	return &NotifyConfig{
+		SmtpHost:        smtpHost,
+		SmtpPort:        smtpPort,
+		SmtpUsername:    smtpUsername,
+		SmtpPassword:    smtpPassword,
+		SmtpFrom:        smtpFrom,
+		SmtpTo:          smtpTo,
+		WebhookUrl:      webhookUrl,
+		ChatWebhookUrl:  chatWebhookUrl,
+		NtfyUrl:         ntfyUrl,
+		NtfyToken:       ntfyToken,
+		GotifyUrl:       gotifyUrl,
+		GotifyToken:     gotifyToken,
+		AmountThreshold: amountThreshold,
+		NewCounterparty: newCounterparty,
+		SessionRestarts: sessionRestarts,
+	}, nil
+}
+
+func loadCassetteConfig(env *profileEnv, storageLocation string) (*CassetteConfig, error) {
+	mode, _ := env.LookupEnv("HTTP_CASSETTE_MODE")
+	switch CassetteMode(mode) {
+	case "", CassetteRecord, CassetteReplay:
+	default:
+		return nil, errors.New("http cassette mode must be record or replay")
+	}
+
+	fileName, exists := env.LookupEnv("HTTP_CASSETTE_FILE_NAME")
+	if !exists {
+		fileName = "http_cassette.json"
+	}
+
+	return &CassetteConfig{
+		Mode:     CassetteMode(mode),
+		Location: storageLocation + fileName,
+	}, nil
+}
+
+func lookupBoolEnv(env *profileEnv, key string, defaultValue bool) (bool, error) {
+	value, exists := env.LookupEnv(key)
+	if !exists || value == "" {
+		return defaultValue, nil
+	}
+
+	result, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New(strings.ToLower(key) + " must be true or false")
+	}
+
+	return result, nil
+}
@@ -0,0 +1,30 @@
+package util_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+)
+
+func TestProfilesDifferingInCaseAreRejected(t *testing.T) {
+	t.Setenv("STORAGE_LOCATION", t.TempDir()+"/")
+	t.Setenv("BUNQ_API_KEY", "bunq-key")
+	t.Setenv("FIREFLY_API_KEY", "firefly-key")
+	t.Setenv("FIREFLY_API_BASE_URL", "http://firefly.test/api")
+
+	t.Setenv("PROFILES", "alice,bob")
+	if _, err := util.LoadProcessConfig(); err != nil {
+		t.Fatalf("expected distinct profiles to load, got %v", err)
+	}
+
+	t.Setenv("PROFILES", "alice,Alice")
+	if _, err := util.LoadProcessConfig(); err == nil || !strings.Contains(err.Error(), "only differ in case") {
+		t.Errorf("expected the profiles to be rejected, got %v", err)
+	}
+
+	t.Setenv("PROFILES", "alice,alice")
+	if _, err := util.LoadProcessConfig(); err == nil || !strings.Contains(err.Error(), "more than once") {
+		t.Errorf("expected the profile to be rejected, got %v", err)
+	}
+}
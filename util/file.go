@@ -0,0 +1,73 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes the data to a temporary file next to path and renames it over path, so readers never see a
+// partially written file
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tempPath := file.Name()
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	if err := os.Chmod(tempPath, perm); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// ReadPrivateFile reads a stored file that only the owner may read. Files written by older versions with wider
+// permissions are restricted to the owner, a file on a read only mount is read as it is.
+func ReadPrivateFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0077 != 0 {
+		os.Chmod(path, 0600)
+	}
+
+	return data, nil
+}
+
+// syncDir flushes the rename to disk, so the new file is still there after a crash. Directories can't be synced on
+// every platform, so errors are ignored.
+func syncDir(path string) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+
+	dir.Sync()
+}
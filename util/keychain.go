@@ -36,6 +36,65 @@ func NewKeyChain(privateKeyPath string, publicKeyPath string, bitSize int) (*Key
 	return &instance, nil
 }
 
+// GenerateKeyChain creates a new keypair in memory without writing it to disk, use WriteKeys to store it
+func GenerateKeyChain(bitSize int) (*Keychain, error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, bitSize)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKeyPem, publicKeyPem, err := encodeKeyPair(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Keychain{
+		PrivateKey:    privateKey,
+		PublicKey:     &privateKey.PublicKey,
+		PrivateKeyPem: privateKeyPem,
+		PublicKeyPem:  publicKeyPem,
+		bitSize:       bitSize,
+	}, nil
+}
+
+// WriteKeys stores the keypair at the given paths, every file is replaced atomically
+func (kc *Keychain) WriteKeys(privateKeyPath string, publicKeyPath string) error {
+	if err := WriteFileAtomic(privateKeyPath, kc.PrivateKeyPem, 0600); err != nil {
+		return err
+	}
+
+	if err := WriteFileAtomic(publicKeyPath, kc.PublicKeyPem, 0600); err != nil {
+		return err
+	}
+
+	kc.privateKeyPath = privateKeyPath
+	kc.publicKeyPath = publicKeyPath
+
+	return nil
+}
+
+// LoadKeyChain loads an existing keypair, unlike NewKeyChain missing keys are not created
+func LoadKeyChain(privateKeyPath string, publicKeyPath string) (*Keychain, error) {
+	instance := Keychain{
+		privateKeyPath: privateKeyPath,
+		publicKeyPath:  publicKeyPath,
+	}
+
+	if err := instance.loadPrivateKey(); err != nil {
+		return nil, err
+	}
+
+	if err := instance.loadPublicKey(); err != nil {
+		return nil, err
+	}
+
+	if !instance.PrivateKey.PublicKey.Equal(instance.PublicKey) {
+		return nil, errors.New("public key does not belong to private key")
+	}
+
+	return &instance, nil
+}
+
 func (kc *Keychain) loadOrCreateKeypair() error {
 	if kc.privateKeyPath != "" {
 		if _, err := os.Stat(kc.privateKeyPath); err == nil {
@@ -65,36 +124,54 @@ func (kc *Keychain) loadOrCreateKeypair() error {
 }
 
 func (kc *Keychain) loadPrivateKey() error {
-	privateKey, err := os.ReadFile(kc.privateKeyPath)
+	privateKey, err := ReadPrivateFile(kc.privateKeyPath)
 	if err != nil {
 		return err
 	}
 
 	keyBlock, _ := pem.Decode(privateKey)
+	if keyBlock == nil {
+		return errors.New("private key is not pem encoded")
+	}
+
 	key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
 	if err != nil {
 		return err
 	}
 
-	kc.PrivateKey = key.(*rsa.PrivateKey)
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return errors.New("private key is not a rsa key")
+	}
+
+	kc.PrivateKey = rsaKey
 	kc.PrivateKeyPem = privateKey
 
 	return nil
 }
 
 func (kc *Keychain) loadPublicKey() error {
-	publicKey, err := os.ReadFile(kc.publicKeyPath)
+	publicKey, err := ReadPrivateFile(kc.publicKeyPath)
 	if err != nil {
 		return err
 	}
 
 	keyBlock, _ := pem.Decode(publicKey)
+	if keyBlock == nil {
+		return errors.New("public key is not pem encoded")
+	}
+
 	key, err := x509.ParsePKIXPublicKey(keyBlock.Bytes)
 	if err != nil {
 		return err
 	}
 
-	kc.PublicKey = key.(*rsa.PublicKey)
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("public key is not a rsa key")
+	}
+
+	kc.PublicKey = rsaKey
 	kc.PublicKeyPem = publicKey
 
 	return nil
@@ -113,7 +190,7 @@ func (kc *Keychain) createPrivateKey() error {
 
 	privateKeyPem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyBytes})
 
-	if err := os.WriteFile(kc.privateKeyPath, privateKeyPem, 0700); err != nil {
+	if err := WriteFileAtomic(kc.privateKeyPath, privateKeyPem, 0600); err != nil {
 		return err
 	}
 
@@ -134,7 +211,7 @@ func (kc *Keychain) createPublicKey() error {
 	}
 
 	publicKeyPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyBytes})
-	if err := os.WriteFile(kc.publicKeyPath, publicKeyPem, 0700); err != nil {
+	if err := WriteFileAtomic(kc.publicKeyPath, publicKeyPem, 0600); err != nil {
 		return err
 	}
 
@@ -144,6 +221,23 @@ func (kc *Keychain) createPublicKey() error {
 	return nil
 }
 
+func encodeKeyPair(privateKey *rsa.PrivateKey) ([]byte, []byte, error) {
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(privateKey.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privateKeyPem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyBytes})
+	publicKeyPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyBytes})
+
+	return privateKeyPem, publicKeyPem, nil
+}
+
 func (kc *Keychain) Sign(data []byte) (string, error) {
 	hashedBody := sha256.Sum256(data)
 
@@ -0,0 +1,281 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// How often the holder of a lock writes its heartbeat and how often a waiting process tries to take the lock
+var (
+	lockHeartbeatInterval = 30 * time.Second
+	lockPollInterval      = time.Second
+	lockBreakInterval     = 10 * time.Millisecond
+)
+
+// errLocked is returned by tryLockFile when another process holds the lock
+var errLocked = errors.New("file is locked")
+
+// LockHolder describes the process holding a lock, it is stored in the lock file
+type LockHolder struct {
+	Pid         int       `json:"pid"`
+	Hostname    string    `json:"hostname"`
+	Command     string    `json:"command"`
+	StartedAt   time.Time `json:"started_at"`
+	HeartbeatAt time.Time `json:"heartbeat_at"`
+}
+
+func (h *LockHolder) String() string {
+	return fmt.Sprintf("%s (pid %d on %s, started at %s, last heartbeat %s ago)",
+		h.Command, h.Pid, h.Hostname, h.StartedAt.Format(time.RFC3339), time.Since(h.HeartbeatAt).Round(time.Second))
+}
+
+// LockedError is returned when another process holds the lock and the caller does not wait
+type LockedError struct {
+	Path   string
+	Holder *LockHolder
+}
+
+func (e *LockedError) Error() string {
+	if e.Holder == nil {
+		return "storage is locked by another process, see " + e.Path
+	}
+
+	return "storage is locked by " + e.Holder.String() + ", see " + e.Path
+}
+
+// Lock is an exclusive lock on a lock file, held until Release
+type Lock struct {
+	path     string
+	file     *os.File
+	holder   *LockHolder
+	log      *logrus.Entry
+	mutex    sync.Mutex
+	stop     chan struct{}
+	finished chan struct{}
+}
+
+// AcquireLock takes the lock on the file at path for the command. When another process holds the lock, AcquireLock
+// waits for it with wait, otherwise it returns a LockedError naming the holder. The lock is released by the system
+// when its holder dies, only a lock held by a process of this host that no longer runs, for example through a file
+// inherited by a child process, is taken over.
+func AcquireLock(path string, command string, wait bool, log *logrus.Entry) (*Lock, error) {
+	hostname, _ := os.Hostname()
+
+	waiting := false
+	for {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+
+		err = tryLockFile(file)
+		if err == nil {
+			// A process that broke a stale lock removed the file this process opened, the lock has to be on the
+			// file that is at the path now
+			if !isSameFile(file, path) {
+				file.Close()
+				continue
+			}
+
+			if previous := readLockHolder(file); previous != nil {
+				log.WithField("holder", previous.String()).Debug("Previous holder ended without releasing the lock")
+			}
+
+			now := time.Now()
+			lock := &Lock{
+				path:     path,
+				file:     file,
+				holder:   &LockHolder{Pid: os.Getpid(), Hostname: hostname, Command: command, StartedAt: now, HeartbeatAt: now},
+				log:      log.WithField("path", path),
+				stop:     make(chan struct{}),
+				finished: make(chan struct{}),
+			}
+			if err := lock.writeHolder(); err != nil {
+				unlockFile(file)
+				file.Close()
+				return nil, err
+			}
+
+			go lock.heartbeat()
+			return lock, nil
+		}
+
+		holder := readLockHolder(file)
+		file.Close()
+		if !errors.Is(err, errLocked) {
+			return nil, err
+		}
+
+		if holder != nil && isStale(holder, hostname) {
+			if err := breakStaleLock(path, hostname, log); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if !wait {
+			return nil, &LockedError{Path: path, Holder: holder}
+		}
+
+		if !waiting {
+			waiting = true
+			lockedErr := &LockedError{Path: path, Holder: holder}
+			log.WithField("path", path).Info(lockedErr.Error() + ", waiting")
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// Release stops the heartbeat and releases the lock
+func (l *Lock) Release() error {
+	close(l.stop)
+	<-l.finished
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// The holder is cleared so the next process does not report it as ended without releasing the lock
+	if err := l.file.Truncate(0); err != nil {
+		l.log.WithError(err).Warn("Cannot clear the holder of the lock")
+	}
+	if err := unlockFile(l.file); err != nil {
+		l.file.Close()
+		return err
+	}
+
+	return l.file.Close()
+}
+
+func (l *Lock) heartbeat() {
+	defer close(l.finished)
+
+	ticker := time.NewTicker(lockHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.mutex.Lock()
+			l.holder.HeartbeatAt = time.Now()
+			// Other processes see the previous heartbeat, they only take the lock over once this process is gone
+			if err := l.writeHolder(); err != nil {
+				l.log.WithError(err).Warn("Cannot write the heartbeat of the lock")
+			}
+			l.mutex.Unlock()
+		}
+	}
+}
+
+func (l *Lock) writeHolder() error {
+	data, err := json.Marshal(l.holder)
+	if err != nil {
+		return err
+	}
+
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := l.file.WriteAt(data, 0); err != nil {
+		return err
+	}
+
+	return l.file.Sync()
+}
+
+func readLockHolder(file *os.File) *LockHolder {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+
+	var holder LockHolder
+	if err := json.Unmarshal(data, &holder); err != nil {
+		return nil
+	}
+
+	return &holder
+}
+
+// breakStaleLock removes the lock file of a holder that no longer runs. Processes breaking the lock at the same time
+// take turns through a second lock file and read the holder again, so a lock another process just took over is kept.
+func breakStaleLock(path string, hostname string, log *logrus.Entry) error {
+	guard, err := os.OpenFile(path+".break", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer guard.Close()
+
+	for {
+		err := tryLockFile(guard)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errLocked) {
+			return err
+		}
+		time.Sleep(lockBreakInterval)
+	}
+	defer unlockFile(guard)
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// The lock was released in the meantime
+	if err := tryLockFile(file); err == nil {
+		return unlockFile(file)
+	}
+
+	holder := readLockHolder(file)
+	if holder == nil || !isStale(holder, hostname) || !isSameFile(file, path) {
+		return nil
+	}
+
+	log.WithFields(logrus.Fields{
+		"holder": holder.String(),
+		"path":   path,
+	}).Warn("Taking over lock of a process that no longer runs")
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// isStale reports whether the holder runs on this host and its process is gone
+func isStale(holder *LockHolder, hostname string) bool {
+	return holder.Hostname == hostname && holder.Pid > 0 && !processExists(holder.Pid)
+}
+
+func isSameFile(file *os.File, path string) bool {
+	opened, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	current, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(opened, current)
+}
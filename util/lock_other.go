@@ -0,0 +1,20 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package util
+
+import (
+	"errors"
+	"os"
+)
+
+func tryLockFile(file *os.File) error {
+	return errors.ErrUnsupported
+}
+
+func unlockFile(file *os.File) error {
+	return errors.ErrUnsupported
+}
+
+func processExists(pid int) bool {
+	return true
+}
@@ -0,0 +1,98 @@
+package util_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+	"github.com/sirupsen/logrus"
+)
+
+func TestLock(t *testing.T) {
+	log := logrus.New()
+	log.Out = io.Discard
+	entry := logrus.NewEntry(log)
+
+	path := t.TempDir() + "/sync.lock"
+
+	first, err := util.AcquireLock(path, "sync", false, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = util.AcquireLock(path, "login", false, entry)
+	var lockedErr *util.LockedError
+	if !errors.As(err, &lockedErr) {
+		t.Fatalf("expected a locked error, got %v", err)
+	}
+	if lockedErr.Holder == nil || lockedErr.Holder.Pid != os.Getpid() || lockedErr.Holder.Command != "sync" {
+		t.Fatalf("expected the holder to be this sync, got %+v", lockedErr.Holder)
+	}
+	if !strings.Contains(err.Error(), "pid "+strconv.Itoa(os.Getpid())) {
+		t.Errorf("expected the error to name the holder, got %q", err.Error())
+	}
+
+	// A waiting process gets the lock once it is released
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		first.Release()
+	}()
+
+	second, err := util.AcquireLock(path, "failed retry", true, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := second.Release(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockOfEndedProcessIsTakenOver(t *testing.T) {
+	log := logrus.New()
+	log.Out = io.Discard
+	entry := logrus.NewEntry(log)
+
+	path := t.TempDir() + "/sync.lock"
+
+	// The lock stays held, like a lock file inherited by a child process, while the process in it ended
+	held, err := util.AcquireLock(path, "sync", false, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Release()
+
+	ended := exec.Command(os.Args[0], "-test.run=^$")
+	if err := ended.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	hostname, _ := os.Hostname()
+	holder, _ := json.Marshal(util.LockHolder{Pid: ended.Process.Pid, Hostname: hostname, Command: "sync", StartedAt: time.Now(), HeartbeatAt: time.Now()})
+	if err := os.WriteFile(path, holder, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	takeover, err := util.AcquireLock(path, "sync", false, entry)
+	if err != nil {
+		t.Fatalf("expected the lock of the ended process to be taken over, got %v", err)
+	}
+
+	// A lock that was just taken over is not taken over again
+	_, err = util.AcquireLock(path, "sync", false, entry)
+	var lockedErr *util.LockedError
+	if !errors.As(err, &lockedErr) {
+		t.Fatalf("expected a locked error, got %v", err)
+	}
+
+	if err := takeover.Release(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,90 @@
+package util
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// NewOAuthState generates the random state used to match an OAuth callback to the authorisation request
+func NewOAuthState() (string, error) {
+	state := make([]byte, 16)
+	if _, err := rand.Read(state); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(state), nil
+}
+
+// WaitForOAuthCallback starts a local http server on the redirect url and waits until the user is redirected back
+// after authorising the application. Returns the authorisation code from the callback.
+func WaitForOAuthCallback(redirectUrl string, state string, timeout time.Duration) (string, error) {
+	callbackUrl, err := url.Parse(redirectUrl)
+	if err != nil {
+		return "", err
+	}
+
+	if callbackUrl.Scheme != "http" {
+		return "", errors.New("oauth redirect url must be a http url the sync can listen on")
+	}
+
+	listener, err := net.Listen("tcp", callbackUrl.Host)
+	if err != nil {
+		return "", err
+	}
+
+	type callbackResult struct {
+		code string
+		err  error
+	}
+	results := make(chan callbackResult, 1)
+
+	path := callbackUrl.Path
+	if path == "" {
+		path = "/"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		var result callbackResult
+		switch {
+		case query.Get("error") != "":
+			result.err = errors.New("authorisation failed: " + query.Get("error"))
+		case query.Get("state") != state:
+			result.err = errors.New("received oauth callback with unknown state")
+		case query.Get("code") == "":
+			result.err = errors.New("received oauth callback without authorisation code")
+		default:
+			result.code = query.Get("code")
+		}
+
+		if result.err != nil {
+			http.Error(w, result.err.Error(), http.StatusBadRequest)
+		} else {
+			w.Write([]byte("Authorisation received, you can close this window."))
+		}
+
+		select {
+		case results <- result:
+		default:
+		}
+	})
+
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	defer server.Shutdown(context.Background())
+
+	select {
+	case result := <-results:
+		return result.code, result.err
+	case <-time.After(timeout):
+		return "", errors.New("timed out waiting for oauth callback")
+	}
+}
@@ -0,0 +1,72 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// StateVersion is the version of the data written to state files. Bump it when the stored data changes and add a
+// migration from the previous version to stateMigrations.
+const StateVersion = 1
+
+// stateEnvelope wraps the data of a state file with its version, so older files can be migrated when reading
+type stateEnvelope struct {
+	Version int             `json:"version"`
+	SavedAt time.Time       `json:"saved_at"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// stateMigrations upgrade the data of a state file from the version of the key to the next version. Files written
+// before the envelope existed are version 0 and hold the data without envelope.
+var stateMigrations = map[int]func(data json.RawMessage) (json.RawMessage, error){
+	0: func(data json.RawMessage) (json.RawMessage, error) { return data, nil },
+}
+
+// WriteStateFile stores the value as json in a versioned envelope. The file is replaced atomically and only readable
+// by the owner, a crash while writing leaves the previous file in place.
+func WriteStateFile(path string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(stateEnvelope{Version: StateVersion, SavedAt: time.Now(), Data: data}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(path, content, 0600)
+}
+
+// ReadStateFile reads the value from a state file written by WriteStateFile or by a version without envelope, and
+// migrates it to the current version. The error wraps os.ErrNotExist when the file does not exist.
+func ReadStateFile(path string, value interface{}) error {
+	content, err := ReadPrivateFile(path)
+	if err != nil {
+		return err
+	}
+
+	version, data := 0, json.RawMessage(content)
+	var envelope stateEnvelope
+	if err := json.Unmarshal(content, &envelope); err == nil && envelope.Version > 0 && envelope.Data != nil {
+		version, data = envelope.Version, envelope.Data
+	}
+
+	if version > StateVersion {
+		return fmt.Errorf("%s was written by a newer version, state version %d is not supported", path, version)
+	}
+
+	for ; version < StateVersion; version++ {
+		data, err = stateMigrations[version](data)
+		if err != nil {
+			return fmt.Errorf("cannot migrate %s from state version %d: %w", path, version, err)
+		}
+	}
+
+	if err := json.Unmarshal(data, value); err != nil {
+		return fmt.Errorf("cannot read %s: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package util_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/daanvanberkel/fireflyiiibunq/util"
+)
+
+type testState struct {
+	Token string `json:"token"`
+}
+
+func TestStateFile(t *testing.T) {
+	path := t.TempDir() + "/state.json"
+
+	if err := util.WriteStateFile(path, testState{Token: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the state file to be only readable by the owner, got %s", info.Mode().Perm())
+	}
+
+	var state testState
+	if err := util.ReadStateFile(path, &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Token != "secret" {
+		t.Errorf("expected the stored token, got %q", state.Token)
+	}
+
+	// Files written before the envelope existed hold the data directly
+	if err := os.WriteFile(path, []byte(`{"token":"legacy"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := util.ReadStateFile(path, &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Token != "legacy" {
+		t.Errorf("expected the token of the file without envelope, got %q", state.Token)
+	}
+
+	// Older versions stored the files readable by everyone, they are restricted to the owner when read
+	if err := os.Chmod(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := util.ReadStateFile(path, &state); err != nil {
+		t.Fatal(err)
+	}
+	info, err = os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the file of an older version to be restricted to the owner, got %s", info.Mode().Perm())
+	}
+
+	if err := os.WriteFile(path, []byte(`{"version":99,"data":{"token":"future"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := util.ReadStateFile(path, &state); err == nil || !strings.Contains(err.Error(), "newer version") {
+		t.Errorf("expected a file of a newer version to be rejected, got %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"token":"trunc`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := util.ReadStateFile(path, &state); err == nil {
+		t.Error("expected a truncated file to fail")
+	}
+
+	if err := util.ReadStateFile(t.TempDir()+"/missing.json", &state); !os.IsNotExist(err) {
+		t.Errorf("expected a missing file to be reported as not existing, got %v", err)
+	}
+}